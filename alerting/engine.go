@@ -0,0 +1,666 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+const (
+	// evaluationInterval is how often pending alerts and silences are re-evaluated
+	evaluationInterval = 15 * time.Second
+
+	// diskCheckInterval is how often disk rules query the daemon's disk usage
+	diskCheckInterval = 5 * time.Minute
+
+	// defaultRestartQuiet is how long a restart alert stays firing without
+	// further restarts when the rule has no explicit "for"
+	defaultRestartQuiet = 10 * time.Minute
+
+	// historySize bounds the number of resolved alerts kept in memory
+	historySize = 200
+)
+
+// reloadSignals are the signals, as numbers in kill events, that
+// containers commonly handle without exiting: SIGHUP, SIGUSR1, SIGUSR2 and
+// SIGWINCH
+var reloadSignals = map[string]bool{
+	"1":  true,
+	"10": true,
+	"12": true,
+	"28": true,
+}
+
+// ErrSilenceNotFound is returned when removing an unknown silence
+var ErrSilenceNotFound = errors.New("silence not found")
+
+type rule struct {
+	apitypes.AlertRule
+	duration time.Duration
+}
+
+type alertState struct {
+	alert       apitypes.Alert
+	rule        *rule
+	notified    bool
+	lastTrigger time.Time
+}
+
+// target identifies what an alert is about
+type target struct {
+	id      string
+	name    string
+	project string
+	service string
+}
+
+// Engine evaluates alert rules against the Docker event stream and the
+// stats collector, deduplicates alerts by rule and container, and delivers
+// firing and resolution notifications.
+type Engine struct {
+	client    *client.Client
+	rules     []*rule
+	notifiers map[string]Notifier
+
+	mu            sync.Mutex
+	alerts        map[string]*alertState
+	history       []apitypes.Alert
+	silences      map[string]apitypes.Silence
+	restartCounts map[string]int
+
+	// stopping holds the containers sent a terminating signal since they
+	// last started, whose next die is not a failure
+	stopping map[string]bool
+}
+
+// LoadConfig reads the alerting configuration from a JSON file. A missing
+// file yields an empty configuration.
+func LoadConfig(path string) (*apitypes.AlertConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &apitypes.AlertConfig{}, nil
+		}
+		return nil, err
+	}
+
+	var config apitypes.AlertConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// NewEngine validates the configuration and builds an engine
+func NewEngine(client *client.Client, config *apitypes.AlertConfig) (*Engine, error) {
+	e := &Engine{
+		client:        client,
+		notifiers:     make(map[string]Notifier),
+		alerts:        make(map[string]*alertState),
+		silences:      make(map[string]apitypes.Silence),
+		restartCounts: make(map[string]int),
+		stopping:      make(map[string]bool),
+	}
+
+	for _, nc := range config.Notifiers {
+		n, err := NewNotifier(nc)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := e.notifiers[n.Name()]; exists {
+			return nil, fmt.Errorf("duplicate notifier %s", n.Name())
+		}
+		e.notifiers[n.Name()] = n
+	}
+
+	names := make(map[string]bool)
+	for _, rc := range config.Rules {
+		r, err := e.compileRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+		e.rules = append(e.rules, r)
+	}
+
+	return e, nil
+}
+
+func (e *Engine) compileRule(rc apitypes.AlertRule) (*rule, error) {
+	if rc.Name == "" {
+		return nil, fmt.Errorf("rule name is required")
+	}
+
+	r := &rule{AlertRule: rc}
+	if rc.For != "" {
+		d, err := time.ParseDuration(rc.For)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: invalid for: %w", rc.Name, err)
+		}
+		r.duration = d
+	}
+
+	switch rc.Type {
+	case apitypes.AlertRuleUnhealthy, apitypes.AlertRuleExitCode:
+	case apitypes.AlertRuleRestart:
+		if r.duration == 0 {
+			r.duration = defaultRestartQuiet
+		}
+	case apitypes.AlertRuleMemory, apitypes.AlertRuleDisk:
+		if rc.Threshold <= 0 {
+			return nil, fmt.Errorf("rule %s: threshold is required", rc.Name)
+		}
+	default:
+		return nil, fmt.Errorf("rule %s: unknown type %q", rc.Name, rc.Type)
+	}
+
+	for _, name := range rc.Notifiers {
+		if _, ok := e.notifiers[name]; !ok {
+			return nil, fmt.Errorf("rule %s: unknown notifier %s", rc.Name, name)
+		}
+	}
+	return r, nil
+}
+
+// Run re-evaluates pending alerts, silences and disk rules until the
+// context is cancelled.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(evaluationInterval)
+	defer ticker.Stop()
+
+	var lastDiskCheck time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.evaluate(now)
+			if now.Sub(lastDiskCheck) >= diskCheckInterval {
+				e.checkDisk(ctx, now)
+				lastDiskCheck = now
+			}
+		}
+	}
+}
+
+// HandleEvent evaluates event-driven rules against a Docker event
+func (e *Engine) HandleEvent(msg events.Message) {
+	if msg.Type != events.ContainerEventType {
+		return
+	}
+
+	attrs := msg.Actor.Attributes
+	t := target{
+		id:      msg.Actor.ID,
+		name:    attrs["name"],
+		project: attrs["com.docker.compose.project"],
+		service: attrs["com.docker.compose.service"],
+	}
+	now := time.Now()
+	action := string(msg.Action)
+
+	switch {
+	case strings.HasPrefix(action, "health_status"):
+		status := strings.TrimSpace(strings.TrimPrefix(action, "health_status:"))
+		for _, r := range e.rulesOfType(apitypes.AlertRuleUnhealthy) {
+			if !r.matches(t) {
+				continue
+			}
+			if status == "unhealthy" {
+				e.activate(r, t, 0, fmt.Sprintf("Container %s is unhealthy", t.name), now)
+			} else if status == "healthy" {
+				e.resolve(r, t, now)
+			}
+		}
+	case msg.Action == events.ActionKill:
+		// Stop, down and rolling updates kill before the container dies;
+		// reload signals such as SIGHUP leave it running
+		if !reloadSignals[attrs["signal"]] {
+			e.mu.Lock()
+			e.stopping[t.id] = true
+			e.mu.Unlock()
+		}
+	case msg.Action == events.ActionDie:
+		e.mu.Lock()
+		stopped := e.stopping[t.id]
+		delete(e.stopping, t.id)
+		e.mu.Unlock()
+
+		// Memory and health no longer apply to a container that exited,
+		// including alerts still pending
+		e.resolveTarget(t, now, apitypes.AlertRuleMemory, apitypes.AlertRuleUnhealthy)
+
+		exitCode := attrs["exitCode"]
+		if exitCode == "" || exitCode == "0" || stopped {
+			return
+		}
+		for _, r := range e.rulesOfType(apitypes.AlertRuleExitCode) {
+			if r.matches(t) {
+				e.activate(r, t, 0, fmt.Sprintf("Container %s exited with code %s", t.name, exitCode), now)
+			}
+		}
+	case msg.Action == events.ActionStart:
+		e.mu.Lock()
+		delete(e.stopping, t.id)
+		e.mu.Unlock()
+		for _, r := range e.rulesOfType(apitypes.AlertRuleExitCode) {
+			if r.matches(t) {
+				e.resolve(r, t, now)
+			}
+		}
+		if len(e.rulesOfType(apitypes.AlertRuleRestart)) > 0 {
+			go e.checkRestart(t)
+		}
+	case msg.Action == events.ActionDestroy:
+		e.resolveTarget(t, now)
+		e.mu.Lock()
+		delete(e.restartCounts, t.id)
+		delete(e.stopping, t.id)
+		e.mu.Unlock()
+	}
+}
+
+// ObserveContainers evaluates stats-driven rules against a sampling round
+func (e *Engine) ObserveContainers(samples []docker.ContainerSample) {
+	rules := e.rulesOfType(apitypes.AlertRuleMemory)
+	if len(rules) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, s := range samples {
+		t := target{id: s.ID, name: s.Name, project: s.Project, service: s.Service}
+		for _, r := range rules {
+			if !r.matches(t) {
+				continue
+			}
+			if s.Stats.Memory.Percent > r.Threshold {
+				e.activate(r, t, s.Stats.Memory.Percent,
+					fmt.Sprintf("Container %s memory at %.1f%% of limit (threshold %.0f%%)", s.Name, s.Stats.Memory.Percent, r.Threshold), now)
+			} else {
+				e.resolve(r, t, now)
+			}
+		}
+	}
+}
+
+func (e *Engine) checkRestart(t target) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inspect, err := e.client.ContainerInspect(ctx, t.id)
+	if err != nil {
+		return
+	}
+
+	// The first start seen of a container only records its count, since
+	// restarts from before Kibutsu started were never observed
+	e.mu.Lock()
+	previous, seen := e.restartCounts[t.id]
+	e.restartCounts[t.id] = inspect.RestartCount
+	e.mu.Unlock()
+
+	if !seen || inspect.RestartCount <= previous {
+		return
+	}
+
+	now := time.Now()
+	for _, r := range e.rulesOfType(apitypes.AlertRuleRestart) {
+		if r.matches(t) {
+			e.activate(r, t, float64(inspect.RestartCount),
+				fmt.Sprintf("Container %s restarted (restart count %d)", t.name, inspect.RestartCount), now)
+		}
+	}
+}
+
+func (e *Engine) checkDisk(ctx context.Context, now time.Time) {
+	rules := e.rulesOfType(apitypes.AlertRuleDisk)
+	if len(rules) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	usage, err := e.client.DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		log.Printf("Warning: alerting failed to get disk usage: %v", err)
+		return
+	}
+
+	total := usage.LayersSize
+	for _, c := range usage.Containers {
+		total += c.SizeRw
+	}
+	for _, v := range usage.Volumes {
+		if v.UsageData != nil && v.UsageData.Size > 0 {
+			total += v.UsageData.Size
+		}
+	}
+	for _, b := range usage.BuildCache {
+		total += b.Size
+	}
+	gb := float64(total) / (1 << 30)
+
+	host := target{}
+	for _, r := range rules {
+		if gb > r.Threshold {
+			e.activate(r, host, gb, fmt.Sprintf("Docker disk usage at %.1f GB (threshold %.0f GB)", gb, r.Threshold), now)
+		} else {
+			e.resolve(r, host, now)
+		}
+	}
+}
+
+func (e *Engine) rulesOfType(ruleType string) []*rule {
+	var result []*rule
+	for _, r := range e.rules {
+		if r.Type == ruleType {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func (r *rule) matches(t target) bool {
+	if r.Container != "" && !globMatch(r.Container, t.name) {
+		return false
+	}
+	if r.Project != "" && r.Project != t.project {
+		return false
+	}
+	if r.Service != "" && r.Service != t.service {
+		return false
+	}
+	return true
+}
+
+func globMatch(pattern, name string) bool {
+	if ok, err := path.Match(pattern, name); err == nil {
+		return ok
+	}
+	return pattern == name
+}
+
+func fingerprint(r *rule, t target) string {
+	name := t.name
+	if name == "" {
+		name = "host"
+	}
+	return r.Name + "/" + name
+}
+
+// activate records that a rule's condition holds for a target. Alerts are
+// deduplicated by fingerprint, so repeated triggers only refresh the value.
+func (e *Engine) activate(r *rule, t target, value float64, summary string, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	fp := fingerprint(r, t)
+	st, exists := e.alerts[fp]
+	if !exists {
+		st = &alertState{
+			rule: r,
+			alert: apitypes.Alert{
+				Fingerprint: fp,
+				Rule:        r.Name,
+				Type:        r.Type,
+				Severity:    r.Severity,
+				Status:      apitypes.AlertPending,
+				Container:   t.name,
+				ContainerID: t.id,
+				Project:     t.project,
+				Service:     t.service,
+				StartsAt:    now,
+			},
+		}
+		e.alerts[fp] = st
+	}
+	st.alert.Value = value
+	st.alert.Summary = summary
+	st.lastTrigger = now
+	st.alert.Silenced = e.silencedLocked(st.alert, now)
+
+	// Restart rules use their duration as a quiet period, not a pending delay
+	if st.alert.Status == apitypes.AlertPending && (r.Type == apitypes.AlertRuleRestart || now.Sub(st.alert.StartsAt) >= r.duration) {
+		e.fireLocked(st, now)
+	}
+}
+
+func (e *Engine) fireLocked(st *alertState, now time.Time) {
+	st.alert.Status = apitypes.AlertFiring
+	st.alert.FiredAt = now
+	if !st.alert.Silenced {
+		st.notified = true
+		e.dispatch(st.rule, st.alert)
+	}
+}
+
+// resolve clears the alert for a rule and target, sending a resolution
+// notification if a firing notification went out.
+func (e *Engine) resolve(r *rule, t target, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resolveLocked(fingerprint(r, t), now)
+}
+
+// resolveTarget clears the alerts of a container, or only those of the
+// given rule types when any are passed
+func (e *Engine) resolveTarget(t target, now time.Time, ruleTypes ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for fp, st := range e.alerts {
+		if st.alert.ContainerID != t.id && (t.name == "" || st.alert.Container != t.name) {
+			continue
+		}
+		if len(ruleTypes) > 0 && !slices.Contains(ruleTypes, st.rule.Type) {
+			continue
+		}
+		e.resolveLocked(fp, now)
+	}
+}
+
+func (e *Engine) resolveLocked(fp string, now time.Time) {
+	st, ok := e.alerts[fp]
+	if !ok {
+		return
+	}
+	delete(e.alerts, fp)
+
+	wasFiring := st.alert.Status == apitypes.AlertFiring
+	st.alert.Status = apitypes.AlertResolved
+	st.alert.EndsAt = now
+
+	if wasFiring {
+		if st.notified {
+			e.dispatch(st.rule, st.alert)
+		}
+		e.history = append(e.history, st.alert)
+		if len(e.history) > historySize {
+			e.history = e.history[len(e.history)-historySize:]
+		}
+	}
+}
+
+func (e *Engine) evaluate(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for id, s := range e.silences {
+		if now.After(s.EndsAt) {
+			delete(e.silences, id)
+		}
+	}
+
+	for fp, st := range e.alerts {
+		st.alert.Silenced = e.silencedLocked(st.alert, now)
+
+		switch st.alert.Status {
+		case apitypes.AlertPending:
+			if now.Sub(st.alert.StartsAt) >= st.rule.duration {
+				e.fireLocked(st, now)
+			}
+		case apitypes.AlertFiring:
+			if st.rule.Type == apitypes.AlertRuleRestart && now.Sub(st.lastTrigger) >= st.rule.duration {
+				e.resolveLocked(fp, now)
+				continue
+			}
+			// Deliver alerts whose silence expired while they were firing
+			if !st.notified && !st.alert.Silenced {
+				st.notified = true
+				e.dispatch(st.rule, st.alert)
+			}
+		}
+	}
+}
+
+func (e *Engine) silencedLocked(alert apitypes.Alert, now time.Time) bool {
+	for _, s := range e.silences {
+		if now.Before(s.StartsAt) || now.After(s.EndsAt) {
+			continue
+		}
+		if s.Rule != "" && s.Rule != alert.Rule {
+			continue
+		}
+		if s.Container != "" && !globMatch(s.Container, alert.Container) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// dispatch delivers an alert to the rule's notifiers without blocking
+// evaluation on slow endpoints.
+func (e *Engine) dispatch(r *rule, alert apitypes.Alert) {
+	var targets []Notifier
+	if len(r.Notifiers) == 0 {
+		for _, n := range e.notifiers {
+			targets = append(targets, n)
+		}
+	} else {
+		for _, name := range r.Notifiers {
+			targets = append(targets, e.notifiers[name])
+		}
+	}
+
+	for _, n := range targets {
+		go func(n Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := n.Notify(ctx, alert); err != nil {
+				log.Printf("Warning: notifier %s failed to deliver %s: %v", n.Name(), alert.Fingerprint, err)
+			}
+		}(n)
+	}
+}
+
+// Alerts returns pending and firing alerts
+func (e *Engine) Alerts() []apitypes.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]apitypes.Alert, 0, len(e.alerts))
+	for _, st := range e.alerts {
+		result = append(result, st.alert)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartsAt.Before(result[j].StartsAt)
+	})
+	return result
+}
+
+// History returns recently resolved alerts, newest first
+func (e *Engine) History() []apitypes.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]apitypes.Alert, len(e.history))
+	for i, a := range e.history {
+		result[len(e.history)-1-i] = a
+	}
+	return result
+}
+
+// Rules returns the configured rules
+func (e *Engine) Rules() []apitypes.AlertRule {
+	result := make([]apitypes.AlertRule, len(e.rules))
+	for i, r := range e.rules {
+		result[i] = r.AlertRule
+	}
+	return result
+}
+
+// Silences returns the active silences
+func (e *Engine) Silences() []apitypes.Silence {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]apitypes.Silence, 0, len(e.silences))
+	for _, s := range e.silences {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].EndsAt.Before(result[j].EndsAt)
+	})
+	return result
+}
+
+// AddSilence registers a silence and applies it to current alerts
+func (e *Engine) AddSilence(s apitypes.Silence) (apitypes.Silence, error) {
+	if s.Rule == "" && s.Container == "" {
+		return s, fmt.Errorf("silence requires a rule or container matcher")
+	}
+
+	now := time.Now()
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(now) || !s.EndsAt.After(s.StartsAt) {
+		return s, fmt.Errorf("silence must end in the future")
+	}
+	s.ID = uuid.New().String()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.silences[s.ID] = s
+	for _, st := range e.alerts {
+		st.alert.Silenced = e.silencedLocked(st.alert, now)
+	}
+	return s, nil
+}
+
+// RemoveSilence expires a silence immediately
+func (e *Engine) RemoveSilence(id string) error {
+	e.mu.Lock()
+	if _, ok := e.silences[id]; !ok {
+		e.mu.Unlock()
+		return ErrSilenceNotFound
+	}
+	delete(e.silences, id)
+	e.mu.Unlock()
+
+	e.evaluate(time.Now())
+	return nil
+}
@@ -0,0 +1,210 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+)
+
+// Notifier delivers alert state changes to an external system
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert apitypes.Alert) error
+}
+
+// NewNotifier builds a notifier from its configuration
+func NewNotifier(config apitypes.NotifierConfig) (Notifier, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("notifier name is required")
+	}
+
+	switch config.Type {
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("notifier %s: url is required", config.Name)
+		}
+		return &WebhookNotifier{name: config.Name, url: config.URL, headers: config.Headers, client: newHTTPClient()}, nil
+	case "slack":
+		if config.URL == "" {
+			return nil, fmt.Errorf("notifier %s: url is required", config.Name)
+		}
+		return &SlackNotifier{name: config.Name, url: config.URL, client: newHTTPClient()}, nil
+	case "smtp":
+		if config.Host == "" || config.From == "" || len(config.To) == 0 {
+			return nil, fmt.Errorf("notifier %s: host, from and to are required", config.Name)
+		}
+		port := config.Port
+		if port == 0 {
+			port = 25
+		}
+		return &SMTPNotifier{
+			name:     config.Name,
+			addr:     net.JoinHostPort(config.Host, strconv.Itoa(port)),
+			host:     config.Host,
+			username: config.Username,
+			password: config.Password,
+			from:     config.From,
+			to:       config.To,
+		}, nil
+	default:
+		return nil, fmt.Errorf("notifier %s: unknown type %q", config.Name, config.Type)
+	}
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// WebhookNotifier posts the alert as JSON to an arbitrary endpoint
+type WebhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (n *WebhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert apitypes.Alert) error {
+	return postJSON(ctx, n.client, n.url, n.headers, alert)
+}
+
+// SlackNotifier posts a Slack-format incoming webhook message. Any service
+// accepting Slack's payload (Mattermost, Rocket.Chat, ...) works as well.
+type SlackNotifier struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func (n *SlackNotifier) Name() string {
+	return n.name
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, alert apitypes.Alert) error {
+	color := "danger"
+	if alert.Status == apitypes.AlertResolved {
+		color = "good"
+	}
+
+	fields := []map[string]interface{}{
+		{"title": "Rule", "value": alert.Rule, "short": true},
+		{"title": "Status", "value": alert.Status, "short": true},
+	}
+	if alert.Container != "" {
+		fields = append(fields, map[string]interface{}{"title": "Container", "value": alert.Container, "short": true})
+	}
+	if alert.Severity != "" {
+		fields = append(fields, map[string]interface{}{"title": "Severity", "value": alert.Severity, "short": true})
+	}
+
+	payload := map[string]interface{}{
+		"text": subject(alert),
+		"attachments": []map[string]interface{}{
+			{
+				"color":  color,
+				"text":   alert.Summary,
+				"fields": fields,
+				"ts":     alert.StartsAt.Unix(),
+			},
+		},
+	}
+	return postJSON(ctx, n.client, n.url, nil, payload)
+}
+
+// SMTPNotifier sends a plain-text email per alert
+type SMTPNotifier struct {
+	name     string
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *SMTPNotifier) Name() string {
+	return n.name
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, alert apitypes.Alert) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", n.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject(alert))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n\r\n", alert.Summary)
+	fmt.Fprintf(&body, "Rule:      %s\r\n", alert.Rule)
+	fmt.Fprintf(&body, "Status:    %s\r\n", alert.Status)
+	if alert.Container != "" {
+		fmt.Fprintf(&body, "Container: %s\r\n", alert.Container)
+	}
+	fmt.Fprintf(&body, "Started:   %s\r\n", alert.StartsAt.Format(time.RFC3339))
+	if !alert.EndsAt.IsZero() {
+		fmt.Fprintf(&body, "Ended:     %s\r\n", alert.EndsAt.Format(time.RFC3339))
+	}
+
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(n.addr, auth, n.from, n.to, body.Bytes())
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func subject(alert apitypes.Alert) string {
+	target := alert.Container
+	if target == "" {
+		target = "host"
+	}
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(alert.Status), alert.Rule, target)
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
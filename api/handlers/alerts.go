@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"kibutsu/alerting"
+	apitypes "kibutsu/api/types"
+)
+
+type AlertHandler struct {
+	engine *alerting.Engine
+}
+
+func NewAlertHandler(engine *alerting.Engine) *AlertHandler {
+	return &AlertHandler{engine: engine}
+}
+
+func (h *AlertHandler) ListAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.engine.Alerts())
+}
+
+func (h *AlertHandler) ListHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.engine.History())
+}
+
+func (h *AlertHandler) ListRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.engine.Rules())
+}
+
+func (h *AlertHandler) ListSilences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.engine.Silences())
+}
+
+// CreateSilence accepts a silence with either an absolute endsAt or a
+// duration such as "2h".
+func (h *AlertHandler) CreateSilence(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		apitypes.Silence
+		Duration string `json:"duration,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	silence := req.Silence
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid duration: %v", err), http.StatusBadRequest)
+			return
+		}
+		start := silence.StartsAt
+		if start.IsZero() {
+			start = time.Now()
+		}
+		silence.EndsAt = start.Add(d)
+	}
+
+	created, err := h.engine.AddSilence(silence)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create silence: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func (h *AlertHandler) DeleteSilence(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/alerts/silences/")
+
+	if err := h.engine.RemoveSilence(id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, alerting.ErrSilenceNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to remove silence: %v", err), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,71 +15,86 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
-	"gopkg.in/yaml.v3"
 
 	apitypes "kibutsu/api/types"
 	"kibutsu/docker"
 )
 
+// maxComposeFileSize bounds the body of project create and update requests
+const maxComposeFileSize = 1 << 20
+
 type ComposeHandler struct {
-	client *client.Client
+	client     *client.Client
+	store      *docker.ComposeStore
+	catalog    *docker.ProjectCatalog
+	operations *docker.OperationManager
 }
 
-func NewComposeHandler(client *client.Client) *ComposeHandler {
-	return &ComposeHandler{client: client}
+func NewComposeHandler(client *client.Client, store *docker.ComposeStore, catalog *docker.ProjectCatalog, operations *docker.OperationManager) *ComposeHandler {
+	return &ComposeHandler{client: client, store: store, catalog: catalog, operations: operations}
 }
 
+// ListProjects serves GET /api/compose/projects: the project catalog,
+// merging stored and scanned directories, compose CLI labels and running
+// containers, with the drift between each project's files and containers
 func (h *ComposeHandler) ListProjects(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	// Filter containers with compose label
-	f := filters.NewArgs()
-	f.Add("label", "com.docker.compose.project")
-
-	containers, err := h.client.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: f,
-	})
+	projects, err := h.catalog.Projects(ctx)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to list compose projects: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Group containers by project
-	projects := make(map[string][]apitypes.ContainerResponse)
-	for _, c := range containers {
-		projectName := c.Labels["com.docker.compose.project"]
-		if projectName == "" {
-			continue
-		}
+	body, err := json.Marshal(projects)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode compose projects: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if checkNotModified(w, r, contentETag("p", body)) {
+		return
+	}
 
-		inspect, err := h.client.ContainerInspect(ctx, c.ID)
-		if err != nil {
-			continue
-		}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
 
-		created, _ := time.Parse(time.RFC3339Nano, inspect.Created)
-		projects[projectName] = append(projects[projectName], apitypes.ContainerResponse{
-			ID:      c.ID,
-			Name:    strings.TrimPrefix(inspect.Name, "/"),
-			Image:   c.Image,
-			Status:  c.Status,
-			Created: created,
-		})
+func (h *ComposeHandler) GetProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{MaskSecrets: true})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(projects)
+	json.NewEncoder(w).Encode(config)
 }
 
-func (h *ComposeHandler) GetProject(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+// GetProjectConfig serves GET /api/compose/projects/{name}/config: the
+// config after interpolation, with sensitive values masked. Variables may
+// be overridden with repeated env=KEY=VALUE query parameters.
+func (h *ComposeHandler) GetProjectConfig(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := loadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.MaskSecrets = true
 
-	config, err := h.loadComposeFile(name)
+	config, err := h.loadComposeFile(r.Context(), name, opts)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
 		return
 	}
 
@@ -86,85 +102,310 @@ func (h *ComposeHandler) GetProject(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(config)
 }
 
+// GetMergedConfig serves GET /api/compose/projects/{name}/merged: the
+// merged config of all project files together with the file each value
+// came from. It accepts the same parameters as GetProjectConfig.
+func (h *ComposeHandler) GetMergedConfig(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	opts, err := loadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.MaskSecrets = true
+
+	loc, err := h.catalog.Locate(r.Context(), name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to find project: %v", err), storeErrorStatus(err))
+		return
+	}
+	if len(opts.Files) == 0 {
+		opts.Files = loc.Files
+	}
+
+	merged, err := docker.MergeComposeProject(loc.Dir, opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
+
+// ProjectUp serves POST /api/compose/projects/{name}/up. It starts an up
+// operation, whose result is the plan it executed. removeOrphans=true
+// removes containers of services no longer in the config; dryRun=true
+// responds with the plan right away without applying it. waitTimeout
+// bounds the wait for each depends_on condition.
 func (h *ComposeHandler) ProjectUp(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
 
-	config, err := h.loadComposeFile(name)
+	opts, err := loadOptions(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-	defer cancel()
+	config, err := h.loadComposeFile(r.Context(), name, opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
 
-	if err := h.startProject(ctx, name, config); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to start project: %v", err), http.StatusInternalServerError)
+	profiles := activeProfiles(r)
+	q := r.URL.Query()
+	upOpts := docker.UpOptions{
+		RemoveOrphans: q.Get("removeOrphans") == "true",
+		DryRun:        q.Get("dryRun") == "true",
+	}
+	if wait := q.Get("waitTimeout"); wait != "" {
+		upOpts.WaitTimeout, err = time.ParseDuration(wait)
+		if err != nil || upOpts.WaitTimeout <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid waitTimeout %q", wait), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if upOpts.DryRun {
+		plan, err := h.startProject(r.Context(), name, config, profiles, upOpts, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to plan project: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	h.startOperation(w, name, apitypes.OperationUp, "", func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		return h.startProject(ctx, name, config, profiles, upOpts, report)
+	})
 }
 
+// ProjectDown serves POST /api/compose/projects/{name}/down. It starts a
+// down operation that stops and removes the containers of the project and
+// the project networks no longer in use. volumes=true also removes volumes,
+// rmi=all|local images, removeOrphans=true containers of services no longer
+// in its files, and timeout overrides every stop_grace_period.
 func (h *ComposeHandler) ProjectDown(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-	defer cancel()
+	profiles := activeProfiles(r)
+	q := r.URL.Query()
+	downOpts := docker.DownOptions{
+		Volumes:       q.Get("volumes") == "true",
+		RemoveImages:  q.Get("rmi"),
+		RemoveOrphans: q.Get("removeOrphans") == "true",
+	}
+	switch downOpts.RemoveImages {
+	case "", docker.RemoveImagesAll, docker.RemoveImagesLocal:
+	default:
+		http.Error(w, fmt.Sprintf("Invalid rmi %q, expected all or local", downOpts.RemoveImages), http.StatusBadRequest)
+		return
+	}
+	if timeout := q.Get("timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("Invalid timeout %q", timeout), http.StatusBadRequest)
+			return
+		}
+		downOpts.Timeout = &d
+	}
 
-	f := filters.NewArgs()
-	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", name))
+	// Containers are found by label, so a project whose files are gone
+	// can still be taken down; all of its services are then orphans. A
+	// config that fails to load is reported rather than treated as gone.
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
+	switch {
+	case err == nil:
+	case loadErrorStatus(err) == http.StatusNotFound:
+		config = &apitypes.ComposeConfig{}
+		downOpts.RemoveOrphans = true
+	default:
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
 
-	containers, err := h.client.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: f,
+	h.startOperation(w, name, apitypes.OperationDown, "", func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		composeProject, err := docker.NewComposeProject(h.client, name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compose project: %w", err)
+		}
+		composeProject.ActivateProfiles(profiles)
+		composeProject.OnProgress(report)
+		return composeProject.Down(ctx, downOpts)
 	})
+}
+
+// ProjectRestart serves POST /api/compose/projects/{name}/restart. It
+// starts an operation restarting the containers in dependency order.
+func (h *ComposeHandler) ProjectRestart(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
 		return
 	}
 
-	for _, c := range containers {
-		timeout := 30
-		if err := h.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: &timeout}); err != nil {
-			continue
-		}
-		if err := h.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
-			continue
+	profiles := activeProfiles(r)
+
+	h.startOperation(w, name, apitypes.OperationRestart, "", func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		composeProject, err := docker.NewComposeProject(h.client, name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compose project: %w", err)
 		}
+		composeProject.ActivateProfiles(profiles)
+		composeProject.OnProgress(report)
+		return nil, composeProject.Restart(ctx)
+	})
+}
+
+// ProjectPull serves POST /api/compose/projects/{name}/pull. It starts an
+// operation pulling the images of the project without recreating any
+// container; the next up recreates those whose image changed.
+func (h *ComposeHandler) ProjectPull(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	profiles := activeProfiles(r)
+
+	h.startOperation(w, name, apitypes.OperationPull, "", func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		composeProject, err := docker.NewComposeProject(h.client, name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compose project: %w", err)
+		}
+		composeProject.ActivateProfiles(profiles)
+		composeProject.OnProgress(report)
+		return nil, composeProject.Pull(ctx)
+	})
 }
 
+// ListServices serves GET /api/compose/projects/{name}/services: every
+// service with its status, replica counts, ports, image, dependencies and
+// containers
 func (h *ComposeHandler) ListServices(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
 
-	config, err := h.loadComposeFile(name)
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
 		return
 	}
 
-	services := make([]string, 0, len(config.Services))
-	for service := range config.Services {
-		services = append(services, service)
+	composeProject, err := docker.NewComposeProject(h.client, name, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	services, err := composeProject.Services(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list services: %v", err), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(services)
 }
 
+// ServiceAction serves POST /api/compose/projects/{name}/services/{service}/{action}
+// for start, stop, restart, recreate, kill, pause and unpause. It starts an
+// operation named after the action. cascade=true applies the action to
+// the dependents of the service too; kill sends signal, SIGKILL by default.
+func (h *ComposeHandler) ServiceAction(w http.ResponseWriter, r *http.Request) {
+	parts := projectPath(r)
+	if len(parts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	name, service, action := parts[0], parts[2], parts[3]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !docker.IsServiceAction(action) {
+		http.Error(w, fmt.Sprintf("Unknown service action %s", action), http.StatusBadRequest)
+		return
+	}
+
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	if _, ok := config.Services[service]; !ok {
+		http.Error(w, fmt.Sprintf("Service %s not found", service), http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := docker.ServiceActionOptions{
+		Cascade: q.Get("cascade") == "true",
+		Signal:  q.Get("signal"),
+	}
+
+	h.startOperation(w, name, action, service, func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		composeProject, err := docker.NewComposeProject(h.client, name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compose project: %w", err)
+		}
+		composeProject.ActivateProfiles(nil, service)
+		composeProject.OnProgress(report)
+		return composeProject.ServiceAction(ctx, service, action, opts)
+	})
+}
+
+// GetProjectLogs serves GET /api/compose/projects/{name}/logs: the last
+// lines of every container, leaving out services whose profiles are not
+// in activeProfiles
 func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimPrefix(r.URL.Path, "/api/compose/projects/")
-	name = strings.Split(name, "/")[0]
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
+	// Without readable files every container is shown
+	inactive := make(map[string]bool)
+	if config, err := h.loadComposeFile(ctx, name, docker.ComposeLoadOptions{}); err == nil {
+		if composeProject, err := docker.NewComposeProject(h.client, name, config); err == nil {
+			composeProject.ActivateProfiles(activeProfiles(r))
+			for _, service := range composeProject.InactiveServices() {
+				inactive[service] = true
+			}
+		}
+	}
+
 	f := filters.NewArgs()
 	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", name))
 
@@ -181,6 +422,9 @@ func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request)
 
 	for _, c := range containers {
 		serviceName := c.Labels["com.docker.compose.service"]
+		if inactive[serviceName] {
+			continue
+		}
 		fmt.Fprintf(w, "=== %s ===\n", serviceName)
 
 		options := container.LogsOptions{
@@ -201,7 +445,7 @@ func (h *ComposeHandler) GetProjectLogs(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ComposeHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/compose/projects/"), "/")
+	parts := projectPath(r)
 	if len(parts) < 4 {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
@@ -209,6 +453,10 @@ func (h *ComposeHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
 
 	projectName := parts[0]
 	serviceName := parts[2]
+	if err := docker.ValidateProjectName(projectName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var scaleReq struct {
 		Replicas int `json:"replicas"`
@@ -218,55 +466,165 @@ func (h *ComposeHandler) ScaleService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
-	defer cancel()
+	if scaleReq.Replicas < 0 {
+		http.Error(w, "Replicas must not be negative", http.StatusBadRequest)
+		return
+	}
 
-	if err := h.scaleService(ctx, projectName, serviceName, scaleReq.Replicas); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to scale service: %v", err), http.StatusInternalServerError)
+	config, err := h.loadComposeFile(r.Context(), projectName, docker.ComposeLoadOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	if _, ok := config.Services[serviceName]; !ok {
+		http.Error(w, fmt.Sprintf("Service %s not found", serviceName), http.StatusNotFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	h.startOperation(w, projectName, apitypes.OperationScale, serviceName, func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		return nil, h.scaleService(ctx, projectName, config, serviceName, scaleReq.Replicas, report)
+	})
 }
 
-func (h *ComposeHandler) loadComposeFile(project string) (*apitypes.ComposeConfig, error) {
-	path := filepath.Join("compose", project, "docker-compose.yml")
-	data, err := os.ReadFile(path)
+// UpdateService serves POST /api/compose/projects/{name}/services/{service}/update.
+// It starts an operation replacing the outdated replicas of the service
+// batch by batch, as set by its deploy.update_config.
+func (h *ComposeHandler) UpdateService(w http.ResponseWriter, r *http.Request) {
+	parts := projectPath(r)
+	if len(parts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	name, service := parts[0], parts[2]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
 	if err != nil {
-		return nil, err
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	if _, ok := config.Services[service]; !ok {
+		http.Error(w, fmt.Sprintf("Service %s not found", service), http.StatusNotFound)
+		return
 	}
 
-	var config apitypes.ComposeConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	h.startOperation(w, name, apitypes.OperationUpdate, service, func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		composeProject, err := docker.NewComposeProject(h.client, name, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create compose project: %w", err)
+		}
+		composeProject.ActivateProfiles(nil, service)
+		composeProject.OnProgress(report)
+		return composeProject.RollingUpdate(ctx, service)
+	})
+}
+
+// loadComposeFile loads a project from wherever the catalog locates it.
+// Projects found through compose CLI labels keep the files they were
+// started with unless the request names others.
+func (h *ComposeHandler) loadComposeFile(ctx context.Context, project string, opts docker.ComposeLoadOptions) (*apitypes.ComposeConfig, error) {
+	loc, err := h.catalog.Locate(ctx, project)
+	if err != nil {
 		return nil, err
 	}
+	if len(opts.Files) == 0 {
+		opts.Files = loc.Files
+	}
+	return docker.LoadComposeProject(loc.Dir, opts)
+}
+
+// loadOptions reads the per-request load options: env=KEY=VALUE
+// interpolation overrides and a files=a.yml,b.yml list that replaces the
+// default compose files
+func loadOptions(r *http.Request) (docker.ComposeLoadOptions, error) {
+	q := r.URL.Query()
+	opts := docker.ComposeLoadOptions{Files: queryList(q["files"])}
+	for _, name := range opts.Files {
+		clean := filepath.Clean(name)
+		if filepath.IsAbs(clean) || strings.HasPrefix(clean, "~") || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return opts, fmt.Errorf("compose file %s is outside the project directory", name)
+		}
+	}
 
-	return &config, nil
+	if values := q["env"]; len(values) > 0 {
+		opts.Environment = make(map[string]string, len(values))
+		for _, v := range values {
+			key, value, ok := strings.Cut(v, "=")
+			if !ok || key == "" {
+				return opts, fmt.Errorf("invalid env override %q, expected KEY=VALUE", v)
+			}
+			opts.Environment[key] = value
+		}
+	}
+	return opts, nil
 }
 
-func (h *ComposeHandler) startProject(ctx context.Context, project string, config *apitypes.ComposeConfig) error {
-	composeProject, err := docker.NewComposeProject(h.client, project, config)
-	if err != nil {
-		return fmt.Errorf("failed to create compose project: %w", err)
+// loadErrorStatus maps a compose load error to an HTTP status
+func loadErrorStatus(err error) int {
+	if os.IsNotExist(err) || errors.Is(err, docker.ErrProjectNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// projectName returns the validated project name of the request, writing
+// a 400 response when it is invalid
+func projectName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := projectPath(r)[0]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
 	}
+	return name, true
+}
 
-	if err := composeProject.Up(ctx); err != nil {
-		return fmt.Errorf("failed to start project: %w", err)
+// activeProfiles returns the profiles named by repeated or comma-separated
+// activeProfiles query parameters
+func activeProfiles(r *http.Request) []string {
+	var profiles []string
+	for _, value := range r.URL.Query()["activeProfiles"] {
+		for _, profile := range strings.Split(value, ",") {
+			if profile = strings.TrimSpace(profile); profile != "" {
+				profiles = append(profiles, profile)
+			}
+		}
 	}
+	return profiles
+}
 
-	return nil
+// projectPath splits /api/compose/projects/{project}/... paths into their
+// segments, with or without the /api mount prefix
+func projectPath(r *http.Request) []string {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/compose/projects/")
+	return strings.Split(path, "/")
 }
 
-func (h *ComposeHandler) scaleService(ctx context.Context, project, service string, replicas int) error {
-	config, err := h.loadComposeFile(project)
+func (h *ComposeHandler) startProject(ctx context.Context, project string, config *apitypes.ComposeConfig, profiles []string, opts docker.UpOptions, report func(apitypes.ComposeProgress)) (*apitypes.ComposePlan, error) {
+	composeProject, err := docker.NewComposeProject(h.client, project, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compose project: %w", err)
+	}
+	composeProject.ActivateProfiles(profiles)
+	composeProject.OnProgress(report)
+
+	plan, err := composeProject.Up(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("failed to load compose file: %w", err)
+		return plan, fmt.Errorf("failed to start project: %w", err)
 	}
 
+	return plan, nil
+}
+
+func (h *ComposeHandler) scaleService(ctx context.Context, project string, config *apitypes.ComposeConfig, service string, replicas int, report func(apitypes.ComposeProgress)) error {
 	composeProject, err := docker.NewComposeProject(h.client, project, config)
 	if err != nil {
 		return fmt.Errorf("failed to create compose project: %w", err)
 	}
+	composeProject.ActivateProfiles(nil, service)
+	composeProject.OnProgress(report)
 
 	if err := composeProject.Scale(ctx, service, replicas); err != nil {
 		return fmt.Errorf("failed to scale service: %w", err)
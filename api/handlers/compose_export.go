@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"gopkg.in/yaml.v3"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// ExportCompose serves GET /api/containers/export-compose?ids=a,b: a
+// compose file reverse-engineered from the given containers. ids may also
+// be repeated.
+func (h *ContainerHandler) ExportCompose(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	for _, value := range r.URL.Query()["ids"] {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	export, err := docker.ExportContainers(ctx, h.client, ids)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if client.IsErrNotFound(err) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to export containers: %v", err), status)
+		return
+	}
+	writeComposeExport(w, r, export)
+}
+
+// ExportProject serves GET /api/compose/projects/{name}/export: the
+// compose file of the project rebuilt from its containers
+func (h *ComposeHandler) ExportProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	export, err := docker.ExportProject(ctx, h.client, name)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, docker.ErrProjectNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("Failed to export project: %v", err), status)
+		return
+	}
+	writeComposeExport(w, r, export)
+}
+
+// writeComposeExport writes an export as YAML with the warnings as leading
+// comments, or as JSON with format=json
+func writeComposeExport(w http.ResponseWriter, r *http.Request, export *apitypes.ComposeExport) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+		return
+	}
+
+	var b strings.Builder
+	for _, warning := range export.Warnings {
+		fmt.Fprintf(&b, "# Warning: %s\n", warning)
+	}
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(export.Config); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode compose file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	enc.Close()
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+	"kibutsu/metrics"
+)
+
+// ListOperations serves GET /api/compose/operations, newest first.
+// project=name limits the list to one project.
+func (h *ComposeHandler) ListOperations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.operations.List(r.URL.Query().Get("project")))
+}
+
+// GetOperation serves GET /api/compose/operations/{id}
+func (h *ComposeHandler) GetOperation(w http.ResponseWriter, r *http.Request) {
+	op, err := h.operations.Get(operationID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(op)
+}
+
+// CancelOperation serves DELETE /api/compose/operations/{id}. Steps that
+// already ran are not undone.
+func (h *ComposeHandler) CancelOperation(w http.ResponseWriter, r *http.Request) {
+	op, err := h.operations.Cancel(operationID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(op)
+}
+
+// OperationEvents serves the WebSocket at /api/compose/operations/{id}/events.
+// Steps reported so far are replayed as progress events, followed by live
+// ones; the final operation event is sent once it finishes.
+func (h *ComposeHandler) OperationEvents(w http.ResponseWriter, r *http.Request) {
+	id := operationID(r)
+	past, steps, unsubscribe, err := h.operations.Subscribe(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		defer unsubscribe()
+		metrics.WebSocketConnections.Inc("compose_operation")
+		defer metrics.WebSocketConnections.Dec("compose_operation")
+
+		// Operations can run for longer than the server's write deadline
+		ws.SetDeadline(time.Time{})
+
+		for i := range past {
+			if err := websocket.JSON.Send(ws, apitypes.ComposeOperationEvent{Type: "progress", Progress: &past[i]}); err != nil {
+				return
+			}
+		}
+		for step := range steps {
+			if err := websocket.JSON.Send(ws, apitypes.ComposeOperationEvent{Type: "progress", Progress: &step}); err != nil {
+				return
+			}
+		}
+
+		op, err := h.operations.Get(id)
+		if err != nil {
+			return
+		}
+		if err := websocket.JSON.Send(ws, apitypes.ComposeOperationEvent{Type: "operation", Operation: &op}); err != nil {
+			log.Printf("Error sending websocket message: %v", err)
+		}
+	}).ServeHTTP(w, r)
+}
+
+// startOperation runs fn as a background operation and responds with 202
+// and the operation, or 409 while the project has another one running
+func (h *ComposeHandler) startOperation(w http.ResponseWriter, project, opType, service string, fn docker.OperationFunc) {
+	op, err := h.operations.Start(project, opType, service, fn)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, docker.ErrOperationInProgress) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Failed to start %s: %v", opType, err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/compose/operations/"+op.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// operationID returns the {id} segment of /api/compose/operations/{id}/...
+func operationID(r *http.Request) string {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/compose/operations/")
+	id, _, _ := strings.Cut(path, "/")
+	return id
+}
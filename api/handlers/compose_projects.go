@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+
+	"kibutsu/docker"
+)
+
+// CreateProject serves POST /api/compose/projects/{name}. The body is the
+// compose file; it is validated before the project is written.
+func (h *ComposeHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	content, ok := readComposeBody(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.validateDraft(w, r, name, "docker-compose.yml", content) {
+		return
+	}
+
+	if err := h.store.Create(name, content); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create project: %v", err), storeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UpdateProject serves PUT /api/compose/projects/{name}. The previous
+// compose file is kept in the project history.
+func (h *ComposeHandler) UpdateProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	content, ok := readComposeBody(w, r)
+	if !ok {
+		return
+	}
+
+	path, err := h.store.MainFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.validateDraft(w, r, name, filepath.Base(path), content) {
+		return
+	}
+
+	if err := h.store.Update(name, content); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update project: %v", err), storeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteProject serves DELETE /api/compose/projects/{name}. Projects that
+// still have containers must be brought down first.
+func (h *ComposeHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", name))
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list project containers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(containers) > 0 {
+		http.Error(w, fmt.Sprintf("Project %s still has %d containers, bring it down first", name, len(containers)), http.StatusConflict)
+		return
+	}
+
+	if err := h.store.Delete(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete project: %v", err), storeErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ValidateProject serves POST /api/compose/projects/{name}/validate. With a
+// body, the body is validated in place of the main compose file; without
+// one, the files on disk are validated. Errors carry file, line and column.
+func (h *ComposeHandler) ValidateProject(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	content, ok := readComposeBody(w, r)
+	if !ok {
+		return
+	}
+	if len(content) == 0 {
+		content = nil
+	}
+
+	opts, err := loadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unknown projects are validated as they would be stored
+	loc, err := h.catalog.Locate(r.Context(), name)
+	if errors.Is(err, docker.ErrProjectNotFound) {
+		loc.Dir, err = h.store.ProjectDir(name)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to find project: %v", err), storeErrorStatus(err))
+		return
+	}
+	if len(opts.Files) == 0 {
+		opts.Files = loc.Files
+	}
+
+	file, err := filepath.Rel(loc.Dir, loc.MainFile())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to find project: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result := docker.ValidateComposeProject(loc.Dir, file, content, opts)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ListHistory serves GET /api/compose/projects/{name}/history
+func (h *ComposeHandler) ListHistory(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := h.store.History(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list history: %v", err), storeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// GetVersion serves GET /api/compose/projects/{name}/history/{version}
+func (h *ComposeHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	name, ok := projectName(w, r)
+	if !ok {
+		return
+	}
+
+	parts := projectPath(r)
+	version, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || version < 1 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	content, err := h.store.Version(name, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read version: %v", err), storeErrorStatus(err))
+		return
+	}
+	// Saved versions are returned as written, apart from their secrets
+	content, err = docker.MaskComposeYAML(content)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse version: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(content)
+}
+
+// validateDraft validates content as the given project file, writing a 422
+// response with the errors when it is invalid
+func (h *ComposeHandler) validateDraft(w http.ResponseWriter, r *http.Request, name, file string, content []byte) bool {
+	opts, err := loadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	dir, err := h.store.ProjectDir(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	result := docker.ValidateComposeProject(dir, file, content, opts)
+	if result.Valid {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(result)
+	return false
+}
+
+func readComposeBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxComposeFileSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return content, true
+}
+
+// storeErrorStatus maps compose store errors to HTTP statuses
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, docker.ErrInvalidProjectName):
+		return http.StatusBadRequest
+	case errors.Is(err, docker.ErrProjectExists):
+		return http.StatusConflict
+	case errors.Is(err, docker.ErrProjectNotFound), errors.Is(err, docker.ErrVersionNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/net/websocket"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+	"kibutsu/metrics"
+)
+
+// RunService serves POST /api/compose/projects/{name}/services/{service}/run.
+// It registers a one-off container of the service with the overrides in
+// the body and responds with 201 and the WebSocket URL that creates and
+// starts it.
+func (h *ComposeHandler) RunService(w http.ResponseWriter, r *http.Request) {
+	parts := projectPath(r)
+	if len(parts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	name, service := parts[0], parts[2]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var runReq apitypes.ComposeRunRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&runReq); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	config, err := h.loadComposeFile(r.Context(), name, docker.ComposeLoadOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	if _, ok := config.Services[service]; !ok {
+		http.Error(w, fmt.Sprintf("Service %s not found", service), http.StatusNotFound)
+		return
+	}
+
+	composeProject, err := docker.NewComposeProject(h.client, name, config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	composeProject.ActivateProfiles(nil, service)
+
+	run, err := composeProject.Run(service, docker.RunOptions{
+		Command:     runReq.Command,
+		Entrypoint:  runReq.Entrypoint,
+		Environment: runReq.Environment,
+		User:        runReq.User,
+		WorkingDir:  runReq.WorkingDir,
+		Tty:         runReq.Tty,
+		Remove:      runReq.Remove == nil || *runReq.Remove,
+		NoDeps:      runReq.NoDeps,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to run service: %v", err), http.StatusInternalServerError)
+		return
+	}
+	run.Attach = fmt.Sprintf("/api/compose/projects/%s/services/%s/run/%s", name, service, run.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", run.Attach)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(run)
+}
+
+// AttachRun serves the WebSocket at
+// /api/compose/projects/{name}/services/{service}/run/{id}. It pulls the
+// image, starts the dependencies, sending each step as a progress message,
+// then creates and starts the one-off container and speaks the terminal
+// protocol: output messages
+// carry stdout, and stderr when there is no terminal; input and resize
+// messages are accepted with a terminal. An exit message with the exit
+// code ends the session, and an error message a failed attach, e.g. to a
+// container that was already started. Closing the WebSocket before the
+// container exits stops it.
+func (h *ComposeHandler) AttachRun(w http.ResponseWriter, r *http.Request) {
+	parts := projectPath(r)
+	if len(parts) < 5 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	name, id := parts[0], parts[4]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The run holds the project it was registered with, so the project
+	// files are not needed to attach
+	composeProject, err := docker.NewComposeProject(h.client, name, &apitypes.ComposeConfig{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create compose project: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		metrics.WebSocketConnections.Inc("compose_run")
+		defer metrics.WebSocketConnections.Dec("compose_run")
+
+		// A run can outlast the request timeout and the server's write
+		// deadline, so the session lives until the socket closes
+		ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		defer cancel()
+		ws.SetDeadline(time.Time{})
+
+		// The container is created and started only once a client is connected
+		composeProject.OnProgress(func(p apitypes.ComposeProgress) {
+			websocket.JSON.Send(ws, TerminalMessage{Type: "progress", Data: formatProgress(p)})
+		})
+		attachment, err := composeProject.AttachRun(ctx, id)
+		if err != nil {
+			websocket.JSON.Send(ws, TerminalMessage{Type: "error", Data: fmt.Sprintf("Failed to attach to one-off container: %v", err)})
+			return
+		}
+		defer attachment.Close()
+
+		var once sync.Once
+		detach := func() {
+			once.Do(func() {
+				stopCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				defer cancel()
+				if err := attachment.Stop(stopCtx); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			})
+		}
+
+		go func() {
+			for {
+				var msg TerminalMessage
+				if err := websocket.JSON.Receive(ws, &msg); err != nil {
+					if err == io.EOF {
+						detach()
+					}
+					return
+				}
+				if !attachment.Tty {
+					continue
+				}
+
+				switch msg.Type {
+				case "resize":
+					if err := attachment.Resize(ctx, msg.Rows, msg.Cols); err != nil {
+						log.Printf("Error resizing terminal: %v", err)
+					}
+				case "input":
+					if _, err := attachment.Conn.Write([]byte(msg.Data)); err != nil {
+						log.Printf("Error writing to container: %v", err)
+						return
+					}
+				}
+			}
+		}()
+
+		stdout := &terminalWriter{ws: ws, msgType: "output"}
+		if attachment.Tty {
+			_, err = io.Copy(stdout, attachment.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(stdout, &terminalWriter{ws: ws, msgType: "stderr"}, attachment.Reader)
+		}
+		if err != nil {
+			log.Printf("Error streaming one-off container output: %v", err)
+			detach()
+		}
+
+		code, err := attachment.Wait()
+		if err != nil {
+			websocket.JSON.Send(ws, TerminalMessage{Type: "error", Data: err.Error()})
+			return
+		}
+		websocket.JSON.Send(ws, TerminalMessage{
+			Type:     "exit",
+			Data:     fmt.Sprintf("Process exited with code %d", code),
+			ExitCode: &code,
+		})
+	}).ServeHTTP(w, r)
+}
+
+// formatProgress renders a progress step as a line of text
+func formatProgress(p apitypes.ComposeProgress) string {
+	line := p.Step
+	if p.Container != "" {
+		line = fmt.Sprintf("%s %s", p.Container, p.Step)
+	} else if p.Service != "" {
+		line = fmt.Sprintf("%s %s", p.Service, p.Step)
+	}
+	if p.Message != "" {
+		line = fmt.Sprintf("%s: %s", line, p.Message)
+	}
+	return line
+}
+
+// terminalWriter sends what is written to it as terminal messages
+type terminalWriter struct {
+	ws      *websocket.Conn
+	msgType string
+}
+
+func (t *terminalWriter) Write(p []byte) (int, error) {
+	if err := websocket.JSON.Send(t.ws, TerminalMessage{Type: t.msgType, Data: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+const (
+	// inspectConcurrency bounds the ContainerInspect calls in flight per request
+	inspectConcurrency = 8
+
+	// maxPageSize caps the limit parameter of paginated list requests
+	maxPageSize = 500
+)
+
+// containerStatuses are the values accepted by the status filter
+var containerStatuses = map[string]bool{
+	"created":    true,
+	"restarting": true,
+	"running":    true,
+	"removing":   true,
+	"paused":     true,
+	"exited":     true,
+	"dead":       true,
+}
+
+// containerSortKeys maps the sort parameter to the key it orders by
+var containerSortKeys = map[string]func(c types.Container) string{
+	"name": func(c types.Container) string {
+		return strings.ToLower(summaryName(c))
+	},
+	"created": func(c types.Container) string {
+		return fmt.Sprintf("%020d", c.Created)
+	},
+	"status": func(c types.Container) string {
+		return c.State
+	},
+	"image": func(c types.Container) string {
+		return strings.ToLower(c.Image)
+	},
+}
+
+// containerQuery holds the parsed list parameters of GET /api/containers
+type containerQuery struct {
+	filters filters.Args
+	search  string
+	sortBy  string
+	desc    bool
+	limit   int
+	cursor  *containerCursor
+	detail  bool
+
+	statuses []string
+	healths  []string
+	labels   []string
+	names    []*regexp.Regexp
+	images   []string
+	networks []string
+}
+
+// containerCursor marks the last item of a page. It is opaque to clients.
+type containerCursor struct {
+	Key string `json:"k"`
+	ID  string `json:"id"`
+}
+
+// parseContainerQuery turns query parameters into Docker filters and
+// in-memory search, sort and pagination settings. List-valued parameters
+// may be repeated or comma separated.
+func parseContainerQuery(r *http.Request) (*containerQuery, error) {
+	q := r.URL.Query()
+	cq := &containerQuery{
+		filters: filters.NewArgs(),
+		sortBy:  "created",
+		desc:    true,
+	}
+
+	cq.statuses = queryList(q["status"])
+	for _, status := range cq.statuses {
+		if !containerStatuses[status] {
+			return nil, fmt.Errorf("invalid status filter: %s", status)
+		}
+		cq.filters.Add("status", status)
+	}
+	cq.healths = queryList(q["health"])
+	for _, health := range cq.healths {
+		if !healthStatuses[health] {
+			return nil, fmt.Errorf("invalid health filter: %s", health)
+		}
+		cq.filters.Add("health", health)
+	}
+	for _, label := range q["label"] {
+		cq.labels = append(cq.labels, label)
+		cq.filters.Add("label", label)
+	}
+	for _, project := range queryList(q["project"]) {
+		cq.labels = append(cq.labels, "com.docker.compose.project="+project)
+		cq.filters.Add("label", "com.docker.compose.project="+project)
+	}
+	for _, name := range queryList(q["name"]) {
+		// The daemon matches names as regular expressions
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name filter: %s", name)
+		}
+		cq.names = append(cq.names, re)
+		cq.filters.Add("name", name)
+	}
+	cq.images = queryList(q["image"])
+	for _, image := range cq.images {
+		cq.filters.Add("ancestor", image)
+	}
+	cq.networks = queryList(q["network"])
+	for _, network := range cq.networks {
+		cq.filters.Add("network", network)
+	}
+
+	cq.search = strings.ToLower(strings.TrimSpace(q.Get("search")))
+
+	if sortParam := q.Get("sort"); sortParam != "" {
+		cq.desc = strings.HasPrefix(sortParam, "-")
+		cq.sortBy = strings.TrimPrefix(sortParam, "-")
+		if _, ok := containerSortKeys[cq.sortBy]; !ok {
+			return nil, fmt.Errorf("invalid sort key: %s", cq.sortBy)
+		}
+	}
+
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit: %s", limit)
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		cq.limit = n
+	}
+
+	if cursor := q.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		var c containerCursor
+		if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		cq.cursor = &c
+	}
+
+	if detail := q.Get("detail"); detail != "" {
+		on, err := strconv.ParseBool(detail)
+		if err != nil {
+			return nil, fmt.Errorf("invalid detail flag: %s", detail)
+		}
+		cq.detail = on
+	}
+
+	return cq, nil
+}
+
+// matchesCached evaluates the daemon-side filters against a cached
+// container. Values of one filter are ORed, different filters are ANDed,
+// as the daemon does.
+func (cq *containerQuery) matchesCached(cc docker.CachedContainer) bool {
+	c := cc.Summary
+
+	if len(cq.statuses) > 0 && !containsString(cq.statuses, c.State) {
+		return false
+	}
+
+	if len(cq.healths) > 0 {
+		health := "none"
+		if cc.Inspect.State != nil && cc.Inspect.State.Health != nil {
+			health = cc.Inspect.State.Health.Status
+		}
+		if !containsString(cq.healths, health) {
+			return false
+		}
+	}
+
+	for _, label := range cq.labels {
+		key, value, hasValue := strings.Cut(label, "=")
+		actual, ok := c.Labels[key]
+		if !ok || (hasValue && actual != value) {
+			return false
+		}
+	}
+
+	if len(cq.names) > 0 {
+		matched := false
+		for _, name := range cq.names {
+			for _, n := range c.Names {
+				if name.MatchString(n) || name.MatchString(strings.TrimPrefix(n, "/")) {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(cq.images) > 0 {
+		matched := false
+		for _, image := range cq.images {
+			if c.Image == image || strings.TrimSuffix(c.Image, ":latest") == strings.TrimSuffix(image, ":latest") ||
+				c.ImageID == image || strings.TrimPrefix(c.ImageID, "sha256:") == image ||
+				(len(image) >= 12 && strings.HasPrefix(strings.TrimPrefix(c.ImageID, "sha256:"), image)) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(cq.networks) > 0 {
+		matched := false
+		if c.NetworkSettings != nil {
+			for name, endpoint := range c.NetworkSettings.Networks {
+				for _, network := range cq.networks {
+					if name == network || (endpoint != nil && endpoint.NetworkID == network) {
+						matched = true
+					}
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apply searches, sorts and paginates containers already filtered by the
+// daemon. It returns the page, the cursor for the next page (empty on the
+// last page) and the number of matches before pagination.
+func (cq *containerQuery) apply(containers []types.Container) ([]types.Container, string, int) {
+	matched := containers
+	if cq.search != "" {
+		matched = make([]types.Container, 0, len(containers))
+		for _, c := range containers {
+			if matchesSearch(c, cq.search) {
+				matched = append(matched, c)
+			}
+		}
+	}
+
+	keyOf := containerSortKeys[cq.sortBy]
+	less := func(aKey, aID, bKey, bID string) bool {
+		if aKey != bKey {
+			if cq.desc {
+				return aKey > bKey
+			}
+			return aKey < bKey
+		}
+		return aID < bID
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return less(keyOf(matched[i]), matched[i].ID, keyOf(matched[j]), matched[j].ID)
+	})
+
+	total := len(matched)
+	start := 0
+	if cq.cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return less(cq.cursor.Key, cq.cursor.ID, keyOf(matched[i]), matched[i].ID)
+		})
+	}
+	page := matched[start:]
+
+	next := ""
+	if cq.limit > 0 && len(page) > cq.limit {
+		page = page[:cq.limit]
+		last := page[len(page)-1]
+		data, _ := json.Marshal(containerCursor{Key: keyOf(last), ID: last.ID})
+		next = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	return page, next, total
+}
+
+// matchesSearch is a case-insensitive substring match over the fields a
+// user is likely to type: name, ID, image, command, compose project and
+// service, and label keys and values.
+func matchesSearch(c types.Container, term string) bool {
+	fields := []string{summaryName(c), c.ID, c.Image, c.Command}
+	for _, name := range c.Names {
+		fields = append(fields, name)
+	}
+	for k, v := range c.Labels {
+		fields = append(fields, k, v)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), term) {
+			return true
+		}
+	}
+	return false
+}
+
+func queryList(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func summaryName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// convertSummary builds a response from list data alone, without the
+// per-container inspect that detail mode adds.
+func convertSummary(c types.Container) apitypes.ContainerResponse {
+	response := apitypes.ContainerResponse{
+		ID:      c.ID,
+		Name:    summaryName(c),
+		Image:   c.Image,
+		Command: c.Command,
+		Status:  c.Status,
+		State:   c.State,
+		Created: time.Unix(c.Created, 0),
+		Ports:   convertPorts(c.Ports),
+		Mounts:  convertMounts(c.Mounts),
+		Labels:  c.Labels,
+		Health:  summaryHealth(c.Status),
+	}
+	if c.NetworkSettings != nil {
+		response.Networks = convertNetworks(c.NetworkSettings.Networks)
+	} else {
+		response.Networks = []apitypes.NetworkInfo{}
+	}
+	return response
+}
+
+// addDetails fills the fields that require ContainerInspect, running the
+// inspects in parallel with bounded concurrency. Containers that vanish
+// between list and inspect keep their summary fields.
+func (h *ContainerHandler) addDetails(ctx context.Context, responses []apitypes.ContainerResponse) {
+	sem := make(chan struct{}, inspectConcurrency)
+	var wg sync.WaitGroup
+
+	for i := range responses {
+		wg.Add(1)
+		go func(resp *apitypes.ContainerResponse) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			inspect, err := h.client.ContainerInspect(ctx, resp.ID)
+			if err != nil {
+				return
+			}
+			applyInspect(resp, inspect)
+		}(&responses[i])
+	}
+	wg.Wait()
+}
+
+// applyInspect fills the detail fields of a response from inspect data,
+// including the probe log of its health
+func applyInspect(resp *apitypes.ContainerResponse, inspect types.ContainerJSON) {
+	resp.Health = convertHealth(inspect.State)
+	resp.RestartCount = inspect.RestartCount
+	if inspect.State != nil {
+		resp.Started, _ = time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+		resp.Finished, _ = time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+	}
+	if inspect.NetworkSettings != nil {
+		resp.Networks = convertNetworks(inspect.NetworkSettings.Networks)
+	}
+	resp.Mounts = convertMounts(inspect.Mounts)
+}
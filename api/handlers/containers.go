@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/docker/docker/client"
 
 	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
 )
 
 type ContainerResponse struct {
@@ -30,53 +32,105 @@ type ContainerResponse struct {
 
 type ContainerHandler struct {
 	client *client.Client
+	health *docker.HealthTracker
+	cache  *docker.StateCache
 }
 
-func NewContainerHandler(client *client.Client) *ContainerHandler {
-	return &ContainerHandler{client: client}
+func NewContainerHandler(client *client.Client, health *docker.HealthTracker, cache *docker.StateCache) *ContainerHandler {
+	return &ContainerHandler{client: client, health: health, cache: cache}
 }
 
+// healthStatuses are the values accepted by the health filter
+var healthStatuses = map[string]bool{
+	"starting":  true,
+	"healthy":   true,
+	"unhealthy": true,
+	"none":      true,
+}
+
+// ListContainers serves GET /api/containers. Filters (status, health,
+// label, name, image, network, project) are passed through to the daemon;
+// search, sort and cursor pagination are applied here. Fields that need a
+// per-container inspect are only filled with ?detail=true. The cursor for
+// the next page is returned in the X-Next-Cursor header and the number of
+// matches in X-Total-Count. Once the state cache is warm, requests are
+// served from it and never reach the daemon.
 func (h *ContainerHandler) ListContainers(w http.ResponseWriter, r *http.Request) {
+	query, err := parseContainerQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.cache != nil && h.cache.Ready() {
+		h.listCachedContainers(w, r, query)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true})
+	containers, err := h.client.ContainerList(ctx, container.ListOptions{All: true, Filters: query.filters})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	response := make([]apitypes.ContainerResponse, 0, len(containers))
-	for _, c := range containers {
-		inspect, err := h.client.ContainerInspect(ctx, c.ID)
-		if err != nil {
-			continue
-		}
+	page, next, total := query.apply(containers)
+
+	response := make([]apitypes.ContainerResponse, len(page))
+	for i, c := range page {
+		response[i] = convertSummary(c)
+	}
+	if query.detail {
+		h.addDetails(ctx, response)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *ContainerHandler) listCachedContainers(w http.ResponseWriter, r *http.Request, query *containerQuery) {
+	snapshot := h.cache.Snapshot()
+	if checkNotModified(w, r, snapshotETag("c", snapshot.ContainersVersion)) {
+		return
+	}
 
-		created, err := time.Parse(time.RFC3339Nano, inspect.Created)
-		if err != nil {
-			created = time.Unix(0, 0)
+	summaries := make([]types.Container, 0, len(snapshot.Containers))
+	inspects := make(map[string]types.ContainerJSON, len(snapshot.Containers))
+	for _, cc := range snapshot.Containers {
+		if query.matchesCached(cc) {
+			summaries = append(summaries, cc.Summary)
+			inspects[cc.Summary.ID] = cc.Inspect
 		}
+	}
 
-		response = append(response, apitypes.ContainerResponse{
-			ID:       c.ID,
-			Name:     strings.TrimPrefix(inspect.Name, "/"),
-			Image:    c.Image,
-			Status:   c.Status,
-			Created:  created,
-			Ports:    convertPorts(c.Ports),
-			Networks: convertNetworks(inspect.NetworkSettings.Networks),
-			Mounts:   convertMounts(inspect.Mounts),
-		})
+	page, next, total := query.apply(summaries)
+
+	response := make([]apitypes.ContainerResponse, len(page))
+	for i, c := range page {
+		response[i] = convertSummary(c)
+		response[i].Status = docker.StatusText(inspects[c.ID])
+		response[i].Health = listHealth(inspects[c.ID].State)
+		if query.detail {
+			applyInspect(&response[i], inspects[c.ID])
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
 func (h *ContainerHandler) GetContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
@@ -100,6 +154,31 @@ func (h *ContainerHandler) GetContainer(w http.ResponseWriter, r *http.Request)
 		Created:  created,
 		Networks: convertNetworks(inspect.NetworkSettings.Networks),
 		Mounts:   convertMounts(inspect.Mounts),
+		Health:   convertHealth(inspect.State),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *ContainerHandler) GetContainerHealth(w http.ResponseWriter, r *http.Request) {
+	id := containerID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	inspect, err := h.client.ContainerInspect(ctx, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Container not found: %v", err), http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(inspect.Name, "/")
+	response := apitypes.ContainerHealthResponse{
+		ID:      inspect.ID,
+		Name:    name,
+		Health:  convertHealth(inspect.State),
+		History: h.health.History(name),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -107,8 +186,7 @@ func (h *ContainerHandler) GetContainer(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ContainerHandler) StartContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
@@ -122,8 +200,7 @@ func (h *ContainerHandler) StartContainer(w http.ResponseWriter, r *http.Request
 }
 
 func (h *ContainerHandler) StopContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
@@ -139,8 +216,7 @@ func (h *ContainerHandler) StopContainer(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *ContainerHandler) RestartContainer(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
@@ -156,8 +232,7 @@ func (h *ContainerHandler) RestartContainer(w http.ResponseWriter, r *http.Reque
 }
 
 func (h *ContainerHandler) GetContainerLogs(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
@@ -181,8 +256,7 @@ func (h *ContainerHandler) GetContainerLogs(w http.ResponseWriter, r *http.Reque
 }
 
 func (h *ContainerHandler) GetContainerStats(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/containers/")
-	id = strings.Split(id, "/")[0]
+	id := containerID(r)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
@@ -198,6 +272,13 @@ func (h *ContainerHandler) GetContainerStats(w http.ResponseWriter, r *http.Requ
 	io.Copy(w, stats.Body)
 }
 
+// containerID extracts the container ID from /api/containers/{id}/... paths,
+// with or without the /api mount prefix.
+func containerID(r *http.Request) string {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/containers/")
+	return strings.Split(id, "/")[0]
+}
+
 // Helper functions to convert Docker SDK types to our API types
 func convertPorts(ports []types.Port) []apitypes.PortMapping {
 	result := make([]apitypes.PortMapping, len(ports))
@@ -238,3 +319,55 @@ func convertMounts(mounts []types.MountPoint) []apitypes.MountInfo {
 	}
 	return result
 }
+
+func convertHealth(state *types.ContainerState) *apitypes.HealthInfo {
+	if state == nil || state.Health == nil {
+		return nil
+	}
+
+	probes := make([]apitypes.HealthProbe, len(state.Health.Log))
+	for i, p := range state.Health.Log {
+		probes[i] = apitypes.HealthProbe{
+			Start:    p.Start,
+			End:      p.End,
+			ExitCode: p.ExitCode,
+			Output:   p.Output,
+		}
+	}
+
+	return &apitypes.HealthInfo{
+		Status:        state.Health.Status,
+		FailingStreak: state.Health.FailingStreak,
+		Log:           probes,
+	}
+}
+
+// listHealth returns the health status of a container without its probe
+// log, which only detailed listings include
+func listHealth(state *types.ContainerState) *apitypes.HealthInfo {
+	if state == nil || state.Health == nil {
+		return nil
+	}
+	return &apitypes.HealthInfo{
+		Status:        state.Health.Status,
+		FailingStreak: state.Health.FailingStreak,
+		Log:           []apitypes.HealthProbe{},
+	}
+}
+
+// summaryHealth returns the health status the daemon appends to the status
+// text of a container list entry, e.g. "Up 5 minutes (healthy)"
+func summaryHealth(status string) *apitypes.HealthInfo {
+	var health string
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		health = types.Healthy
+	case strings.HasSuffix(status, "(unhealthy)"):
+		health = types.Unhealthy
+	case strings.HasSuffix(status, "(health: starting)"):
+		health = types.Starting
+	default:
+		return nil
+	}
+	return &apitypes.HealthInfo{Status: health, Log: []apitypes.HealthProbe{}}
+}
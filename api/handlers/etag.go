@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// snapshotETag derives a weak ETag from a cache version. The minute is
+// folded in because responses carry relative status text ("Up 5 minutes")
+// that ages even when nothing changed.
+func snapshotETag(kind string, version uint64) string {
+	return fmt.Sprintf(`W/"%s%d-%d"`, kind, version, time.Now().Unix()/60)
+}
+
+// contentETag derives a weak ETag from a response body, for responses that
+// combine sources without a single version
+func contentETag(kind string, body []byte) string {
+	return fmt.Sprintf(`W/"%s%x"`, kind, sha256.Sum256(body))
+}
+
+// checkNotModified sets the ETag header and answers 304 when the client
+// already holds the current representation.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,36 +18,56 @@ import (
 	"golang.org/x/net/websocket"
 
 	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+	"kibutsu/metrics"
 )
 
 type ImageHandler struct {
 	client *client.Client
+	cache  *docker.StateCache
 }
 
-func NewImageHandler(client *client.Client) *ImageHandler {
-	return &ImageHandler{client: client}
+func NewImageHandler(client *client.Client, cache *docker.StateCache) *ImageHandler {
+	return &ImageHandler{client: client, cache: cache}
 }
 
 func (h *ImageHandler) ListImages(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancel()
+	dangling := r.URL.Query().Get("dangling")
+	reference := r.URL.Query().Get("reference")
 
-	// Parse filter query parameters
-	filterArgs := filters.NewArgs()
-	if dangling := r.URL.Query().Get("dangling"); dangling != "" {
-		filterArgs.Add("dangling", dangling)
-	}
-	if reference := r.URL.Query().Get("reference"); reference != "" {
-		filterArgs.Add("reference", reference)
-	}
+	var images []image.Summary
+	if h.cache != nil && h.cache.Ready() {
+		snapshot := h.cache.Snapshot()
+		if checkNotModified(w, r, snapshotETag("i", snapshot.ImagesVersion)) {
+			return
+		}
+		for _, img := range snapshot.Images {
+			if matchesImageFilters(img, dangling, reference) {
+				images = append(images, img)
+			}
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		// Parse filter query parameters
+		filterArgs := filters.NewArgs()
+		if dangling != "" {
+			filterArgs.Add("dangling", dangling)
+		}
+		if reference != "" {
+			filterArgs.Add("reference", reference)
+		}
 
-	images, err := h.client.ImageList(ctx, image.ListOptions{
-		All:     true,
-		Filters: filterArgs,
-	})
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list images: %v", err), http.StatusInternalServerError)
-		return
+		var err error
+		images, err = h.client.ImageList(ctx, image.ListOptions{
+			All:     true,
+			Filters: filterArgs,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list images: %v", err), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	response := make([]apitypes.ImageInfo, 0, len(images))
@@ -67,6 +89,35 @@ func (h *ImageHandler) ListImages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// matchesImageFilters applies the dangling and reference filters to a
+// cached image the way the daemon would.
+func matchesImageFilters(img image.Summary, dangling, reference string) bool {
+	if dangling != "" {
+		isDangling := len(img.RepoTags) == 0 || (len(img.RepoTags) == 1 && img.RepoTags[0] == "<none>:<none>")
+		if want, err := strconv.ParseBool(dangling); err == nil && want != isDangling {
+			return false
+		}
+	}
+
+	if reference != "" {
+		for _, tag := range img.RepoTags {
+			repo := tag
+			if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+				repo = tag[:i]
+			}
+			if ok, _ := path.Match(reference, tag); ok {
+				return true
+			}
+			if ok, _ := path.Match(reference, repo); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
 func (h *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/api/images/")
 	id = strings.Split(id, "/")[0]
@@ -109,6 +160,8 @@ func (h *ImageHandler) RemoveImage(w http.ResponseWriter, r *http.Request) {
 func (h *ImageHandler) PullImage(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
+		metrics.WebSocketConnections.Inc("image_pull")
+		defer metrics.WebSocketConnections.Dec("image_pull")
 
 		var pullReq struct {
 			Image string `json:"image"`
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/metrics"
+)
+
+type MetricsHandler struct {
+	store *metrics.Store
+}
+
+func NewMetricsHandler(store *metrics.Store) *MetricsHandler {
+	return &MetricsHandler{store: store}
+}
+
+// Query serves /api/metrics/query?container=&metric=&from=&to=&step=.
+// from and to accept RFC 3339 timestamps, unix seconds or a duration
+// relative to now (e.g. "-6h"); step accepts a duration or seconds.
+func (h *MetricsHandler) Query(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	container := q.Get("container")
+	if container == "" {
+		container = metrics.HostSeries
+	}
+	metric := q.Get("metric")
+	if metric == "" {
+		http.Error(w, "metric is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	from, err := parseQueryTime(q.Get("from"), now, now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid from: %v", err), http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(q.Get("to"), now, now)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid to: %v", err), http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(q.Get("step"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid step: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	points, resolution, err := h.store.Query(container, metric, from, to, now, step)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, metrics.ErrSeriesNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, metrics.ErrInvalidRange):
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Failed to query metrics: %v", err), status)
+		return
+	}
+
+	response := apitypes.MetricQueryResponse{
+		Container:  container,
+		Metric:     metric,
+		From:       from,
+		To:         to,
+		Step:       step.String(),
+		Resolution: resolution.String(),
+		Points:     points,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListSeries serves /api/metrics/series
+func (h *MetricsHandler) ListSeries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.store.Series())
+}
+
+func parseQueryTime(value string, now, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", value)
+}
+
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if secs, atoiErr := strconv.Atoi(value); atoiErr == nil {
+		d, err = time.Duration(secs)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("step must be positive")
+	}
+	return d, nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// TemplateHandler serves the compose templates and deploys them as
+// projects of the compose handler
+type TemplateHandler struct {
+	templates *docker.TemplateStore
+	compose   *ComposeHandler
+}
+
+func NewTemplateHandler(templates *docker.TemplateStore, compose *ComposeHandler) *TemplateHandler {
+	return &TemplateHandler{templates: templates, compose: compose}
+}
+
+// ListTemplates serves GET /api/templates
+func (h *TemplateHandler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.templates.List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list templates: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// GetTemplate serves GET /api/templates/{name}
+func (h *TemplateHandler) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := h.templates.Get(templateName(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load template: %v", err), templateErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// DeployTemplate serves POST /api/templates/{name}/deploy. It renders the
+// template with the inputs of the body into a new project and, unless up
+// is false, starts an up operation for it and responds with 202 and the
+// operation. Invalid inputs are rejected with 422 and the same body as
+// project validation.
+func (h *TemplateHandler) DeployTemplate(w http.ResponseWriter, r *http.Request) {
+	name := templateName(r)
+
+	var req apitypes.TemplateDeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := docker.ValidateProjectName(req.Project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if _, err := h.compose.catalog.Locate(ctx, req.Project); err == nil {
+		http.Error(w, fmt.Sprintf("Project %s already exists", req.Project), http.StatusConflict)
+		return
+	} else if !errors.Is(err, docker.ErrProjectNotFound) {
+		http.Error(w, fmt.Sprintf("Failed to find project: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	files, problems, err := h.templates.Render(name, req.Inputs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render template: %v", err), templateErrorStatus(err))
+		return
+	}
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(apitypes.ComposeValidationResult{Valid: false, Errors: problems})
+		return
+	}
+
+	if err := h.compose.store.CreateFiles(req.Project, files); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create project: %v", err), storeErrorStatus(err))
+		return
+	}
+
+	if req.Up != nil && !*req.Up {
+		deployment := apitypes.TemplateDeployment{Project: req.Project, Template: name}
+		for file := range files {
+			deployment.Files = append(deployment.Files, file)
+		}
+		sort.Strings(deployment.Files)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(deployment)
+		return
+	}
+
+	config, err := h.compose.loadComposeFile(ctx, req.Project, docker.ComposeLoadOptions{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load compose file: %v", err), loadErrorStatus(err))
+		return
+	}
+	h.compose.startOperation(w, req.Project, apitypes.OperationUp, "", func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error) {
+		return h.compose.startProject(ctx, req.Project, config, nil, docker.UpOptions{}, report)
+	})
+}
+
+// templateName returns the {name} segment of /api/templates/{name}/...
+func templateName(r *http.Request) string {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/templates/")
+	name, _, _ := strings.Cut(path, "/")
+	return name
+}
+
+// templateErrorStatus maps a template error to an HTTP status
+func templateErrorStatus(err error) int {
+	if errors.Is(err, docker.ErrTemplateNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
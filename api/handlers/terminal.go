@@ -13,6 +13,8 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/websocket"
+
+	"kibutsu/metrics"
 )
 
 type TerminalHandler struct {
@@ -25,6 +27,9 @@ type TerminalMessage struct {
 	Cols    uint   `json:"cols,omitempty"`
 	Rows    uint   `json:"rows,omitempty"`
 	Command string `json:"command,omitempty"`
+
+	// ExitCode is set on the exit message of a one-off container
+	ExitCode *int `json:"exitCode,omitempty"`
 }
 
 func NewTerminalHandler(client *client.Client) *TerminalHandler {
@@ -32,7 +37,7 @@ func NewTerminalHandler(client *client.Client) *TerminalHandler {
 }
 
 func (h *TerminalHandler) HandleTerminal(w http.ResponseWriter, r *http.Request) {
-	containerId := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	containerId := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api"), "/containers/")
 	containerId = strings.TrimSuffix(containerId, "/exec")
 
 	// Verify container exists and is running
@@ -51,6 +56,8 @@ func (h *TerminalHandler) HandleTerminal(w http.ResponseWriter, r *http.Request)
 	// Upgrade connection to websocket
 	websocket.Handler(func(ws *websocket.Conn) {
 		defer ws.Close()
+		metrics.WebSocketConnections.Inc("terminal")
+		defer metrics.WebSocketConnections.Dec("terminal")
 		h.handleConnection(ctx, ws, containerId)
 	}).ServeHTTP(w, r)
 }
@@ -80,6 +87,9 @@ func (h *TerminalHandler) handleConnection(ctx context.Context, ws *websocket.Co
 	}
 	defer resp.Close()
 
+	metrics.ExecSessions.Inc()
+	defer metrics.ExecSessions.Dec()
+
 	// Start copying data between websocket and container
 	var wg sync.WaitGroup
 	wg.Add(2)
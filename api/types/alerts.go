@@ -0,0 +1,108 @@
+package types
+
+import "time"
+
+// Alert rule types
+const (
+	AlertRuleUnhealthy = "unhealthy"
+	AlertRuleRestart   = "restart"
+	AlertRuleMemory    = "memory"
+	AlertRuleExitCode  = "exit_code"
+	AlertRuleDisk      = "disk"
+)
+
+// Alert states
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule defines a condition that raises an alert
+type AlertRule struct {
+	// Name uniquely identifies the rule
+	Name string `json:"name"`
+
+	// Type is one of unhealthy, restart, memory, exit_code or disk
+	Type string `json:"type"`
+
+	// Container is a name or glob pattern; empty matches every container
+	Container string `json:"container,omitempty"`
+
+	// Project and Service restrict the rule to compose containers
+	Project string `json:"project,omitempty"`
+	Service string `json:"service,omitempty"`
+
+	// For is how long the condition must hold before firing, e.g. "2m".
+	// For restart rules it is the quiet period after which the alert resolves.
+	For string `json:"for,omitempty"`
+
+	// Threshold is a percentage of the memory limit for memory rules and
+	// gigabytes for disk rules
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// Severity is passed through to notifications
+	Severity string `json:"severity,omitempty"`
+
+	// Notifiers lists notifier names to deliver to; empty means all
+	Notifiers []string `json:"notifiers,omitempty"`
+}
+
+// NotifierConfig configures a notification channel
+type NotifierConfig struct {
+	// Name identifies the notifier in rule definitions
+	Name string `json:"name"`
+
+	// Type is one of webhook, slack or smtp
+	Type string `json:"type"`
+
+	// URL is the endpoint for webhook and slack notifiers
+	URL string `json:"url,omitempty"`
+
+	// Headers are added to webhook requests
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SMTP settings
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// AlertConfig is the on-disk alerting configuration
+type AlertConfig struct {
+	Rules     []AlertRule      `json:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+// Alert is an instance of a rule matching a container or the host
+type Alert struct {
+	Fingerprint string    `json:"fingerprint"`
+	Rule        string    `json:"rule"`
+	Type        string    `json:"type"`
+	Severity    string    `json:"severity,omitempty"`
+	Status      string    `json:"status"`
+	Container   string    `json:"container,omitempty"`
+	ContainerID string    `json:"containerId,omitempty"`
+	Project     string    `json:"project,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Summary     string    `json:"summary"`
+	Value       float64   `json:"value,omitempty"`
+	StartsAt    time.Time `json:"startsAt"`
+	FiredAt     time.Time `json:"firedAt,omitempty"`
+	EndsAt      time.Time `json:"endsAt,omitempty"`
+	Silenced    bool      `json:"silenced"`
+}
+
+// Silence suppresses notifications for matching alerts until it expires
+type Silence struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+}
@@ -12,51 +12,409 @@ type ComposeProject struct {
 	Labels     map[string]string `json:"labels"`
 }
 
-// ComposeService represents a service within a Docker Compose project
+// ComposeService represents a service within a Docker Compose project.
+// Replicas counts its containers and DesiredReplicas the ones declared;
+// Dependents are the services that depend on it, directly or not.
 type ComposeService struct {
-	Name         string            `json:"name"`
-	Image        string            `json:"image"`
-	Status       string            `json:"status"`
-	Replicas     int               `json:"replicas"`
-	Ports        []PortMapping     `json:"ports"`
-	Networks     []NetworkInfo     `json:"networks"`
-	Volumes      []MountInfo       `json:"volumes"`
-	Environment  map[string]string `json:"environment"`
-	Dependencies []string          `json:"dependencies"`
+	Name            string              `json:"name"`
+	Image           string              `json:"image"`
+	Status          string              `json:"status"`
+	Replicas        int                 `json:"replicas"`
+	DesiredReplicas int                 `json:"desiredReplicas"`
+	Ports           []PortMapping       `json:"ports"`
+	Networks        []NetworkInfo       `json:"networks"`
+	Volumes         []MountInfo         `json:"volumes"`
+	Environment     map[string]string   `json:"environment"`
+	Dependencies    []string            `json:"dependencies"`
+	Dependents      []string            `json:"dependents"`
+	Containers      []ContainerResponse `json:"containers"`
+}
+
+// Actions on the containers of a compose service
+const (
+	ServiceActionStart    = "start"
+	ServiceActionStop     = "stop"
+	ServiceActionRestart  = "restart"
+	ServiceActionRecreate = "recreate"
+	ServiceActionKill     = "kill"
+	ServiceActionPause    = "pause"
+	ServiceActionUnpause  = "unpause"
+)
+
+// ComposeDownReport lists the resources down removed, kept and failed to
+// remove
+type ComposeDownReport struct {
+	Removed []ComposeResourceResult `json:"removed"`
+	Skipped []ComposeResourceResult `json:"skipped"`
+	Failed  []ComposeResourceResult `json:"failed"`
+}
+
+// ComposeResourceResult is a container, network, volume or image handled
+// by down, with why it was skipped or the error that failed it
+type ComposeResourceResult struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Service string `json:"service,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ComposeRunRequest overrides the definition of a service for a one-off
+// container. Remove defaults to true.
+type ComposeRunRequest struct {
+	Command     []string          `json:"command,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Environment map[string]string `json:"environment,omitempty"`
+	User        string            `json:"user,omitempty"`
+	WorkingDir  string            `json:"workingDir,omitempty"`
+	Tty         bool              `json:"tty,omitempty"`
+	Remove      *bool             `json:"remove,omitempty"`
+	NoDeps      bool              `json:"noDeps,omitempty"`
+}
+
+// ComposeRun is a one-off container registered by run, waiting for a
+// client to attach to it
+type ComposeRun struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Project string `json:"project"`
+	Service string `json:"service"`
+	Tty     bool   `json:"tty"`
+	Remove  bool   `json:"remove"`
+	Attach  string `json:"attach"`
+}
+
+// ComposeExport is a compose config reverse-engineered from existing
+// containers, with what could not be carried over
+type ComposeExport struct {
+	Config   *ComposeConfig `json:"config"`
+	Warnings []string       `json:"warnings"`
+}
+
+// ComposeServiceActionResult is the outcome of an action on a service.
+// Cascaded lists the dependents the action was also applied to and
+// Restarted those restarted because they depend on the service with
+// restart: true.
+type ComposeServiceActionResult struct {
+	Action     string   `json:"action"`
+	Service    string   `json:"service"`
+	Containers []string `json:"containers"`
+	Cascaded   []string `json:"cascaded"`
+	Restarted  []string `json:"restarted"`
+	Warnings   []string `json:"warnings"`
 }
 
 // ComposeConfig represents the configuration for a Docker Compose project
 type ComposeConfig struct {
-	Version  string                 `json:"version"`
-	Services map[string]ServiceSpec `json:"services"`
-	Networks map[string]NetworkSpec `json:"networks,omitempty"`
-	Volumes  map[string]VolumeSpec  `json:"volumes,omitempty"`
+	Version    string                    `json:"version,omitempty" yaml:"version,omitempty"`
+	Name       string                    `json:"name,omitempty" yaml:"name,omitempty"`
+	Services   map[string]ServiceSpec    `json:"services" yaml:"services"`
+	Networks   map[string]NetworkSpec    `json:"networks,omitempty" yaml:"networks,omitempty"`
+	Volumes    map[string]VolumeSpec     `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	Secrets    map[string]FileObjectSpec `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Configs    map[string]FileObjectSpec `json:"configs,omitempty" yaml:"configs,omitempty"`
+	Extensions Extensions                `json:"extensions,omitempty" yaml:"-"`
+
+	// WorkingDir and ConfigFiles record where the config was loaded from,
+	// as absolute paths
+	WorkingDir  string   `json:"-" yaml:"-"`
+	ConfigFiles []string `json:"-" yaml:"-"`
 }
 
 // ServiceSpec defines the configuration for a service
 type ServiceSpec struct {
-	Image       string            `json:"image"`
-	Command     []string          `json:"command,omitempty"`
-	Environment map[string]string `json:"environment,omitempty"`
-	Ports       []string          `json:"ports,omitempty"`
-	Volumes     []string          `json:"volumes,omitempty"`
-	DependsOn   []string          `json:"depends_on,omitempty"`
-	Deploy      *DeploySpec       `json:"deploy,omitempty"`
+	Image           string            `json:"image,omitempty" yaml:"image,omitempty"`
+	Build           *BuildSpec        `json:"build,omitempty" yaml:"build,omitempty"`
+	Command         ShellCommand      `json:"command,omitempty" yaml:"command,omitempty"`
+	Entrypoint      ShellCommand      `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Environment     MappingWithEquals `json:"environment,omitempty" yaml:"environment,omitempty"`
+	EnvFile         StringList        `json:"env_file,omitempty" yaml:"env_file,omitempty"`
+	Ports           PortList          `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Volumes         []ServiceVolume   `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	DependsOn       DependsOn         `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+	Deploy          *DeploySpec       `json:"deploy,omitempty" yaml:"deploy,omitempty"`
+	Healthcheck     *HealthcheckSpec  `json:"healthcheck,omitempty" yaml:"healthcheck,omitempty"`
+	Restart         string            `json:"restart,omitempty" yaml:"restart,omitempty"`
+	Labels          Labels            `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Networks        ServiceNetworks   `json:"networks,omitempty" yaml:"networks,omitempty"`
+	WorkingDir      string            `json:"working_dir,omitempty" yaml:"working_dir,omitempty"`
+	User            string            `json:"user,omitempty" yaml:"user,omitempty"`
+	CapAdd          []string          `json:"cap_add,omitempty" yaml:"cap_add,omitempty"`
+	CapDrop         []string          `json:"cap_drop,omitempty" yaml:"cap_drop,omitempty"`
+	Ulimits         map[string]Ulimit `json:"ulimits,omitempty" yaml:"ulimits,omitempty"`
+	Logging         *LoggingSpec      `json:"logging,omitempty" yaml:"logging,omitempty"`
+	ExtraHosts      HostsList         `json:"extra_hosts,omitempty" yaml:"extra_hosts,omitempty"`
+	Secrets         []ServiceFileRef  `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Configs         []ServiceFileRef  `json:"configs,omitempty" yaml:"configs,omitempty"`
+	Profiles        []string          `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+	PullPolicy      string            `json:"pull_policy,omitempty" yaml:"pull_policy,omitempty"`
+	StopSignal      string            `json:"stop_signal,omitempty" yaml:"stop_signal,omitempty"`
+	StopGracePeriod string            `json:"stop_grace_period,omitempty" yaml:"stop_grace_period,omitempty"`
+	Privileged      bool              `json:"privileged,omitempty" yaml:"privileged,omitempty"`
+	SecurityOpt     []string          `json:"security_opt,omitempty" yaml:"security_opt,omitempty"`
+	Devices         []string          `json:"devices,omitempty" yaml:"devices,omitempty"`
+	Tmpfs           StringList        `json:"tmpfs,omitempty" yaml:"tmpfs,omitempty"`
+	ShmSize         ByteSize          `json:"shm_size,omitempty" yaml:"shm_size,omitempty"`
+	Sysctls         Labels            `json:"sysctls,omitempty" yaml:"sysctls,omitempty"`
+	Init            *bool             `json:"init,omitempty" yaml:"init,omitempty"`
+	ReadOnly        bool              `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+	NetworkMode     string            `json:"network_mode,omitempty" yaml:"network_mode,omitempty"`
+	Pid             string            `json:"pid,omitempty" yaml:"pid,omitempty"`
+	Ipc             string            `json:"ipc,omitempty" yaml:"ipc,omitempty"`
+	DNS             StringList        `json:"dns,omitempty" yaml:"dns,omitempty"`
+	DNSSearch       StringList        `json:"dns_search,omitempty" yaml:"dns_search,omitempty"`
+	DNSOpt          []string          `json:"dns_opt,omitempty" yaml:"dns_opt,omitempty"`
+	Extensions      Extensions        `json:"extensions,omitempty" yaml:"-"`
 }
 
+// Restart policies of a service, besides on-failure[:max-retries]
+const (
+	RestartNo            = "no"
+	RestartAlways        = "always"
+	RestartOnFailure     = "on-failure"
+	RestartUnlessStopped = "unless-stopped"
+)
+
+// Pull policies of a service. An empty policy means missing.
+const (
+	PullPolicyAlways       = "always"
+	PullPolicyMissing      = "missing"
+	PullPolicyIfNotPresent = "if_not_present"
+	PullPolicyNever        = "never"
+	PullPolicyBuild        = "build"
+)
+
 // DeploySpec defines deployment configuration for a service
 type DeploySpec struct {
-	Replicas int `json:"replicas,omitempty"`
+	Replicas      int                `json:"replicas,omitempty" yaml:"replicas,omitempty"`
+	UpdateConfig  *UpdateConfig      `json:"update_config,omitempty" yaml:"update_config,omitempty"`
+	Resources     *ResourcesSpec     `json:"resources,omitempty" yaml:"resources,omitempty"`
+	RestartPolicy *RestartPolicySpec `json:"restart_policy,omitempty" yaml:"restart_policy,omitempty"`
+}
+
+// ResourcesSpec holds the resource limits and reservations of a service
+type ResourcesSpec struct {
+	Limits       *ResourceSpec `json:"limits,omitempty" yaml:"limits,omitempty"`
+	Reservations *ResourceSpec `json:"reservations,omitempty" yaml:"reservations,omitempty"`
+}
+
+// ResourceSpec is an amount of resources. Cpus is a fraction of CPUs such
+// as "0.5"; Pids only applies as a limit.
+type ResourceSpec struct {
+	Cpus   string   `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	Memory ByteSize `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Pids   int64    `json:"pids,omitempty" yaml:"pids,omitempty"`
+}
+
+// RestartPolicySpec restarts containers on condition none, on-failure or
+// any. It takes precedence over restart. Delay and Window are not
+// supported by the Docker engine outside swarm mode.
+type RestartPolicySpec struct {
+	Condition   string `json:"condition,omitempty" yaml:"condition,omitempty"`
+	Delay       string `json:"delay,omitempty" yaml:"delay,omitempty"`
+	MaxAttempts *int   `json:"max_attempts,omitempty" yaml:"max_attempts,omitempty"`
+	Window      string `json:"window,omitempty" yaml:"window,omitempty"`
+}
+
+// Conditions of deploy.restart_policy
+const (
+	RestartConditionNone      = "none"
+	RestartConditionOnFailure = "on-failure"
+	RestartConditionAny       = "any"
+)
+
+// UpdateConfig controls how a rolling update replaces the replicas of a
+// service. Durations use Go duration syntax. A nil Parallelism updates
+// one replica at a time and zero updates all of them at once.
+type UpdateConfig struct {
+	Parallelism     *int    `json:"parallelism,omitempty" yaml:"parallelism,omitempty"`
+	Delay           string  `json:"delay,omitempty" yaml:"delay,omitempty"`
+	FailureAction   string  `json:"failure_action,omitempty" yaml:"failure_action,omitempty"`
+	Monitor         string  `json:"monitor,omitempty" yaml:"monitor,omitempty"`
+	MaxFailureRatio float64 `json:"max_failure_ratio,omitempty" yaml:"max_failure_ratio,omitempty"`
+	Order           string  `json:"order,omitempty" yaml:"order,omitempty"`
+}
+
+// Update orders: stop-first stops the old replica before starting its
+// replacement, start-first starts the replacement first
+const (
+	UpdateOrderStopFirst  = "stop-first"
+	UpdateOrderStartFirst = "start-first"
+)
+
+// Actions taken when replicas fail a rolling update
+const (
+	FailureActionPause    = "pause"
+	FailureActionContinue = "continue"
+	FailureActionRollback = "rollback"
+)
+
+// ComposeUpdateResult is the outcome of a rolling update of a service
+type ComposeUpdateResult struct {
+	Service    string   `json:"service"`
+	Updated    []string `json:"updated"`
+	Unchanged  []string `json:"unchanged"`
+	Failed     []string `json:"failed"`
+	Removed    []string `json:"removed"`
+	Paused     bool     `json:"paused"`
+	RolledBack bool     `json:"rolledBack"`
+}
+
+// Conditions a service waits for on a dependency before it starts
+const (
+	ConditionServiceStarted               = "service_started"
+	ConditionServiceHealthy               = "service_healthy"
+	ConditionServiceCompletedSuccessfully = "service_completed_successfully"
+)
+
+// DependencySpec is the long form of a depends_on entry. Restart restarts
+// the service when the dependency is recreated; a dependency that is not
+// required may be missing or fail to start.
+type DependencySpec struct {
+	Condition string `json:"condition" yaml:"condition,omitempty"`
+	Restart   bool   `json:"restart,omitempty" yaml:"restart,omitempty"`
+	Required  bool   `json:"required" yaml:"required"`
+}
+
+// BuildSpec defines how to build a service image. The short syntax is just
+// the context path.
+type BuildSpec struct {
+	Context          string            `json:"context,omitempty" yaml:"context,omitempty"`
+	Dockerfile       string            `json:"dockerfile,omitempty" yaml:"dockerfile,omitempty"`
+	DockerfileInline string            `json:"dockerfile_inline,omitempty" yaml:"dockerfile_inline,omitempty"`
+	Args             MappingWithEquals `json:"args,omitempty" yaml:"args,omitempty"`
+	Target           string            `json:"target,omitempty" yaml:"target,omitempty"`
+	Labels           Labels            `json:"labels,omitempty" yaml:"labels,omitempty"`
+	CacheFrom        []string          `json:"cache_from,omitempty" yaml:"cache_from,omitempty"`
+	Network          string            `json:"network,omitempty" yaml:"network,omitempty"`
+}
+
+// HealthcheckSpec defines a container health check. Durations use Go
+// duration syntax, e.g. "30s" or "1m30s".
+type HealthcheckSpec struct {
+	Test          HealthcheckTest `json:"test,omitempty" yaml:"test,omitempty"`
+	Interval      string          `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout       string          `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	StartPeriod   string          `json:"start_period,omitempty" yaml:"start_period,omitempty"`
+	StartInterval string          `json:"start_interval,omitempty" yaml:"start_interval,omitempty"`
+	Retries       *int            `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Disable       bool            `json:"disable,omitempty" yaml:"disable,omitempty"`
+}
+
+// ServiceNetworkSpec defines per-service settings for an attached network
+type ServiceNetworkSpec struct {
+	Aliases     []string `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Ipv4Address string   `json:"ipv4_address,omitempty" yaml:"ipv4_address,omitempty"`
+	Ipv6Address string   `json:"ipv6_address,omitempty" yaml:"ipv6_address,omitempty"`
+	Priority    int      `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// Service volume types
+const (
+	VolumeTypeBind   = "bind"
+	VolumeTypeVolume = "volume"
+	VolumeTypeTmpfs  = "tmpfs"
+)
+
+// ServiceVolume is a mount in long syntax. Short "source:target:mode"
+// entries are converted on load.
+type ServiceVolume struct {
+	Type     string              `json:"type" yaml:"type"`
+	Source   string              `json:"source,omitempty" yaml:"source,omitempty"`
+	Target   string              `json:"target" yaml:"target"`
+	ReadOnly bool                `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+	Bind     *ServiceVolumeBind  `json:"bind,omitempty" yaml:"bind,omitempty"`
+	Volume   *ServiceVolumeOpts  `json:"volume,omitempty" yaml:"volume,omitempty"`
+	Tmpfs    *ServiceVolumeTmpfs `json:"tmpfs,omitempty" yaml:"tmpfs,omitempty"`
+}
+
+// ServiceVolumeBind holds bind mount options
+type ServiceVolumeBind struct {
+	Propagation    string `json:"propagation,omitempty" yaml:"propagation,omitempty"`
+	CreateHostPath *bool  `json:"create_host_path,omitempty" yaml:"create_host_path,omitempty"`
+	SELinux        string `json:"selinux,omitempty" yaml:"selinux,omitempty"`
+}
+
+// ServiceVolumeOpts holds named volume mount options
+type ServiceVolumeOpts struct {
+	NoCopy  bool   `json:"nocopy,omitempty" yaml:"nocopy,omitempty"`
+	Subpath string `json:"subpath,omitempty" yaml:"subpath,omitempty"`
+}
+
+// ServiceVolumeTmpfs holds tmpfs mount options
+type ServiceVolumeTmpfs struct {
+	Size ByteSize `json:"size,omitempty" yaml:"size,omitempty"`
+	Mode uint32   `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// Ulimit is a soft/hard resource limit pair. A single number sets both.
+type Ulimit struct {
+	Soft int64 `json:"soft" yaml:"soft"`
+	Hard int64 `json:"hard" yaml:"hard"`
+}
+
+// LoggingSpec defines the logging driver of a service
+type LoggingSpec struct {
+	Driver  string            `json:"driver,omitempty" yaml:"driver,omitempty"`
+	Options map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// ServiceFileRef grants a service access to a secret or config. The short
+// syntax is just the source name.
+type ServiceFileRef struct {
+	Source string  `json:"source" yaml:"source"`
+	Target string  `json:"target,omitempty" yaml:"target,omitempty"`
+	UID    string  `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID    string  `json:"gid,omitempty" yaml:"gid,omitempty"`
+	Mode   *uint32 `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// FileObjectSpec defines a top-level secret or config. Its content comes
+// from exactly one of File, Environment (a variable name) and Content.
+type FileObjectSpec struct {
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	File        string `json:"file,omitempty" yaml:"file,omitempty"`
+	Environment string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Content     string `json:"content,omitempty" yaml:"content,omitempty"`
+	External    bool   `json:"external,omitempty" yaml:"external,omitempty"`
+
+	// EnvironmentValue is the value of the Environment variable, resolved
+	// when the config is loaded
+	EnvironmentValue *string `json:"-" yaml:"-"`
 }
 
 // NetworkSpec defines network configuration
 type NetworkSpec struct {
-	External bool `json:"external,omitempty"`
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Driver     string            `json:"driver,omitempty" yaml:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty" yaml:"driver_opts,omitempty"`
+	External   bool              `json:"external,omitempty" yaml:"external,omitempty"`
+	Internal   bool              `json:"internal,omitempty" yaml:"internal,omitempty"`
+	Attachable bool              `json:"attachable,omitempty" yaml:"attachable,omitempty"`
+	EnableIPv6 bool              `json:"enable_ipv6,omitempty" yaml:"enable_ipv6,omitempty"`
+	Labels     Labels            `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Ipam       *IpamSpec         `json:"ipam,omitempty" yaml:"ipam,omitempty"`
+}
+
+// IpamSpec defines IP address management for a network
+type IpamSpec struct {
+	Driver string       `json:"driver,omitempty" yaml:"driver,omitempty"`
+	Config []IpamConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// IpamConfig defines a subnet of a network
+type IpamConfig struct {
+	Subnet  string `json:"subnet,omitempty" yaml:"subnet,omitempty"`
+	Gateway string `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	IPRange string `json:"ip_range,omitempty" yaml:"ip_range,omitempty"`
 }
 
 // VolumeSpec defines volume configuration
 type VolumeSpec struct {
-	External bool `json:"external,omitempty"`
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Driver     string            `json:"driver,omitempty" yaml:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty" yaml:"driver_opts,omitempty"`
+	External   bool              `json:"external,omitempty" yaml:"external,omitempty"`
+	Labels     Labels            `json:"labels,omitempty" yaml:"labels,omitempty"`
 }
 
 // ComposeError represents an error that occurred during compose operations
@@ -68,14 +426,182 @@ type ComposeError struct {
 	Time      string `json:"time"`
 }
 
-// ComposeOperation represents the status of a compose operation
+// Compose operation types. Operations on a service use the name of the
+// service action, e.g. stop.
+const (
+	OperationUp      = "up"
+	OperationDown    = "down"
+	OperationScale   = "scale"
+	OperationPull    = "pull"
+	OperationRestart = "restart"
+	OperationUpdate  = "update"
+)
+
+// Compose operation statuses
+const (
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+	OperationCancelled = "cancelled"
+)
+
+// ComposeOperation represents the status of a compose operation. Services
+// holds the latest step of each service, Progress every step in order and
+// Result the operation's outcome, e.g. the plan executed by up.
 type ComposeOperation struct {
-	ID        string    `json:"id"`
-	Type      string    `json:"type"`
-	Project   string    `json:"project"`
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Project   string            `json:"project"`
+	Service   string            `json:"service,omitempty"`
+	Status    string            `json:"status"`
+	StartTime time.Time         `json:"startTime"`
+	EndTime   time.Time         `json:"endTime,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Services  map[string]string `json:"services"`
+	Progress  []ComposeProgress `json:"progress"`
+	Result    interface{}       `json:"result,omitempty"`
+}
+
+// Steps reported in compose operation progress
+const (
+	StepPulling     = "pulling"
+	StepPulled      = "pulled"
+	StepCreating    = "creating"
+	StepStarting    = "starting"
+	StepStarted     = "started"
+	StepWaiting     = "waiting"
+	StepHealthy     = "healthy"
+	StepRestarting  = "restarting"
+	StepStopping    = "stopping"
+	StepStopped     = "stopped"
+	StepRemoving    = "removing"
+	StepRemoved     = "removed"
+	StepFailed      = "failed"
+	StepRollingBack = "rolling_back"
+	StepKilled      = "killed"
+	StepPaused      = "paused"
+	StepUnpaused    = "unpaused"
+)
+
+// ComposeProgress is a step of a compose operation on a service
+type ComposeProgress struct {
+	Time      time.Time `json:"time"`
 	Service   string    `json:"service,omitempty"`
-	Status    string    `json:"status"`
-	StartTime time.Time `json:"startTime"`
-	EndTime   time.Time `json:"endTime,omitempty"`
-	Error     string    `json:"error,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Step      string    `json:"step"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// ComposeOperationEvent is a message on an operation's WebSocket: a
+// progress step, or the operation itself once it has finished
+type ComposeOperationEvent struct {
+	Type      string            `json:"type"`
+	Progress  *ComposeProgress  `json:"progress,omitempty"`
+	Operation *ComposeOperation `json:"operation,omitempty"`
+}
+
+// MergedComposeConfig is the result of merging the files of a project.
+// Sources maps the dotted path of every value, e.g. "services.web.image"
+// or "services.web.ports[0]", to the file it came from.
+type MergedComposeConfig struct {
+	Files   []string          `json:"files"`
+	Config  *ComposeConfig    `json:"config"`
+	Sources map[string]string `json:"sources"`
+}
+
+// ComposeVersion describes a saved version of a project's compose file
+type ComposeVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+}
+
+// ComposeValidationError is a problem found in a compose file. Line and
+// Column are 1-based and zero when unknown.
+type ComposeValidationError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// ComposeValidationResult is the outcome of validating a compose project
+type ComposeValidationResult struct {
+	Valid  bool                     `json:"valid"`
+	Errors []ComposeValidationError `json:"errors"`
+}
+
+// Catalog sources a project can be discovered from
+const (
+	ProjectSourceStore      = "store"
+	ProjectSourceDirectory  = "directory"
+	ProjectSourceLabels     = "labels"
+	ProjectSourceContainers = "containers"
+)
+
+// Drift kinds reported between a project's files and its containers
+const (
+	DriftMissing    = "missing"
+	DriftOrphaned   = "orphaned"
+	DriftImage      = "image"
+	DriftReplicas   = "replicas"
+	DriftConfig     = "config"
+	DriftModified   = "modified"
+	DriftWorkingDir = "working_dir"
+	DriftFiles      = "config_files"
+)
+
+// ComposeCatalogEntry is a project found in the configured directories, in
+// compose labels or only through its running containers
+type ComposeCatalogEntry struct {
+	Name        string              `json:"name"`
+	Path        string              `json:"path,omitempty"`
+	ConfigFiles []string            `json:"configFiles,omitempty"`
+	Sources     []string            `json:"sources"`
+	Managed     bool                `json:"managed"`
+	Status      string              `json:"status"`
+	Services    []string            `json:"services"`
+	Containers  []ContainerResponse `json:"containers"`
+	Drift       []ComposeDrift      `json:"drift"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// ComposeDrift is a difference between a project's compose files and its
+// containers
+type ComposeDrift struct {
+	Kind    string `json:"kind"`
+	Service string `json:"service,omitempty"`
+	Message string `json:"message"`
+}
+
+// Actions of a compose up plan
+const (
+	PlanCreate    = "create"
+	PlanRecreate  = "recreate"
+	PlanStart     = "start"
+	PlanRestart   = "restart"
+	PlanUnchanged = "unchanged"
+	PlanRemove    = "remove"
+	PlanOrphan    = "orphan"
+)
+
+// ComposePlanAction is one step of a compose up plan
+type ComposePlanAction struct {
+	Action      string `json:"action"`
+	Service     string `json:"service"`
+	Container   string `json:"container"`
+	ContainerID string `json:"containerId,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// ComposePlan lists what up does to converge a project on its config,
+// in execution order: images to pull, networks to create, then container
+// actions
+type ComposePlan struct {
+	Project  string              `json:"project"`
+	DryRun   bool                `json:"dryRun"`
+	Pulls    []string            `json:"pulls"`
+	Networks []string            `json:"networks"`
+	Actions  []ComposePlanAction `json:"actions"`
 }
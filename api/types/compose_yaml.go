@@ -0,0 +1,558 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions holds the x- prefixed fields of a compose mapping
+type Extensions map[string]interface{}
+
+// ShellCommand is a command given either as a list or as a string that is
+// split like a shell would
+type ShellCommand []string
+
+// HealthcheckTest is a health check command. A plain string is run with
+// the container's shell (CMD-SHELL).
+type HealthcheckTest []string
+
+// MappingWithEquals maps variable names to values, given as a map or as a
+// list of KEY=VALUE entries. A nil value means the variable is taken from
+// the environment of the host.
+type MappingWithEquals map[string]*string
+
+// Labels maps label keys to values, given as a map or a list of key=value
+type Labels map[string]string
+
+// StringList is a list that may also be given as a single string
+type StringList []string
+
+// PortList holds port mappings in short syntax. Long syntax entries are
+// converted on load.
+type PortList []string
+
+// ServiceNetworks maps network names to per-service settings, given as a
+// list of names or as a map. Values may be nil.
+type ServiceNetworks map[string]*ServiceNetworkSpec
+
+// DependsOn maps the services a service depends on to the condition it
+// waits for, given as a list of names or as a map
+type DependsOn map[string]DependencySpec
+
+// HostsList holds extra host entries as "host:ip", given as a list or a map
+type HostsList []string
+
+// ByteSize is a size given as a number of bytes or a string like "64m"
+type ByteSize string
+
+func (c *ComposeConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain ComposeConfig
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Extensions = extensionsOf(node)
+	return nil
+}
+
+func (s *ServiceSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain ServiceSpec
+	if err := node.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	s.Extensions = extensionsOf(node)
+	return nil
+}
+
+// extensionsOf collects the x- keys of a mapping node
+func extensionsOf(node *yaml.Node) Extensions {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	var ext Extensions
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if !strings.HasPrefix(key, "x-") {
+			continue
+		}
+		var value interface{}
+		if err := node.Content[i+1].Decode(&value); err != nil {
+			continue
+		}
+		if ext == nil {
+			ext = make(Extensions)
+		}
+		ext[key] = value
+	}
+	return ext
+}
+
+func (c *ShellCommand) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			*c = nil
+			return nil
+		}
+		words, err := SplitShellWords(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*c = words
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*c = list
+		return nil
+	}
+	return fmt.Errorf("line %d: command must be a string or a list", node.Line)
+}
+
+func (t *HealthcheckTest) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*t = HealthcheckTest{"CMD-SHELL", node.Value}
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*t = list
+		return nil
+	}
+	return fmt.Errorf("line %d: healthcheck test must be a string or a list", node.Line)
+}
+
+func (m *MappingWithEquals) UnmarshalYAML(node *yaml.Node) error {
+	result := make(MappingWithEquals)
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: value of %s must be a scalar", value.Line, key.Value)
+			}
+			if value.ShortTag() == "!!null" {
+				result[key.Value] = nil
+				continue
+			}
+			v := value.Value
+			result[key.Value] = &v
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: entries must be KEY=VALUE strings", item.Line)
+			}
+			key, value, ok := strings.Cut(item.Value, "=")
+			if !ok {
+				result[key] = nil
+				continue
+			}
+			result[key] = &value
+		}
+	default:
+		return fmt.Errorf("line %d: must be a mapping or a list", node.Line)
+	}
+	*m = result
+	return nil
+}
+
+// Resolve returns the defined values, looking up nil entries with lookup.
+// Entries that lookup cannot resolve are omitted.
+func (m MappingWithEquals) Resolve(lookup func(string) (string, bool)) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if v != nil {
+			result[k] = *v
+			continue
+		}
+		if lookup == nil {
+			continue
+		}
+		if value, ok := lookup(k); ok {
+			result[k] = value
+		}
+	}
+	return result
+}
+
+func (l *Labels) UnmarshalYAML(node *yaml.Node) error {
+	var mapping MappingWithEquals
+	if err := node.Decode(&mapping); err != nil {
+		return err
+	}
+	result := make(Labels, len(mapping))
+	for k, v := range mapping {
+		if v != nil {
+			result[k] = *v
+		} else {
+			result[k] = ""
+		}
+	}
+	*l = result
+	return nil
+}
+
+func (s *StringList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*s = StringList{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		for _, item := range node.Content {
+			// env_file entries may use the long form {path, required}
+			if item.Kind == yaml.MappingNode {
+				var entry struct {
+					Path string `yaml:"path"`
+				}
+				if err := item.Decode(&entry); err != nil {
+					return err
+				}
+				list = append(list, entry.Path)
+				continue
+			}
+			list = append(list, item.Value)
+		}
+		*s = list
+		return nil
+	}
+	return fmt.Errorf("line %d: must be a string or a list", node.Line)
+}
+
+func (p *PortList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: ports must be a list", node.Line)
+	}
+	list := make(PortList, 0, len(node.Content))
+	for _, item := range node.Content {
+		switch item.Kind {
+		case yaml.ScalarNode:
+			list = append(list, item.Value)
+		case yaml.MappingNode:
+			var long struct {
+				Target    string `yaml:"target"`
+				Published string `yaml:"published"`
+				HostIP    string `yaml:"host_ip"`
+				Protocol  string `yaml:"protocol"`
+			}
+			if err := item.Decode(&long); err != nil {
+				return err
+			}
+			if long.Target == "" {
+				return fmt.Errorf("line %d: port target is required", item.Line)
+			}
+			spec := long.Target
+			if long.Published != "" {
+				spec = long.Published + ":" + spec
+				if long.HostIP != "" {
+					spec = long.HostIP + ":" + spec
+				}
+			}
+			if long.Protocol != "" {
+				spec += "/" + long.Protocol
+			}
+			list = append(list, spec)
+		default:
+			return fmt.Errorf("line %d: invalid port entry", item.Line)
+		}
+	}
+	*p = list
+	return nil
+}
+
+func (v *ServiceVolume) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		parsed, err := ParseVolumeSpec(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*v = parsed
+		return nil
+	}
+
+	type plain ServiceVolume
+	if err := node.Decode((*plain)(v)); err != nil {
+		return err
+	}
+	if v.Type == "" {
+		v.Type = VolumeTypeVolume
+	}
+	if v.Target == "" {
+		return fmt.Errorf("line %d: volume target is required", node.Line)
+	}
+	return nil
+}
+
+// ParseVolumeSpec converts a short volume entry ([source:]target[:mode])
+// to long syntax. Sources that look like paths are bind mounts, others are
+// named volumes.
+func ParseVolumeSpec(spec string) (ServiceVolume, error) {
+	parts := strings.Split(spec, ":")
+	var v ServiceVolume
+	var mode string
+
+	switch len(parts) {
+	case 1:
+		v.Target = parts[0]
+	case 2:
+		if strings.HasPrefix(parts[1], "/") {
+			v.Source, v.Target = parts[0], parts[1]
+		} else {
+			v.Target, mode = parts[0], parts[1]
+		}
+	case 3:
+		v.Source, v.Target, mode = parts[0], parts[1], parts[2]
+	default:
+		return v, fmt.Errorf("invalid volume spec %q", spec)
+	}
+	if v.Target == "" {
+		return v, fmt.Errorf("invalid volume spec %q: empty target", spec)
+	}
+
+	switch {
+	case v.Source == "":
+		v.Type = VolumeTypeVolume
+	case strings.HasPrefix(v.Source, "/"), strings.HasPrefix(v.Source, "."), strings.HasPrefix(v.Source, "~"):
+		v.Type = VolumeTypeBind
+	default:
+		v.Type = VolumeTypeVolume
+	}
+
+	for _, opt := range strings.Split(mode, ",") {
+		switch opt {
+		case "":
+		case "ro":
+			v.ReadOnly = true
+		case "rw":
+		case "z", "Z":
+			v.bindOptions().SELinux = opt
+		case "shared", "rshared", "slave", "rslave", "private", "rprivate":
+			v.bindOptions().Propagation = opt
+		case "nocopy":
+			if v.Volume == nil {
+				v.Volume = &ServiceVolumeOpts{}
+			}
+			v.Volume.NoCopy = true
+		default:
+			return v, fmt.Errorf("invalid volume mode %q in %q", opt, spec)
+		}
+	}
+	return v, nil
+}
+
+func (v *ServiceVolume) bindOptions() *ServiceVolumeBind {
+	if v.Bind == nil {
+		v.Bind = &ServiceVolumeBind{}
+	}
+	return v.Bind
+}
+
+func (n *ServiceNetworks) UnmarshalYAML(node *yaml.Node) error {
+	result := make(ServiceNetworks)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			result[item.Value] = nil
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.ShortTag() == "!!null" {
+				result[key.Value] = nil
+				continue
+			}
+			var spec ServiceNetworkSpec
+			if err := value.Decode(&spec); err != nil {
+				return err
+			}
+			result[key.Value] = &spec
+		}
+	default:
+		return fmt.Errorf("line %d: networks must be a list or a mapping", node.Line)
+	}
+	*n = result
+	return nil
+}
+
+func (d *DependsOn) UnmarshalYAML(node *yaml.Node) error {
+	result := make(DependsOn)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			result[item.Value] = DependencySpec{Condition: ConditionServiceStarted, Required: true}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			var spec struct {
+				Condition string `yaml:"condition"`
+				Restart   bool   `yaml:"restart"`
+				Required  *bool  `yaml:"required"`
+			}
+			if value.ShortTag() != "!!null" {
+				if err := value.Decode(&spec); err != nil {
+					return err
+				}
+			}
+			dep := DependencySpec{Condition: spec.Condition, Restart: spec.Restart, Required: true}
+			if dep.Condition == "" {
+				dep.Condition = ConditionServiceStarted
+			}
+			if spec.Required != nil {
+				dep.Required = *spec.Required
+			}
+			switch dep.Condition {
+			case ConditionServiceStarted, ConditionServiceHealthy, ConditionServiceCompletedSuccessfully:
+			default:
+				return fmt.Errorf("line %d: unknown depends_on condition %s", value.Line, dep.Condition)
+			}
+			result[key.Value] = dep
+		}
+	default:
+		return fmt.Errorf("line %d: depends_on must be a list or a mapping", node.Line)
+	}
+	*d = result
+	return nil
+}
+
+func (b *BuildSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*b = BuildSpec{Context: node.Value}
+		return nil
+	}
+	type plain BuildSpec
+	return node.Decode((*plain)(b))
+}
+
+func (u *Ulimit) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		n, err := strconv.ParseInt(node.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid ulimit %q", node.Line, node.Value)
+		}
+		*u = Ulimit{Soft: n, Hard: n}
+		return nil
+	}
+	type plain Ulimit
+	return node.Decode((*plain)(u))
+}
+
+func (h *HostsList) UnmarshalYAML(node *yaml.Node) error {
+	var list HostsList
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			entry := item.Value
+			// host=ip is accepted as well as host:ip
+			if host, ip, ok := strings.Cut(entry, "="); ok {
+				entry = host + ":" + ip
+			}
+			list = append(list, entry)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			host, value := node.Content[i], node.Content[i+1]
+			if value.Kind == yaml.SequenceNode {
+				for _, ip := range value.Content {
+					list = append(list, host.Value+":"+ip.Value)
+				}
+				continue
+			}
+			list = append(list, host.Value+":"+value.Value)
+		}
+	default:
+		return fmt.Errorf("line %d: extra_hosts must be a list or a mapping", node.Line)
+	}
+	*h = list
+	return nil
+}
+
+func (r *ServiceFileRef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*r = ServiceFileRef{Source: node.Value}
+		return nil
+	}
+	type plain ServiceFileRef
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	if r.Source == "" {
+		return fmt.Errorf("line %d: source is required", node.Line)
+	}
+	return nil
+}
+
+func (s *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: size must be a number or a string", node.Line)
+	}
+	*s = ByteSize(node.Value)
+	return nil
+}
+
+// SplitShellWords splits a command line into words, honouring single and
+// double quotes and backslash escapes as a POSIX shell would
+func SplitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -21,6 +21,40 @@ type ContainerResponse struct {
 	Mounts     []MountInfo      `json:"mounts"`
 	Labels     map[string]string `json:"labels"`
 	RestartCount int            `json:"restartCount"`
+	Health     *HealthInfo      `json:"health,omitempty"`
+}
+
+// HealthInfo represents the current health check state of a container
+type HealthInfo struct {
+	Status        string        `json:"status"`
+	FailingStreak int           `json:"failingStreak"`
+	Log           []HealthProbe `json:"log"`
+}
+
+// HealthProbe represents the result of a single health check run
+type HealthProbe struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	Output   string    `json:"output"`
+}
+
+// HealthTransition represents a recorded change of health status
+type HealthTransition struct {
+	Time          time.Time `json:"time"`
+	Status        string    `json:"status"`
+	Previous      string    `json:"previous,omitempty"`
+	FailingStreak int       `json:"failingStreak"`
+	ExitCode      int       `json:"exitCode"`
+	Output        string    `json:"output,omitempty"`
+}
+
+// ContainerHealthResponse represents current health and its recorded history
+type ContainerHealthResponse struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Health  *HealthInfo        `json:"health"`
+	History []HealthTransition `json:"history"`
 }
 
 // PortMapping represents container port mappings
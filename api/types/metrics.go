@@ -0,0 +1,30 @@
+package types
+
+import "time"
+
+// MetricPoint is a single value in a metric time series. Rolled-up points
+// carry the average as Value plus the extremes of the underlying samples.
+type MetricPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+}
+
+// MetricQueryResponse is the result of a historical metrics query
+type MetricQueryResponse struct {
+	Container  string        `json:"container"`
+	Metric     string        `json:"metric"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Step       string        `json:"step"`
+	Resolution string        `json:"resolution"`
+	Points     []MetricPoint `json:"points"`
+}
+
+// MetricSeries describes a series available in the metrics store
+type MetricSeries struct {
+	Container string    `json:"container"`
+	Metric    string    `json:"metric"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Types of template inputs
+const (
+	TemplateInputString   = "string"
+	TemplateInputPassword = "password"
+	TemplateInputInteger  = "integer"
+	TemplateInputNumber   = "number"
+	TemplateInputBoolean  = "boolean"
+	TemplateInputPort     = "port"
+	TemplateInputEnum     = "enum"
+)
+
+// ComposeTemplate is a parameterized compose project from the templates
+// directory. Name is the name of its directory; the other fields come from
+// its template.yaml, except Services and Files.
+type ComposeTemplate struct {
+	Name        string          `json:"name" yaml:"-"`
+	Title       string          `json:"title" yaml:"title"`
+	Description string          `json:"description,omitempty" yaml:"description,omitempty"`
+	Category    string          `json:"category,omitempty" yaml:"category,omitempty"`
+	Version     string          `json:"version,omitempty" yaml:"version,omitempty"`
+	Inputs      []TemplateInput `json:"inputs" yaml:"inputs"`
+	Services    []string        `json:"services" yaml:"-"`
+	Files       []string        `json:"files" yaml:"-"`
+}
+
+// TemplateInput is a variable of a template, set in the .env file of the
+// projects deployed from it. Min and Max bound numbers and ports, Pattern
+// strings and passwords. A password with Generate gets a random value
+// when none is given.
+type TemplateInput struct {
+	Name        string   `json:"name" yaml:"name"`
+	Label       string   `json:"label,omitempty" yaml:"label,omitempty"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Type        string   `json:"type" yaml:"type"`
+	Default     string   `json:"default,omitempty" yaml:"default,omitempty"`
+	Required    bool     `json:"required,omitempty" yaml:"required,omitempty"`
+	Options     []string `json:"options,omitempty" yaml:"options,omitempty"`
+	Pattern     string   `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Min         *float64 `json:"min,omitempty" yaml:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty" yaml:"max,omitempty"`
+	Generate    bool     `json:"generate,omitempty" yaml:"generate,omitempty"`
+}
+
+// TemplateValues are the values of template inputs. JSON numbers and
+// booleans are accepted as well as strings.
+type TemplateValues map[string]string
+
+func (v *TemplateValues) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	values := make(TemplateValues, len(raw))
+	for name, value := range raw {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			values[name] = value
+		case float64:
+			values[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			values[name] = strconv.FormatBool(value)
+		default:
+			return fmt.Errorf("input %s must be a string, number or boolean", name)
+		}
+	}
+	*v = values
+	return nil
+}
+
+// TemplateDeployRequest creates a project from a template. Up defaults to
+// true and starts the project once it is written.
+type TemplateDeployRequest struct {
+	Project string         `json:"project"`
+	Inputs  TemplateValues `json:"inputs,omitempty"`
+	Up      *bool          `json:"up,omitempty"`
+}
+
+// TemplateDeployment is a project created from a template
+type TemplateDeployment struct {
+	Project  string   `json:"project"`
+	Template string   `json:"template"`
+	Files    []string `json:"files"`
+}
@@ -0,0 +1,359 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	units "github.com/docker/go-units"
+)
+
+const (
+	// cacheInspectConcurrency bounds inspects in flight during a resync
+	cacheInspectConcurrency = 8
+
+	// cacheEventBuffer is how many events may queue before the cache falls
+	// back to a full resync
+	cacheEventBuffer = 1024
+)
+
+// CachedContainer pairs the list summary of a container with its inspect
+// result. Summary.Status is left empty because the daemon's relative time
+// text goes stale; use StatusText instead.
+type CachedContainer struct {
+	Summary types.Container
+	Inspect types.ContainerJSON
+}
+
+// Snapshot is an immutable, consistent view of the cached daemon state.
+// Versions increase whenever the corresponding resource set changes.
+type Snapshot struct {
+	Containers        []CachedContainer
+	Images            []image.Summary
+	ContainersVersion uint64
+	ImagesVersion     uint64
+	Updated           time.Time
+}
+
+// StateCache keeps containers and images in memory. It bootstraps from a
+// full list and inspect, applies incremental updates from the event stream
+// and periodically resyncs to heal anything the stream missed.
+type StateCache struct {
+	client *client.Client
+	resync time.Duration
+	events chan events.Message
+	resets chan struct{}
+
+	mu         sync.RWMutex
+	containers map[string]CachedContainer
+	snapshot   *Snapshot
+	ready      chan struct{}
+	readyOnce  sync.Once
+}
+
+// NewStateCache creates a cache that fully resyncs at the given interval
+func NewStateCache(client *client.Client, resync time.Duration) *StateCache {
+	return &StateCache{
+		client:     client,
+		resync:     resync,
+		events:     make(chan events.Message, cacheEventBuffer),
+		resets:     make(chan struct{}, 1),
+		containers: make(map[string]CachedContainer),
+		snapshot:   &Snapshot{},
+		ready:      make(chan struct{}),
+	}
+}
+
+// HandleEvent queues an event for the cache worker. It never blocks the
+// event watcher; if the queue overflows the cache schedules a resync.
+func (c *StateCache) HandleEvent(msg events.Message) {
+	select {
+	case c.events <- msg:
+	default:
+		c.Invalidate()
+	}
+}
+
+// Invalidate schedules a full resync, e.g. after the event stream reconnects
+func (c *StateCache) Invalidate() {
+	select {
+	case c.resets <- struct{}{}:
+	default:
+	}
+}
+
+// Ready reports whether the initial bootstrap has completed
+func (c *StateCache) Ready() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Snapshot returns the current consistent view of the cache
+func (c *StateCache) Snapshot() *Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snapshot
+}
+
+// Run bootstraps the cache and applies events until the context is
+// cancelled. Events are applied in arrival order by a single worker so that
+// a late refresh can never resurrect a destroyed container.
+func (c *StateCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.resync)
+	defer ticker.Stop()
+
+	c.sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.sync(ctx)
+		case <-c.resets:
+			c.sync(ctx)
+		case msg := <-c.events:
+			c.apply(ctx, msg)
+		}
+	}
+}
+
+func (c *StateCache) sync(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	summaries, err := c.client.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		log.Printf("Warning: state cache failed to list containers: %v", err)
+		return
+	}
+
+	fresh := make(map[string]CachedContainer, len(summaries))
+	var freshMu sync.Mutex
+	sem := make(chan struct{}, cacheInspectConcurrency)
+	var wg sync.WaitGroup
+
+	for _, s := range summaries {
+		wg.Add(1)
+		go func(s types.Container) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			inspect, err := c.client.ContainerInspect(ctx, s.ID)
+			if err != nil {
+				return
+			}
+			s.Status = ""
+			freshMu.Lock()
+			fresh[s.ID] = CachedContainer{Summary: s, Inspect: inspect}
+			freshMu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+
+	images, err := c.client.ImageList(ctx, image.ListOptions{All: true})
+	if err != nil {
+		log.Printf("Warning: state cache failed to list images: %v", err)
+		images = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := *c.snapshot
+	if !reflect.DeepEqual(fresh, c.containers) {
+		c.containers = fresh
+		next.Containers = sortedContainers(fresh)
+		next.ContainersVersion++
+	}
+	if images != nil && !reflect.DeepEqual(images, c.snapshot.Images) {
+		next.Images = images
+		next.ImagesVersion++
+	}
+	next.Updated = time.Now()
+	c.snapshot = &next
+
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+func (c *StateCache) apply(ctx context.Context, msg events.Message) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	switch msg.Type {
+	case events.ContainerEventType:
+		switch msg.Action {
+		case events.ActionDestroy:
+			c.removeContainer(msg.Actor.ID)
+		case events.ActionAttach, events.ActionDetach, events.ActionResize, events.ActionTop,
+			events.ActionCopy, events.ActionArchivePath, events.ActionExtractToDir, events.ActionExport:
+			// No state change
+		default:
+			if strings.HasPrefix(string(msg.Action), "exec_") {
+				return
+			}
+			c.refreshContainer(ctx, msg.Actor.ID)
+		}
+	case events.NetworkEventType:
+		if msg.Action == events.ActionConnect || msg.Action == events.ActionDisconnect {
+			if id := msg.Actor.Attributes["container"]; id != "" {
+				c.refreshContainer(ctx, id)
+			}
+		}
+	case events.ImageEventType:
+		c.refreshImages(ctx)
+	}
+}
+
+func (c *StateCache) refreshContainer(ctx context.Context, id string) {
+	inspect, err := c.client.ContainerInspect(ctx, id)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			c.removeContainer(id)
+		}
+		return
+	}
+
+	f := filters.NewArgs()
+	f.Add("id", inspect.ID)
+	summaries, err := c.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil || len(summaries) == 0 {
+		return
+	}
+	summary := summaries[0]
+	summary.Status = ""
+	entry := CachedContainer{Summary: summary, Inspect: inspect}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.containers[inspect.ID]; ok && reflect.DeepEqual(existing, entry) {
+		return
+	}
+	containers := make(map[string]CachedContainer, len(c.containers)+1)
+	for k, v := range c.containers {
+		containers[k] = v
+	}
+	containers[inspect.ID] = entry
+	c.publishContainersLocked(containers)
+}
+
+func (c *StateCache) removeContainer(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.containers[id]; !ok {
+		return
+	}
+	containers := make(map[string]CachedContainer, len(c.containers))
+	for k, v := range c.containers {
+		if k != id {
+			containers[k] = v
+		}
+	}
+	c.publishContainersLocked(containers)
+}
+
+func (c *StateCache) publishContainersLocked(containers map[string]CachedContainer) {
+	c.containers = containers
+	next := *c.snapshot
+	next.Containers = sortedContainers(containers)
+	next.ContainersVersion++
+	next.Updated = time.Now()
+	c.snapshot = &next
+}
+
+func (c *StateCache) refreshImages(ctx context.Context) {
+	images, err := c.client.ImageList(ctx, image.ListOptions{All: true})
+	if err != nil {
+		log.Printf("Warning: state cache failed to list images: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reflect.DeepEqual(images, c.snapshot.Images) {
+		return
+	}
+	next := *c.snapshot
+	next.Images = images
+	next.ImagesVersion++
+	next.Updated = time.Now()
+	c.snapshot = &next
+}
+
+// sortedContainers orders containers newest first, matching the daemon's
+// list order.
+func sortedContainers(m map[string]CachedContainer) []CachedContainer {
+	result := make([]CachedContainer, 0, len(m))
+	for _, cc := range m {
+		result = append(result, cc)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i].Summary, result[j].Summary
+		if a.Created != b.Created {
+			return a.Created > b.Created
+		}
+		return a.ID < b.ID
+	})
+	return result
+}
+
+// StatusText renders the human readable status the daemon would report now,
+// e.g. "Up 5 minutes (healthy)" or "Exited (1) 2 hours ago".
+func StatusText(inspect types.ContainerJSON) string {
+	s := inspect.State
+	if s == nil {
+		return ""
+	}
+
+	started, _ := time.Parse(time.RFC3339Nano, s.StartedAt)
+	finished, _ := time.Parse(time.RFC3339Nano, s.FinishedAt)
+	now := time.Now().UTC()
+
+	if s.Running {
+		if s.Paused {
+			return fmt.Sprintf("Up %s (Paused)", units.HumanDuration(now.Sub(started)))
+		}
+		if s.Restarting {
+			return fmt.Sprintf("Restarting (%d) %s ago", s.ExitCode, units.HumanDuration(now.Sub(finished)))
+		}
+		if s.Health != nil {
+			health := s.Health.Status
+			if health == types.Starting {
+				health = "health: starting"
+			}
+			return fmt.Sprintf("Up %s (%s)", units.HumanDuration(now.Sub(started)), health)
+		}
+		return fmt.Sprintf("Up %s", units.HumanDuration(now.Sub(started)))
+	}
+
+	switch {
+	case s.Status == "removing":
+		return "Removal In Progress"
+	case s.Dead:
+		return "Dead"
+	case started.IsZero():
+		return "Created"
+	case finished.IsZero():
+		return ""
+	}
+	return fmt.Sprintf("Exited (%d) %s ago", s.ExitCode, units.HumanDuration(now.Sub(finished)))
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,18 +17,46 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
-	"gopkg.in/yaml.v3"
+	units "github.com/docker/go-units"
 )
 
+// Labels the compose CLI sets on the containers, networks and volumes of a
+// project, besides the project and service labels
+const (
+	composeVersionLabel         = "com.docker.compose.version"
+	composeOneoffLabel          = "com.docker.compose.oneoff"
+	composeContainerNumberLabel = "com.docker.compose.container-number"
+	composeWorkingDirLabel      = "com.docker.compose.project.working_dir"
+	composeConfigFilesLabel     = "com.docker.compose.project.config_files"
+	composeDependsOnLabel       = "com.docker.compose.depends_on"
+	composeNetworkLabel         = "com.docker.compose.network"
+	composeVolumeLabel          = "com.docker.compose.volume"
+)
+
+// ComposeVersion is the compose CLI version whose conventions containers
+// and networks follow, recorded in their version label
+const ComposeVersion = "2.29.7"
+
+// defaultNetwork is the network services join when they declare none
+const defaultNetwork = "default"
+
 type ComposeProject struct {
 	Name       string
 	ConfigPath string
 	Config     *apitypes.ComposeConfig
 	client     *client.Client
 	mu         sync.RWMutex
+	report     func(apitypes.ComposeProgress)
+
+	// services holds every service of the config, and inactive the
+	// profiles of those ActivateProfiles left out of Config
+	services map[string]apitypes.ServiceSpec
+	inactive map[string][]string
 }
 
 type ProjectStatus struct {
@@ -56,48 +84,105 @@ type ContainerInfo struct {
 }
 
 func NewComposeProject(client *client.Client, name string, config *apitypes.ComposeConfig) (*ComposeProject, error) {
-	return &ComposeProject{
+	configPath := filepath.Join("compose", name, "docker-compose.yml")
+	if len(config.ConfigFiles) > 0 {
+		configPath = config.ConfigFiles[0]
+	}
+	p := &ComposeProject{
 		Name:       name,
-		ConfigPath: filepath.Join("compose", name, "docker-compose.yml"),
+		ConfigPath: configPath,
 		Config:     config,
 		client:     client,
-	}, nil
+		services:   config.Services,
+	}
+	p.ActivateProfiles(nil)
+	return p, nil
 }
 
-func (p *ComposeProject) Up(ctx context.Context) error {
+// Up converges the project on its config and returns the plan it
+// executed. Running containers whose config is unchanged are left alone,
+// so Up can be repeated safely. With DryRun only the plan is returned.
+func (p *ComposeProject) Up(ctx context.Context, opts UpOptions) (*apitypes.ComposePlan, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Create networks first
+	// Images are resolved first so that the plan sees pulled images
+	pulls, err := p.imagePulls(ctx, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DryRun {
+		if err := p.pullImages(ctx, pulls); err != nil {
+			return nil, err
+		}
+	}
+
+	plan, steps, err := p.plan(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, pull := range pulls {
+		plan.Pulls = append(plan.Pulls, pull.ref)
+	}
+	if opts.DryRun {
+		return plan, nil
+	}
+
+	// Create networks and volumes first
 	if err := p.createNetworks(ctx); err != nil {
-		return fmt.Errorf("failed to create networks: %w", err)
+		return plan, fmt.Errorf("failed to create networks: %w", err)
+	}
+	if err := p.createVolumes(ctx); err != nil {
+		return plan, fmt.Errorf("failed to create volumes: %w", err)
 	}
 
-	// Create and start services in dependency order
-	services := p.getServiceOrder()
-	for _, serviceName := range services {
-		if err := p.startService(ctx, serviceName); err != nil {
-			return fmt.Errorf("failed to start service %s: %w", serviceName, err)
-		}
+	// Containers are converged in dependency order, waiting for the
+	// depends_on conditions of each service
+	timeout := opts.WaitTimeout
+	if timeout <= 0 {
+		timeout = DefaultDependencyTimeout
 	}
+	return plan, p.applyInLevels(ctx, steps, timeout)
+}
 
-	return nil
+// OnProgress sets the function that receives the steps of operations
+func (p *ComposeProject) OnProgress(fn func(apitypes.ComposeProgress)) {
+	p.report = fn
 }
 
-func (p *ComposeProject) Down(ctx context.Context) error {
+// Restart restarts the containers of the project in dependency order
+func (p *ComposeProject) Restart(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Stop and remove containers in reverse dependency order
-	services := p.getServiceOrder()
-	for i := len(services) - 1; i >= 0; i-- {
-		if err := p.stopService(ctx, services[i]); err != nil {
-			return fmt.Errorf("failed to stop service %s: %w", services[i], err)
-		}
+	services, err := p.getServiceOrder()
+	if err != nil {
+		return err
+	}
+	containers, err := p.projectContainers(ctx)
+	if err != nil {
+		return err
 	}
 
-	// Remove networks
-	return p.removeNetworks(ctx)
+	for _, service := range services {
+		for _, c := range containers {
+			if c.Labels["com.docker.compose.service"] != service {
+				continue
+			}
+			name := summaryName(c)
+			reportf(p.report, service, name, apitypes.StepRestarting, "")
+			stop, err := stopOptions(p.Config.Services[service], nil)
+			if err != nil {
+				return err
+			}
+			if err := p.client.ContainerRestart(ctx, c.ID, stop); err != nil {
+				reportf(p.report, service, name, apitypes.StepFailed, "%v", err)
+				return fmt.Errorf("failed to restart container %s: %w", name, err)
+			}
+			reportf(p.report, service, name, apitypes.StepStarted, "")
+		}
+	}
+	return nil
 }
 
 func (p *ComposeProject) Scale(ctx context.Context, service string, replicas int) error {
@@ -109,36 +194,39 @@ func (p *ComposeProject) Scale(ctx context.Context, service string, replicas int
 		return fmt.Errorf("service %s not found", service)
 	}
 
-	// Get current containers for the service
-	f := filters.NewArgs()
-	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
-	f.Add("label", fmt.Sprintf("com.docker.compose.service=%s", service))
-
-	containers, err := p.client.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: f,
-	})
+	// Get current containers for the service, leaving out one-off ones
+	all, err := p.projectContainers(ctx)
 	if err != nil {
 		return err
 	}
+	var containers []types.Container
+	for _, c := range all {
+		if c.Labels["com.docker.compose.service"] == service {
+			containers = append(containers, c)
+		}
+	}
 
-	currentCount := len(containers)
+	// Replicas are matched by number, so missing numbers are filled and the
+	// highest numbers removed rather than going by list order
+	byIndex, extra := replicasByIndex(containers, replicas)
 
-	// Scale up
-	if replicas > currentCount {
-		for i := currentCount; i < replicas; i++ {
-			if err := p.createContainer(ctx, service, svcConfig, i); err != nil {
-				return err
-			}
+	// Scale down
+	for _, c := range extra {
+		name := summaryName(c)
+		reportf(p.report, service, name, apitypes.StepRemoving, "")
+		if err := p.removeContainer(ctx, c.ID, svcConfig); err != nil {
+			return err
 		}
+		reportf(p.report, service, name, apitypes.StepRemoved, "")
 	}
 
-	// Scale down
-	if replicas < currentCount {
-		for i := currentCount - 1; i >= replicas; i-- {
-			if err := p.removeContainer(ctx, containers[i].ID); err != nil {
-				return err
-			}
+	// Scale up
+	for i := 0; i < replicas; i++ {
+		if _, ok := byIndex[i]; ok {
+			continue
+		}
+		if err := p.runContainer(ctx, service, svcConfig, i); err != nil {
+			return err
 		}
 	}
 
@@ -169,12 +257,26 @@ func (p *ComposeProject) Status(ctx context.Context) (*ProjectStatus, error) {
 			Containers: make([]ContainerInfo, 0),
 		}
 	}
+	for serviceName := range p.inactive {
+		services[serviceName] = ServiceInfo{
+			Name:       serviceName,
+			Status:     "inactive",
+			Replicas:   0,
+			Containers: make([]ContainerInfo, 0),
+		}
+	}
 
 	for _, c := range containers {
+		if strings.EqualFold(c.Labels[composeOneoffLabel], "true") {
+			continue
+		}
 		serviceName := c.Labels["com.docker.compose.service"]
 		svc := services[serviceName]
 		svc.Replicas++
 		svc.Status = c.State
+		if _, inactive := p.inactive[serviceName]; inactive {
+			svc.Status = "inactive"
+		}
 		svc.Containers = append(svc.Containers, ContainerInfo{
 			ID:      c.ID,
 			Name:    strings.TrimPrefix(c.Names[0], "/"),
@@ -208,6 +310,9 @@ func (p *ComposeProject) Logs(ctx context.Context, service string, follow bool)
 
 	readers := make([]io.Reader, 0, len(containers))
 	for _, c := range containers {
+		if _, inactive := p.inactive[c.Labels["com.docker.compose.service"]]; inactive {
+			continue
+		}
 		logs, err := p.client.ContainerLogs(ctx, c.ID, container.LogsOptions{
 			ShowStdout: true,
 			ShowStderr: true,
@@ -223,80 +328,105 @@ func (p *ComposeProject) Logs(ctx context.Context, service string, follow bool)
 	return io.NopCloser(io.MultiReader(readers...)), nil
 }
 
-// Helper functions
-func loadComposeFile(path string) (*apitypes.ComposeConfig, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var config apitypes.ComposeConfig
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
-	}
-
-	return &config, nil
+func (p *ComposeProject) getServiceOrder() ([]string, error) {
+	return ServiceOrder(p.Config.Services)
 }
 
-func (p *ComposeProject) getServiceOrder() []string {
-	// Create dependency graph
-	graph := make(map[string][]string)
-	for name, service := range p.Config.Services {
-		graph[name] = service.DependsOn
+// ServiceOrder sorts services so that every service comes after the
+// services it depends on. A dependency cycle is an error.
+func ServiceOrder(services map[string]apitypes.ServiceSpec) ([]string, error) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	// Perform topological sort
 	visited := make(map[string]bool)
-	temp := make(map[string]bool)
+	var stack []string
 	var order []string
 
-	var visit func(node string) bool
-	visit = func(node string) bool {
-		if temp[node] {
-			return false // Cycle detected
+	var visit func(node string) error
+	visit = func(node string) error {
+		for i, s := range stack {
+			if s == node {
+				return fmt.Errorf("dependency cycle: %s", strings.Join(append(stack[i:], node), " -> "))
+			}
 		}
 		if visited[node] {
-			return true
+			return nil
 		}
-		temp[node] = true
+		stack = append(stack, node)
 
-		for _, dep := range graph[node] {
-			if !visit(dep) {
-				return false
+		deps := make([]string, 0, len(services[node].DependsOn))
+		for dep := range services[node].DependsOn {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if _, ok := services[dep]; !ok {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
 			}
 		}
 
-		temp[node] = false
+		stack = stack[:len(stack)-1]
 		visited[node] = true
 		order = append(order, node)
-		return true
+		return nil
 	}
 
-	for name := range p.Config.Services {
-		if !visited[name] {
-			if !visit(name) {
-				// Handle circular dependencies
-				log.Printf("Warning: circular dependency detected in service %s", name)
-			}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
 		}
 	}
-
-	return order
+	return order, nil
 }
 
+// createNetworks creates the networks of the project that don't exist yet,
+// with the driver, options and address management they declare
 func (p *ComposeProject) createNetworks(ctx context.Context) error {
-	for name, config := range p.Config.Networks {
+	for name, config := range p.projectNetworks() {
 		if config.External {
 			continue
 		}
 
-		_, err := p.client.NetworkCreate(ctx, fmt.Sprintf("%s_%s", p.Name, name), types.NetworkCreate{
-			Driver: "bridge",
-			Labels: map[string]string{
-				"com.docker.compose.project": p.Name,
-				"com.docker.compose.network": name,
-			},
-		})
+		labels := map[string]string{}
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		labels["com.docker.compose.project"] = p.Name
+		labels[composeNetworkLabel] = name
+		labels[composeVersionLabel] = ComposeVersion
+
+		options := types.NetworkCreate{
+			Driver:     config.Driver,
+			Options:    config.DriverOpts,
+			Internal:   config.Internal,
+			Attachable: config.Attachable,
+			Labels:     labels,
+		}
+		if options.Driver == "" {
+			options.Driver = "bridge"
+		}
+		if config.EnableIPv6 {
+			enable := true
+			options.EnableIPv6 = &enable
+		}
+		if config.Ipam != nil {
+			options.IPAM = &network.IPAM{Driver: config.Ipam.Driver}
+			for _, pool := range config.Ipam.Config {
+				options.IPAM.Config = append(options.IPAM.Config, network.IPAMConfig{
+					Subnet:  pool.Subnet,
+					IPRange: pool.IPRange,
+					Gateway: pool.Gateway,
+				})
+			}
+		}
+
+		_, err := p.client.NetworkCreate(ctx, p.networkName(name), options)
 		if err != nil && !strings.Contains(err.Error(), "already exists") {
 			return fmt.Errorf("failed to create network %s: %w", name, err)
 		}
@@ -304,72 +434,70 @@ func (p *ComposeProject) createNetworks(ctx context.Context) error {
 	return nil
 }
 
-func (p *ComposeProject) removeNetworks(ctx context.Context) error {
-	f := filters.NewArgs()
-	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
-
-	networks, err := p.client.NetworkList(ctx, types.NetworkListOptions{Filters: f})
-	if err != nil {
-		return err
-	}
+// createVolumes creates the named volumes declared by the project that are
+// not external. Creating a volume that exists returns it unchanged.
+func (p *ComposeProject) createVolumes(ctx context.Context) error {
+	for name, config := range p.Config.Volumes {
+		if config.External {
+			continue
+		}
 
-	for _, network := range networks {
-		if err := p.client.NetworkRemove(ctx, network.ID); err != nil {
-			log.Printf("Warning: failed to remove network %s: %v", network.Name, err)
+		labels := map[string]string{}
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		labels["com.docker.compose.project"] = p.Name
+		labels[composeVolumeLabel] = name
+		labels[composeVersionLabel] = ComposeVersion
+
+		_, err := p.client.VolumeCreate(ctx, volume.CreateOptions{
+			Name:       p.volumeName(name),
+			Driver:     config.Driver,
+			DriverOpts: config.DriverOpts,
+			Labels:     labels,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create volume %s: %w", name, err)
 		}
 	}
 	return nil
 }
 
-func (p *ComposeProject) startService(ctx context.Context, service string) error {
-	svcConfig := p.Config.Services[service]
-	replicas := 1
-	if svcConfig.Deploy != nil && svcConfig.Deploy.Replicas > 0 {
-		replicas = svcConfig.Deploy.Replicas
+// createContainer creates a replica of a service, labelled with the hash
+// of its config
+func (p *ComposeProject) createContainer(ctx context.Context, service string, config apitypes.ServiceSpec, index int) (string, error) {
+	containerConfig, hostConfig, networkConfig, err := p.containerSpec(service, config, index)
+	if err != nil {
+		return "", err
 	}
 
-	for i := 0; i < replicas; i++ {
-		if err := p.createContainer(ctx, service, svcConfig, i); err != nil {
-			return err
-		}
+	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, p.containerName(service, index))
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	if err := p.copyFileObjects(ctx, resp.ID, service, config); err != nil {
+		p.client.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true})
+		return "", err
 	}
-	return nil
-}
 
-func (p *ComposeProject) stopService(ctx context.Context, service string) error {
-	f := filters.NewArgs()
-	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
-	f.Add("label", fmt.Sprintf("com.docker.compose.service=%s", service))
+	return resp.ID, nil
+}
 
-	containers, err := p.client.ContainerList(ctx, container.ListOptions{
-		All:     true,
-		Filters: f,
-	})
+// containerSpec returns the container, host and networking configs of a
+// replica of a service
+func (p *ComposeProject) containerSpec(service string, config apitypes.ServiceSpec, index int) (*container.Config, *container.HostConfig, *network.NetworkingConfig, error) {
+	hash, err := ServiceConfigHash(config)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	timeout := 30
-	for _, c := range containers {
-		if err := p.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: &timeout}); err != nil {
-			log.Printf("Warning: failed to stop container %s: %v", c.ID, err)
-			continue
-		}
-		if err := p.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
-			log.Printf("Warning: failed to remove container %s: %v", c.ID, err)
-		}
-	}
-	return nil
-}
-
-func (p *ComposeProject) createContainer(ctx context.Context, service string, config apitypes.ServiceSpec, index int) error {
 	// Parse port mappings
 	portBindings := nat.PortMap{}
 	exposedPorts := nat.PortSet{}
 	for _, portStr := range config.Ports {
 		portMapping, err := nat.ParsePortSpec(portStr)
 		if err != nil {
-			return fmt.Errorf("invalid port mapping %s: %w", portStr, err)
+			return nil, nil, nil, fmt.Errorf("invalid port mapping %s: %w", portStr, err)
 		}
 		for _, pm := range portMapping {
 			portBindings[pm.Port] = append(portBindings[pm.Port], pm.Binding)
@@ -377,51 +505,107 @@ func (p *ComposeProject) createContainer(ctx context.Context, service string, co
 		}
 	}
 
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels["com.docker.compose.project"] = p.Name
+	labels["com.docker.compose.service"] = service
+	labels[composeContainerNumberLabel] = strconv.Itoa(index + 1)
+	labels[composeOneoffLabel] = "False"
+	labels[composeVersionLabel] = ComposeVersion
+	labels[configHashLabel] = hash
+	labels[composeDependsOnLabel] = dependsOnLabel(config.DependsOn)
+	if p.Config.WorkingDir != "" {
+		labels[composeWorkingDirLabel] = p.Config.WorkingDir
+		labels[composeConfigFilesLabel] = strings.Join(p.Config.ConfigFiles, ",")
+	}
+
 	// Create container config
 	containerConfig := &container.Config{
-		Image:        config.Image,
-		Cmd:          config.Command,
-		Env:          mapToEnvSlice(config.Environment),
+		Image:        p.serviceImage(service, config),
+		Cmd:          []string(config.Command),
+		Entrypoint:   []string(config.Entrypoint),
+		Env:          mapToEnvSlice(config.Environment.Resolve(os.LookupEnv)),
 		ExposedPorts: exposedPorts,
-		Labels: map[string]string{
-			"com.docker.compose.project":  p.Name,
-			"com.docker.compose.service":  service,
-			"com.docker.compose.instance": strconv.Itoa(index),
-		},
+		WorkingDir:   config.WorkingDir,
+		User:         config.User,
+		Labels:       labels,
+	}
+
+	containerConfig.StopSignal = config.StopSignal
+	if config.StopGracePeriod != "" {
+		grace, err := time.ParseDuration(config.StopGracePeriod)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid stop_grace_period %s: %w", config.StopGracePeriod, err)
+		}
+		seconds := int(grace.Seconds())
+		containerConfig.StopTimeout = &seconds
+	}
+
+	if config.Healthcheck != nil {
+		healthcheck, err := convertHealthcheck(config.Healthcheck)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		containerConfig.Healthcheck = healthcheck
+	}
+
+	binds, mounts, err := p.convertVolumes(config.Volumes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	objects, err := p.serviceFileObjects(service, config)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	mounts = append(mounts, fileObjectMounts(objects)...)
 
 	// Create host config
 	hostConfig := &container.HostConfig{
 		PortBindings: portBindings,
-		Binds:        config.Volumes,
+		Binds:        binds,
+		Mounts:       mounts,
+	}
+	if err := p.applyHostOptions(hostConfig, config); err != nil {
+		return nil, nil, nil, fmt.Errorf("service %s: %w", service, err)
 	}
 
-	// Create networking config
+	// Create networking config. Services are reachable by their name on
+	// every network they join, and join the default network when they
+	// declare none. With network_mode they join no project network.
 	networkConfig := &network.NetworkingConfig{
 		EndpointsConfig: make(map[string]*network.EndpointSettings),
 	}
-	for netName := range p.Config.Networks {
-		networkConfig.EndpointsConfig[fmt.Sprintf("%s_%s", p.Name, netName)] = &network.EndpointSettings{}
-	}
-
-	// Create container
-	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, fmt.Sprintf("%s_%s_%d", p.Name, service, index))
-	if err != nil {
-		return fmt.Errorf("failed to create container: %w", err)
-	}
-
-	// Start container
-	if err := p.client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return fmt.Errorf("failed to start container: %w", err)
+	serviceNetworks := config.Networks
+	if len(serviceNetworks) == 0 && config.NetworkMode == "" {
+		serviceNetworks = apitypes.ServiceNetworks{defaultNetwork: nil}
+	}
+	for netName, netConfig := range serviceNetworks {
+		endpoint := &network.EndpointSettings{Aliases: []string{service}}
+		if netConfig != nil {
+			endpoint.Aliases = append(endpoint.Aliases, netConfig.Aliases...)
+			if netConfig.Ipv4Address != "" || netConfig.Ipv6Address != "" {
+				endpoint.IPAMConfig = &network.EndpointIPAMConfig{
+					IPv4Address: netConfig.Ipv4Address,
+					IPv6Address: netConfig.Ipv6Address,
+				}
+			}
+		}
+		networkConfig.EndpointsConfig[p.networkName(netName)] = endpoint
 	}
 
-	return nil
+	return containerConfig, hostConfig, networkConfig, nil
 }
 
-func (p *ComposeProject) removeContainer(ctx context.Context, containerID string) error {
-	// Stop container first
-	timeout := 30
-	if err := p.client.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout}); err != nil {
+// removeContainer stops a container of a service the way its spec asks and
+// removes it
+func (p *ComposeProject) removeContainer(ctx context.Context, containerID string, spec apitypes.ServiceSpec) error {
+	stop, err := stopOptions(spec, nil)
+	if err != nil {
+		return err
+	}
+	if err := p.client.ContainerStop(ctx, containerID, stop); err != nil {
 		return fmt.Errorf("failed to stop container %s: %w", containerID, err)
 	}
 
@@ -436,15 +620,16 @@ func (p *ComposeProject) removeContainer(ctx context.Context, containerID string
 	return nil
 }
 
+// determineProjectStatus summarizes the status of the active services
 func (p *ComposeProject) determineProjectStatus(services map[string]ServiceInfo) string {
-	total := len(services)
-	if total == 0 {
-		return "not_created"
-	}
-
+	total := 0
 	running := 0
 	stopped := 0
 	for _, svc := range services {
+		if svc.Status == "inactive" {
+			continue
+		}
+		total++
 		switch svc.Status {
 		case "running":
 			running++
@@ -453,6 +638,9 @@ func (p *ComposeProject) determineProjectStatus(services map[string]ServiceInfo)
 		}
 	}
 
+	if total == 0 {
+		return "not_created"
+	}
 	if running == total {
 		return "running"
 	}
@@ -470,3 +658,203 @@ func mapToEnvSlice(m map[string]string) []string {
 	}
 	return result
 }
+
+// containerName returns the name of a replica, numbered from 1 as by the
+// compose CLI
+func (p *ComposeProject) containerName(service string, index int) string {
+	return fmt.Sprintf("%s-%s-%d", p.Name, service, index+1)
+}
+
+// replicaIndex returns the 0-based replica index of a container from its
+// container-number label, falling back to the instance label of
+// containers created before compose naming
+func replicaIndex(labels map[string]string) (int, error) {
+	if n, ok := labels[composeContainerNumberLabel]; ok {
+		number, err := strconv.Atoi(n)
+		return number - 1, err
+	}
+	return strconv.Atoi(labels["com.docker.compose.instance"])
+}
+
+// replicasByIndex assigns the containers of a service to replica indexes
+// 0 to replicas-1. Containers without a valid index, beyond the count or
+// duplicating an index are returned as extra, highest number first.
+func replicasByIndex(containers []types.Container, replicas int) (map[int]types.Container, []types.Container) {
+	byIndex := make(map[int]types.Container)
+	var extra []types.Container
+	for _, c := range containers {
+		index, err := replicaIndex(c.Labels)
+		if _, taken := byIndex[index]; err != nil || index < 0 || index >= replicas || taken {
+			extra = append(extra, c)
+			continue
+		}
+		byIndex[index] = c
+	}
+	sort.SliceStable(extra, func(i, j int) bool {
+		a, _ := replicaIndex(extra[i].Labels)
+		b, _ := replicaIndex(extra[j].Labels)
+		return a > b
+	})
+	return byIndex, extra
+}
+
+// dependsOnLabel formats depends_on as the compose CLI does:
+// service:condition:restart pairs separated by commas
+func dependsOnLabel(deps apitypes.DependsOn) string {
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		condition := deps[name].Condition
+		if condition == "" {
+			condition = apitypes.ConditionServiceStarted
+		}
+		parts[i] = fmt.Sprintf("%s:%s:%t", name, condition, deps[name].Restart)
+	}
+	return strings.Join(parts, ",")
+}
+
+// projectNetworks returns the declared networks plus the default network
+// when a service joins it, explicitly or by declaring no networks
+func (p *ComposeProject) projectNetworks() map[string]apitypes.NetworkSpec {
+	networks := make(map[string]apitypes.NetworkSpec, len(p.Config.Networks)+1)
+	for name, spec := range p.Config.Networks {
+		networks[name] = spec
+	}
+	for _, spec := range p.Config.Services {
+		if _, ok := spec.Networks[defaultNetwork]; ok || len(spec.Networks) == 0 {
+			if _, declared := networks[defaultNetwork]; !declared {
+				networks[defaultNetwork] = apitypes.NetworkSpec{}
+			}
+		}
+	}
+	return networks
+}
+
+// networkName returns the daemon name of a project network
+func (p *ComposeProject) networkName(name string) string {
+	if spec, ok := p.Config.Networks[name]; ok {
+		if spec.Name != "" {
+			return spec.Name
+		}
+		if spec.External {
+			return name
+		}
+	}
+	return fmt.Sprintf("%s_%s", p.Name, name)
+}
+
+// volumeName returns the daemon name of a named project volume
+func (p *ComposeProject) volumeName(name string) string {
+	if spec, ok := p.Config.Volumes[name]; ok {
+		if spec.Name != "" {
+			return spec.Name
+		}
+		if spec.External {
+			return name
+		}
+	}
+	return fmt.Sprintf("%s_%s", p.Name, name)
+}
+
+// convertHealthcheck maps a compose health check to the container config.
+// A disabled check overrides the one in the image.
+func convertHealthcheck(spec *apitypes.HealthcheckSpec) (*container.HealthConfig, error) {
+	if spec.Disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+
+	hc := &container.HealthConfig{Test: []string(spec.Test)}
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{spec.Interval, &hc.Interval},
+		{spec.Timeout, &hc.Timeout},
+		{spec.StartPeriod, &hc.StartPeriod},
+		{spec.StartInterval, &hc.StartInterval},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid healthcheck duration %s: %w", d.value, err)
+		}
+		*d.target = duration
+	}
+	if spec.Retries != nil {
+		hc.Retries = *spec.Retries
+	}
+	return hc, nil
+}
+
+// convertVolumes maps service volumes to mounts. Named volumes are scoped
+// to the project unless declared external or given an explicit name. Bind
+// mounts with an SELinux label are returned as binds, since the mount API
+// cannot relabel.
+func (p *ComposeProject) convertVolumes(volumes []apitypes.ServiceVolume) ([]string, []mount.Mount, error) {
+	var binds []string
+	mounts := make([]mount.Mount, 0, len(volumes))
+	for _, v := range volumes {
+		m := mount.Mount{
+			Type:     mount.Type(v.Type),
+			Source:   v.Source,
+			Target:   v.Target,
+			ReadOnly: v.ReadOnly,
+		}
+
+		switch v.Type {
+		case apitypes.VolumeTypeBind:
+			if v.Bind != nil && v.Bind.SELinux != "" {
+				opts := []string{v.Bind.SELinux}
+				if v.ReadOnly {
+					opts = append(opts, "ro")
+				}
+				if v.Bind.Propagation != "" {
+					opts = append(opts, v.Bind.Propagation)
+				}
+				binds = append(binds, fmt.Sprintf("%s:%s:%s", v.Source, v.Target, strings.Join(opts, ",")))
+				continue
+			}
+			// Missing host paths are created, as compose does by default
+			m.BindOptions = &mount.BindOptions{CreateMountpoint: true}
+			if v.Bind != nil {
+				m.BindOptions.Propagation = mount.Propagation(v.Bind.Propagation)
+				if v.Bind.CreateHostPath != nil {
+					m.BindOptions.CreateMountpoint = *v.Bind.CreateHostPath
+				}
+			}
+		case apitypes.VolumeTypeVolume:
+			if v.Source != "" {
+				m.Source = p.volumeName(v.Source)
+			}
+			if v.Volume != nil {
+				m.VolumeOptions = &mount.VolumeOptions{
+					NoCopy:  v.Volume.NoCopy,
+					Subpath: v.Volume.Subpath,
+				}
+			}
+		case apitypes.VolumeTypeTmpfs:
+			if v.Tmpfs != nil {
+				m.TmpfsOptions = &mount.TmpfsOptions{Mode: os.FileMode(v.Tmpfs.Mode)}
+				if v.Tmpfs.Size != "" {
+					size, err := units.RAMInBytes(string(v.Tmpfs.Size))
+					if err != nil {
+						return nil, nil, fmt.Errorf("invalid tmpfs size %s: %w", v.Tmpfs.Size, err)
+					}
+					m.TmpfsOptions.SizeBytes = size
+				}
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported volume type %s", v.Type)
+		}
+
+		mounts = append(mounts, m)
+	}
+	return binds, mounts, nil
+}
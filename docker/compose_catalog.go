@@ -0,0 +1,566 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// catalogScanDepth is how many directory levels below a root are searched
+// for compose files
+const catalogScanDepth = 2
+
+// catalogScanTTL is how long a scan of the roots serves project lookups
+// before the roots are scanned again. Listing the catalog always rescans.
+const catalogScanTTL = time.Minute
+
+// ProjectLocation is where the compose files of a project live. Files is
+// empty when the default files of Dir are used.
+type ProjectLocation struct {
+	Dir     string
+	Files   []string
+	Managed bool
+}
+
+// MainFile returns the file that edits of the project replace: the first
+// of Files, or the default compose file of Dir
+func (l ProjectLocation) MainFile() string {
+	if len(l.Files) > 0 {
+		return resolvePath(l.Dir, l.Files[0])
+	}
+	if path, err := mainComposeFile(l.Dir); err == nil {
+		return path
+	}
+	return filepath.Join(l.Dir, "docker-compose.yml")
+}
+
+// ProjectCatalog discovers compose projects from three sources: the
+// project store and other root directories scanned for compose files, the
+// working directory and config file labels written by the compose CLI, and
+// the containers themselves. Projects are keyed by name; the store wins
+// over the roots, which win in the order they are configured.
+type ProjectCatalog struct {
+	client *client.Client
+	cache  *StateCache
+	store  *ComposeStore
+	roots  []string
+
+	mu        sync.Mutex
+	scanned   []rootProject
+	scannedAt time.Time
+}
+
+// rootProject is a project directory found below a root, with its files
+// loaded once per scan
+type rootProject struct {
+	dir     string
+	name    string
+	merged  *apitypes.MergedComposeConfig
+	loadErr error
+}
+
+// NewProjectCatalog creates a catalog over the store and the given roots
+func NewProjectCatalog(client *client.Client, cache *StateCache, store *ComposeStore, roots []string) *ProjectCatalog {
+	return &ProjectCatalog{client: client, cache: cache, store: store, roots: roots}
+}
+
+// catalogProject gathers what the sources know about one project
+type catalogProject struct {
+	name       string
+	dir        string
+	files      []string
+	managed    bool
+	sources    []string
+	containers []CachedContainer
+	labelDir   string
+	labelFiles []string
+	merged     *apitypes.MergedComposeConfig
+	loadErr    error
+}
+
+func (p *catalogProject) addSource(source string) {
+	for _, s := range p.sources {
+		if s == source {
+			return
+		}
+	}
+	p.sources = append(p.sources, source)
+}
+
+// load reads the project's compose files once
+func (p *catalogProject) load() {
+	if p.merged != nil || p.loadErr != nil || p.dir == "" {
+		return
+	}
+	p.merged, p.loadErr = MergeComposeProject(p.dir, ComposeLoadOptions{Files: p.files})
+}
+
+// Projects returns every known project with its status and drift, sorted
+// by name
+func (c *ProjectCatalog) Projects(ctx context.Context) ([]apitypes.ComposeCatalogEntry, error) {
+	projects, err := c.discover(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]apitypes.ComposeCatalogEntry, 0, len(projects))
+	for _, p := range projects {
+		p.load()
+		entries = append(entries, p.entry())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Locate returns where the compose files of a project live. Stored
+// projects are found without scanning the other sources, and the others
+// from the last scan of the roots while it is recent.
+func (c *ProjectCatalog) Locate(ctx context.Context, name string) (ProjectLocation, error) {
+	dir, err := c.store.ProjectDir(name)
+	if err != nil {
+		return ProjectLocation{}, err
+	}
+	if _, err := mainComposeFile(dir); err == nil {
+		return ProjectLocation{Dir: dir, Managed: true}, nil
+	}
+
+	projects, err := c.discover(ctx, catalogScanTTL)
+	if err != nil {
+		return ProjectLocation{}, err
+	}
+	p, ok := projects[name]
+	if !ok || p.dir == "" {
+		return ProjectLocation{}, ErrProjectNotFound
+	}
+	return ProjectLocation{Dir: p.dir, Files: p.files, Managed: p.managed}, nil
+}
+
+// discover collects the projects of all sources, keyed by name. The roots
+// are rescanned when the last scan is older than maxAge.
+func (c *ProjectCatalog) discover(ctx context.Context, maxAge time.Duration) (map[string]*catalogProject, error) {
+	projects := make(map[string]*catalogProject)
+	get := func(name string) *catalogProject {
+		p, ok := projects[name]
+		if !ok {
+			p = &catalogProject{name: name}
+			projects[name] = p
+		}
+		return p
+	}
+
+	names, err := c.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored projects: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		dir, _ := c.store.ProjectDir(name)
+		p := get(name)
+		p.dir, p.managed = absPath(dir), true
+		p.addSource(apitypes.ProjectSourceStore)
+		seen[p.dir] = true
+	}
+
+	for _, rp := range c.scanRoots(seen, maxAge) {
+		if rp.name == "" || projects[rp.name] != nil && projects[rp.name].dir != "" {
+			continue
+		}
+		p := get(rp.name)
+		p.dir, p.merged, p.loadErr = rp.dir, rp.merged, rp.loadErr
+		p.addSource(apitypes.ProjectSourceDirectory)
+	}
+
+	containers, err := c.composeContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cc := range containers {
+		labels := cc.Summary.Labels
+		p := get(labels["com.docker.compose.project"])
+		p.containers = append(p.containers, cc)
+		p.addSource(apitypes.ProjectSourceContainers)
+
+		if wd := labels["com.docker.compose.project.working_dir"]; wd != "" && p.labelDir == "" {
+			p.addSource(apitypes.ProjectSourceLabels)
+			p.labelDir = filepath.Clean(wd)
+			for _, f := range strings.Split(labels["com.docker.compose.project.config_files"], ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					p.labelFiles = append(p.labelFiles, f)
+				}
+			}
+		}
+	}
+
+	for _, p := range projects {
+		if p.dir == "" && p.labelDir != "" {
+			p.dir, p.files = p.labelDir, p.labelFiles
+		}
+	}
+	return projects, nil
+}
+
+// scanRoots returns the project directories below the roots in the order
+// the roots are configured, leaving out the directories in skip. The last
+// scan is reused while it is younger than maxAge.
+func (c *ProjectCatalog) scanRoots(skip map[string]bool, maxAge time.Duration) []rootProject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.scannedAt.IsZero() || time.Since(c.scannedAt) >= maxAge {
+		var scanned []rootProject
+		seen := make(map[string]bool)
+		for _, root := range c.roots {
+			for _, dir := range scanComposeDirs(root, catalogScanDepth) {
+				if seen[dir] || skip[dir] {
+					continue
+				}
+				seen[dir] = true
+
+				rp := rootProject{dir: dir}
+				rp.merged, rp.loadErr = MergeComposeProject(dir, ComposeLoadOptions{})
+				if rp.loadErr == nil {
+					rp.name = rp.merged.Config.Name
+				}
+				if rp.name == "" {
+					rp.name = NormalizeProjectName(filepath.Base(dir))
+				}
+				scanned = append(scanned, rp)
+			}
+		}
+		c.scanned, c.scannedAt = scanned, time.Now()
+	}
+
+	result := make([]rootProject, 0, len(c.scanned))
+	for _, rp := range c.scanned {
+		if !skip[rp.dir] {
+			result = append(result, rp)
+		}
+	}
+	return result
+}
+
+// composeContainers returns the containers carrying a compose project
+// label, from the state cache when it is ready
+func (c *ProjectCatalog) composeContainers(ctx context.Context) ([]CachedContainer, error) {
+	var containers []CachedContainer
+	if c.cache != nil && c.cache.Ready() {
+		for _, cc := range c.cache.Snapshot().Containers {
+			if cc.Summary.Labels["com.docker.compose.project"] != "" {
+				containers = append(containers, cc)
+			}
+		}
+		return containers, nil
+	}
+
+	f := filters.NewArgs()
+	f.Add("label", "com.docker.compose.project")
+	summaries, err := c.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list compose containers: %w", err)
+	}
+	for _, s := range summaries {
+		inspect, err := c.client.ContainerInspect(ctx, s.ID)
+		if err != nil {
+			continue
+		}
+		containers = append(containers, CachedContainer{Summary: s, Inspect: inspect})
+	}
+	return containers, nil
+}
+
+// entry renders the catalog entry of a project
+func (p *catalogProject) entry() apitypes.ComposeCatalogEntry {
+	e := apitypes.ComposeCatalogEntry{
+		Name:       p.name,
+		Path:       p.dir,
+		Sources:    p.sources,
+		Managed:    p.managed,
+		Services:   []string{},
+		Containers: make([]apitypes.ContainerResponse, 0, len(p.containers)),
+		Drift:      []apitypes.ComposeDrift{},
+	}
+	if p.loadErr != nil {
+		e.Error = p.loadErr.Error()
+	}
+
+	if p.merged != nil {
+		for _, f := range p.merged.Files {
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(p.dir, f)
+			}
+			e.ConfigFiles = append(e.ConfigFiles, f)
+		}
+		for name := range p.merged.Config.Services {
+			e.Services = append(e.Services, name)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, cc := range p.containers {
+			if svc := cc.Summary.Labels["com.docker.compose.service"]; svc != "" && !seen[svc] {
+				seen[svc] = true
+				e.Services = append(e.Services, svc)
+			}
+		}
+	}
+	sort.Strings(e.Services)
+
+	for _, cc := range p.containers {
+		created, _ := time.Parse(time.RFC3339Nano, cc.Inspect.Created)
+		state := ""
+		if cc.Inspect.State != nil {
+			state = cc.Inspect.State.Status
+		}
+		e.Containers = append(e.Containers, apitypes.ContainerResponse{
+			ID:      cc.Summary.ID,
+			Name:    strings.TrimPrefix(cc.Inspect.Name, "/"),
+			Image:   cc.Summary.Image,
+			Status:  StatusText(cc.Inspect),
+			State:   state,
+			Created: created,
+			Labels:  cc.Summary.Labels,
+		})
+	}
+	sort.Slice(e.Containers, func(i, j int) bool {
+		return e.Containers[i].Name < e.Containers[j].Name
+	})
+
+	e.Drift = append(e.Drift, p.drift(e.ConfigFiles)...)
+	e.Status = p.status(e.Drift)
+	return e
+}
+
+// serviceContainers groups the project's containers by service, leaving
+// out one-off containers
+func (p *catalogProject) serviceContainers() map[string][]CachedContainer {
+	byService := make(map[string][]CachedContainer)
+	for _, cc := range p.containers {
+		if strings.EqualFold(cc.Summary.Labels["com.docker.compose.oneoff"], "true") {
+			continue
+		}
+		svc := cc.Summary.Labels["com.docker.compose.service"]
+		byService[svc] = append(byService[svc], cc)
+	}
+	return byService
+}
+
+// drift compares the loaded compose files with the containers. Projects
+// without containers or without readable files have nothing to compare.
+func (p *catalogProject) drift(files []string) []apitypes.ComposeDrift {
+	if p.merged == nil || len(p.containers) == 0 {
+		return nil
+	}
+	var drift []apitypes.ComposeDrift
+	add := func(kind, service, format string, args ...interface{}) {
+		drift = append(drift, apitypes.ComposeDrift{Kind: kind, Service: service, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if p.labelDir != "" && p.labelDir != p.dir {
+		add(apitypes.DriftWorkingDir, "", "containers were created from %s", p.labelDir)
+	} else if len(p.labelFiles) > 0 && !sameFiles(p.labelFiles, files) {
+		add(apitypes.DriftFiles, "", "containers were created from %s", strings.Join(p.labelFiles, ", "))
+	}
+
+	byService := p.serviceContainers()
+	services := p.merged.Config.Services
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := services[name]
+		containers := byService[name]
+		if len(containers) == 0 {
+			// Services with profiles only run when one of them is active
+			if len(spec.Profiles) == 0 {
+				add(apitypes.DriftMissing, name, "service %s has no containers", name)
+			}
+			continue
+		}
+
+		desired := 1
+		if spec.Deploy != nil && spec.Deploy.Replicas > 0 {
+			desired = spec.Deploy.Replicas
+		}
+		if len(containers) != desired {
+			add(apitypes.DriftReplicas, name, "service %s has %d containers, the file declares %d", name, len(containers), desired)
+		}
+
+		if hash, err := ServiceConfigHash(spec); err == nil {
+			for _, cc := range containers {
+				if configChanged(cc.Summary, hash) {
+					add(apitypes.DriftConfig, name, "container %s was created from a different config", strings.TrimPrefix(cc.Inspect.Name, "/"))
+				}
+			}
+		}
+
+		if spec.Image != "" {
+			for _, cc := range containers {
+				if cc.Inspect.Config == nil || sameImage(cc.Inspect.Config.Image, spec.Image) {
+					continue
+				}
+				add(apitypes.DriftImage, name, "container %s runs %s, the file declares %s",
+					strings.TrimPrefix(cc.Inspect.Name, "/"), cc.Inspect.Config.Image, spec.Image)
+			}
+		}
+	}
+
+	orphans := make([]string, 0)
+	for name := range byService {
+		if _, ok := services[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		add(apitypes.DriftOrphaned, name, "service %s has %d containers but is not in the compose files", name, len(byService[name]))
+	}
+
+	if modified := newestModTime(files); !modified.IsZero() {
+		for _, cc := range p.containers {
+			if created, err := time.Parse(time.RFC3339Nano, cc.Inspect.Created); err == nil && created.Before(modified) {
+				add(apitypes.DriftModified, "", "compose files changed at %s, after containers were created", modified.UTC().Format(time.RFC3339))
+				break
+			}
+		}
+	}
+	return drift
+}
+
+// status summarizes the project state: not_created without containers,
+// running when every service runs as declared, stopped when nothing runs
+// and partial otherwise
+func (p *catalogProject) status(drift []apitypes.ComposeDrift) string {
+	if len(p.containers) == 0 {
+		return "not_created"
+	}
+	running := 0
+	for _, cc := range p.containers {
+		if cc.Inspect.State != nil && cc.Inspect.State.Running {
+			running++
+		}
+	}
+	switch {
+	case running == 0:
+		return "stopped"
+	case running < len(p.containers):
+		return "partial"
+	}
+	for _, d := range drift {
+		if d.Kind == apitypes.DriftMissing {
+			return "partial"
+		}
+	}
+	return "running"
+}
+
+// scanComposeDirs returns the directories below root, up to depth levels
+// deep, that contain a default compose file. Hidden directories are
+// skipped and project directories are not searched further.
+func scanComposeDirs(root string, depth int) []string {
+	root = absPath(root)
+	if _, err := mainComposeFile(root); err == nil {
+		return []string{root}
+	}
+	if depth == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to scan %s for compose projects: %v", root, err)
+		}
+		return nil
+	}
+	var dirs []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dirs = append(dirs, scanComposeDirs(filepath.Join(root, e.Name()), depth-1)...)
+	}
+	return dirs
+}
+
+// NormalizeProjectName derives a project name from a directory name the
+// way the compose CLI does: lowercased, with characters outside the
+// allowed set removed
+func NormalizeProjectName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	normalized := strings.TrimLeft(b.String(), "_-")
+	if ValidateProjectName(normalized) != nil {
+		return ""
+	}
+	return normalized
+}
+
+// sameImage compares image references, treating the implicit registry,
+// library namespace and latest tag as equal
+func sameImage(a, b string) bool {
+	normalize := func(ref string) string {
+		ref = strings.TrimPrefix(ref, "docker.io/")
+		ref = strings.TrimPrefix(ref, "library/")
+		if !strings.Contains(ref, "@") && !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+			ref += ":latest"
+		}
+		return ref
+	}
+	return normalize(a) == normalize(b)
+}
+
+// sameFiles reports whether two lists name the same files, in any order
+func sameFiles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, f := range a {
+		set[filepath.Clean(f)] = true
+	}
+	for _, f := range b {
+		if !set[filepath.Clean(f)] {
+			return false
+		}
+	}
+	return true
+}
+
+// newestModTime returns the latest modification time of the files
+func newestModTime(files []string) time.Time {
+	var newest time.Time
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
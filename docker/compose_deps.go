@@ -0,0 +1,253 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	// DefaultDependencyTimeout bounds how long a service waits for each of
+	// its dependencies to meet its condition
+	DefaultDependencyTimeout = 5 * time.Minute
+
+	// dependencyPollInterval is how often dependency containers are checked
+	dependencyPollInterval = time.Second
+)
+
+// serviceLevels groups services by dependency depth. Services in a level
+// only depend on services in earlier levels, so each level can be started
+// in parallel once the previous one is up.
+func serviceLevels(services map[string]apitypes.ServiceSpec) ([][]string, error) {
+	order, err := ServiceOrder(services)
+	if err != nil {
+		return nil, err
+	}
+
+	depth := make(map[string]int, len(order))
+	var levels [][]string
+	for _, name := range order {
+		level := 0
+		for dep := range services[name].DependsOn {
+			if d, ok := depth[dep]; ok && d+1 > level {
+				level = d + 1
+			}
+		}
+		depth[name] = level
+		if level == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], name)
+	}
+	for _, level := range levels {
+		sort.Strings(level)
+	}
+	return levels, nil
+}
+
+// applyInLevels executes plan steps level by level. Services of a level
+// run in parallel, each waiting for its dependencies first; the next level
+// starts once all of them are done. Steps of services that are no longer
+// in the config run last.
+func (p *ComposeProject) applyInLevels(ctx context.Context, steps []upStep, timeout time.Duration) error {
+	byService := make(map[string][]upStep)
+	for _, step := range steps {
+		byService[step.Service] = append(byService[step.Service], step)
+	}
+
+	levels, err := serviceLevels(p.Config.Services)
+	if err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		errs := make([]error, len(level))
+		var wg sync.WaitGroup
+		for i, service := range level {
+			if !needsAction(byService[service]) {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, service string) {
+				defer wg.Done()
+				if err := p.waitForDependencies(ctx, service, timeout); err != nil {
+					reportf(p.report, service, "", apitypes.StepFailed, "%v", err)
+					errs[i] = err
+					return
+				}
+				errs[i] = p.apply(ctx, byService[service])
+			}(i, service)
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+	}
+
+	var orphans []upStep
+	for _, step := range steps {
+		if _, ok := p.Config.Services[step.Service]; !ok {
+			orphans = append(orphans, step)
+		}
+	}
+	return p.apply(ctx, orphans)
+}
+
+// needsAction reports whether any step changes a container
+func needsAction(steps []upStep) bool {
+	for _, step := range steps {
+		if step.Action != apitypes.PlanUnchanged && step.Action != apitypes.PlanOrphan {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForDependencies blocks until the dependencies of a service meet
+// their conditions. Failures of dependencies that are not required are
+// logged and ignored.
+func (p *ComposeProject) waitForDependencies(ctx context.Context, service string, timeout time.Duration) error {
+	deps := p.Config.Services[service].DependsOn
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dep := deps[name]
+		err := fmt.Errorf("service %s is not defined", name)
+		if _, ok := p.Config.Services[name]; ok {
+			if dep.Condition != apitypes.ConditionServiceStarted {
+				reportf(p.report, service, "", apitypes.StepWaiting, "waiting for %s to be %s", name, strings.TrimPrefix(dep.Condition, "service_"))
+			}
+			err = p.waitForCondition(ctx, name, dep.Condition, timeout)
+		}
+		if err == nil {
+			if dep.Condition == apitypes.ConditionServiceHealthy {
+				reportf(p.report, name, "", apitypes.StepHealthy, "")
+			}
+			continue
+		}
+		if !dep.Required {
+			log.Printf("Warning: starting %s without optional dependency %s: %v", service, name, err)
+			continue
+		}
+		return fmt.Errorf("service %s: dependency %s: %w", service, name, err)
+	}
+	return nil
+}
+
+// waitForCondition polls the containers of a service until they meet a
+// depends_on condition, fail it, or the timeout expires
+func (p *ComposeProject) waitForCondition(ctx context.Context, service, condition string, timeout time.Duration) error {
+	if condition == "" || condition == apitypes.ConditionServiceStarted {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := p.conditionMet(ctx, service, condition)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for %s to be %s", timeout, service, strings.TrimPrefix(condition, "service_"))
+		case <-ticker.C:
+		}
+	}
+}
+
+// conditionMet checks every container of a service against a condition.
+// It returns an error once the condition can no longer be met.
+func (p *ComposeProject) conditionMet(ctx context.Context, service, condition string) (bool, error) {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+	f.Add("label", fmt.Sprintf("com.docker.compose.service=%s", service))
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	found := false
+	for _, c := range containers {
+		if strings.EqualFold(c.Labels["com.docker.compose.oneoff"], "true") {
+			continue
+		}
+		found = true
+
+		inspect, err := p.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to inspect container %s: %w", summaryName(c), err)
+		}
+		if ok, err := stateMeets(summaryName(c), inspect.State, condition); err != nil || !ok {
+			return false, err
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("service %s has no containers", service)
+	}
+	return true, nil
+}
+
+// stateMeets checks the state of one container against a condition
+func stateMeets(name string, state *types.ContainerState, condition string) (bool, error) {
+	if state == nil {
+		return false, nil
+	}
+
+	switch condition {
+	case apitypes.ConditionServiceStarted:
+		if state.Running {
+			return true, nil
+		}
+		if state.Status == "created" || state.Restarting {
+			return false, nil
+		}
+		return false, fmt.Errorf("container %s is %s", name, state.Status)
+	case apitypes.ConditionServiceHealthy:
+		if state.Health == nil {
+			return false, fmt.Errorf("container %s has no healthcheck", name)
+		}
+		if !state.Running && state.Status != "created" {
+			return false, fmt.Errorf("container %s is %s", name, state.Status)
+		}
+		switch state.Health.Status {
+		case "healthy":
+		case "unhealthy":
+			return false, fmt.Errorf("container %s is unhealthy", name)
+		default:
+			return false, nil
+		}
+	case apitypes.ConditionServiceCompletedSuccessfully:
+		if state.Running || state.Status == "created" || state.Restarting {
+			return false, nil
+		}
+		if state.ExitCode != 0 {
+			return false, fmt.Errorf("container %s exited with code %d", name, state.ExitCode)
+		}
+	}
+	return true, nil
+}
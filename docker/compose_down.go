@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// Values of DownOptions.RemoveImages
+const (
+	RemoveImagesAll   = "all"
+	RemoveImagesLocal = "local"
+)
+
+// Kinds of resources in a down report
+const (
+	resourceContainer = "container"
+	resourceNetwork   = "network"
+	resourceVolume    = "volume"
+	resourceImage     = "image"
+)
+
+// DownOptions controls what Down removes besides the containers and
+// networks of the project
+type DownOptions struct {
+	// Volumes removes the named volumes of the project and the anonymous
+	// volumes of its containers
+	Volumes bool
+
+	// RemoveImages removes the images of all services, or with "local"
+	// only those without a custom tag, i.e. services without image
+	RemoveImages string
+
+	// RemoveOrphans removes containers of services that are no longer in
+	// the config, which are otherwise kept
+	RemoveOrphans bool
+
+	// Timeout overrides the stop_grace_period of every service
+	Timeout *time.Duration
+}
+
+// Down stops and removes the containers of the project in reverse
+// dependency order, each with its service's stop_signal and
+// stop_grace_period, keeping those of inactive services. It then removes
+// the project networks that are no longer in use and, as requested,
+// volumes and images. Failures do not stop the teardown; the report lists
+// them and an error is returned.
+func (p *ComposeProject) Down(ctx context.Context, opts DownOptions) (*apitypes.ComposeDownReport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := &apitypes.ComposeDownReport{
+		Removed: []apitypes.ComposeResourceResult{},
+		Skipped: []apitypes.ComposeResourceResult{},
+		Failed:  []apitypes.ComposeResourceResult{},
+	}
+	add := func(list *[]apitypes.ComposeResourceResult, kind, name, service, format string, args ...interface{}) {
+		r := apitypes.ComposeResourceResult{Kind: kind, Name: name, Service: service}
+		if format != "" {
+			r.Message = fmt.Sprintf(format, args...)
+		}
+		*list = append(*list, r)
+	}
+
+	services, err := p.getServiceOrder()
+	if err != nil {
+		return nil, err
+	}
+	rank := make(map[string]int, len(services))
+	for i, service := range services {
+		rank[service] = len(services) - i
+	}
+
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project containers: %w", err)
+	}
+	sort.SliceStable(containers, func(i, j int) bool {
+		return rank[containers[i].Labels["com.docker.compose.service"]] < rank[containers[j].Labels["com.docker.compose.service"]]
+	})
+
+	for _, c := range containers {
+		service, name := c.Labels["com.docker.compose.service"], summaryName(c)
+		spec, known := p.Config.Services[service]
+		if reason := p.inactiveReason(service); reason != "" {
+			add(&report.Skipped, resourceContainer, name, service, "%s", reason)
+			continue
+		}
+		if !known && !opts.RemoveOrphans {
+			add(&report.Skipped, resourceContainer, name, service, "service %s is not in the config, use remove orphans to remove it", service)
+			continue
+		}
+
+		stop, err := stopOptions(spec, opts.Timeout)
+		if err == nil && c.State != "exited" && c.State != "created" && c.State != "dead" {
+			reportf(p.report, service, name, apitypes.StepStopping, "")
+			err = p.client.ContainerStop(ctx, c.ID, stop)
+		}
+		if err == nil {
+			reportf(p.report, service, name, apitypes.StepRemoving, "")
+			err = p.client.ContainerRemove(ctx, c.ID, container.RemoveOptions{RemoveVolumes: opts.Volumes, Force: true})
+		}
+		if err != nil {
+			reportf(p.report, service, name, apitypes.StepFailed, "%v", err)
+			add(&report.Failed, resourceContainer, name, service, "%v", err)
+			continue
+		}
+		reportf(p.report, service, name, apitypes.StepRemoved, "")
+		add(&report.Removed, resourceContainer, name, service, "")
+	}
+
+	networks, err := p.client.NetworkList(ctx, types.NetworkListOptions{Filters: f})
+	if err != nil {
+		add(&report.Failed, resourceNetwork, "", "", "failed to list networks: %v", err)
+	}
+	for _, n := range networks {
+		inspect, err := p.client.NetworkInspect(ctx, n.ID, types.NetworkInspectOptions{})
+		if err == nil && len(inspect.Containers) > 0 {
+			add(&report.Skipped, resourceNetwork, n.Name, "", "network is used by %d containers", len(inspect.Containers))
+			continue
+		}
+		if err == nil {
+			err = p.client.NetworkRemove(ctx, n.ID)
+		}
+		p.removed(report, add, resourceNetwork, n.Name, err)
+	}
+
+	if opts.Volumes {
+		for _, name := range p.projectVolumes(ctx, f, report, add) {
+			p.removed(report, add, resourceVolume, name, p.client.VolumeRemove(ctx, name, false))
+		}
+	}
+
+	if opts.RemoveImages != "" {
+		seen := make(map[string]bool)
+		for _, service := range services {
+			spec := p.Config.Services[service]
+			ref := p.serviceImage(service, spec)
+			if seen[ref] || opts.RemoveImages == RemoveImagesLocal && spec.Image != "" {
+				continue
+			}
+			seen[ref] = true
+			_, err := p.client.ImageRemove(ctx, ref, image.RemoveOptions{PruneChildren: true})
+			p.removed(report, add, resourceImage, ref, err)
+		}
+	}
+
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("failed to remove %d resources of project %s", len(report.Failed), p.Name)
+	}
+	return report, nil
+}
+
+// removed records the outcome of removing a network, volume or image.
+// Resources that are already gone are left out of the report.
+func (p *ComposeProject) removed(report *apitypes.ComposeDownReport, add func(*[]apitypes.ComposeResourceResult, string, string, string, string, ...interface{}), kind, name string, err error) {
+	switch {
+	case client.IsErrNotFound(err):
+	case err != nil:
+		reportf(p.report, "", "", apitypes.StepFailed, "%s %s: %v", kind, name, err)
+		add(&report.Failed, kind, name, "", "%v", err)
+	default:
+		reportf(p.report, "", "", apitypes.StepRemoved, "%s %s", kind, name)
+		add(&report.Removed, kind, name, "", "")
+	}
+}
+
+// projectVolumes returns the named volumes of the project: those declared
+// in the config that are not external, and those labelled with the project
+func (p *ComposeProject) projectVolumes(ctx context.Context, f filters.Args, report *apitypes.ComposeDownReport, add func(*[]apitypes.ComposeResourceResult, string, string, string, string, ...interface{})) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for name, spec := range p.Config.Volumes {
+		if !spec.External && !seen[p.volumeName(name)] {
+			seen[p.volumeName(name)] = true
+			names = append(names, p.volumeName(name))
+		}
+	}
+
+	volumes, err := p.client.VolumeList(ctx, volume.ListOptions{Filters: f})
+	if err != nil {
+		add(&report.Failed, resourceVolume, "", "", "failed to list volumes: %v", err)
+	}
+	for _, v := range volumes.Volumes {
+		if !seen[v.Name] {
+			seen[v.Name] = true
+			names = append(names, v.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stopOptions returns how to stop a container of a service: with its
+// stop_signal, and its stop_grace_period unless timeout overrides it
+func stopOptions(spec apitypes.ServiceSpec, timeout *time.Duration) (container.StopOptions, error) {
+	opts := container.StopOptions{Signal: spec.StopSignal}
+	grace := timeout
+	if grace == nil && spec.StopGracePeriod != "" {
+		d, err := time.ParseDuration(spec.StopGracePeriod)
+		if err != nil {
+			return opts, fmt.Errorf("invalid stop_grace_period %s: %w", spec.StopGracePeriod, err)
+		}
+		grace = &d
+	}
+	if grace != nil {
+		seconds := int(grace.Seconds())
+		opts.Timeout = &seconds
+	}
+	return opts, nil
+}
@@ -0,0 +1,647 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+)
+
+// defaultShmSize is the size of /dev/shm the engine gives containers
+const defaultShmSize = 64 << 20
+
+// exporter reverse-engineers inspected containers into the services of a
+// compose config
+type exporter struct {
+	client *client.Client
+
+	// project is set when exporting a project, whose networks and volumes
+	// then keep their keys instead of becoming external
+	project string
+
+	config   *apitypes.ComposeConfig
+	warnings []string
+
+	// services maps the IDs and names of exported containers to their
+	// service, to turn container: references into service: ones
+	services map[string]string
+
+	// images caches the config of the images of the containers
+	images map[string]*container.Config
+
+	logDriver string
+}
+
+// ExportContainers turns containers into a compose config: one service per
+// container, or per compose service for containers created by compose,
+// with the settings that differ from their image. Named volumes and
+// networks are declared external so that the project reuses them.
+func ExportContainers(ctx context.Context, cli *client.Client, ids []string) (*apitypes.ComposeExport, error) {
+	containers := make([]types.ContainerJSON, 0, len(ids))
+	for _, id := range ids {
+		inspect, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+		}
+		containers = append(containers, inspect)
+	}
+	return newExporter(cli, "").export(ctx, containers)
+}
+
+// ExportProject turns the containers of a compose project, including
+// projects whose files are gone, back into its compose config
+func ExportProject(ctx context.Context, cli *client.Client, project string) (*apitypes.ComposeExport, error) {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", project))
+	list, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project containers: %w", err)
+	}
+
+	var containers []types.ContainerJSON
+	for _, c := range list {
+		if strings.EqualFold(c.Labels[composeOneoffLabel], "true") {
+			continue
+		}
+		inspect, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect container %s: %w", summaryName(c), err)
+		}
+		containers = append(containers, inspect)
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("%w: no containers of project %s", ErrProjectNotFound, project)
+	}
+
+	e := newExporter(cli, project)
+	e.config.Name = project
+	return e.export(ctx, containers)
+}
+
+func newExporter(cli *client.Client, project string) *exporter {
+	return &exporter{
+		client:  cli,
+		project: project,
+		config: &apitypes.ComposeConfig{
+			Services: make(map[string]apitypes.ServiceSpec),
+		},
+		warnings: []string{},
+		services: make(map[string]string),
+		images:   make(map[string]*container.Config),
+	}
+}
+
+func (e *exporter) warnf(format string, args ...interface{}) {
+	e.warnings = append(e.warnings, fmt.Sprintf(format, args...))
+}
+
+// export groups the replicas of each compose service, names the services
+// and converts the first replica of each
+func (e *exporter) export(ctx context.Context, containers []types.ContainerJSON) (*apitypes.ComposeExport, error) {
+	if info, err := e.client.Info(ctx); err == nil {
+		e.logDriver = info.LoggingDriver
+	}
+
+	groups := make(map[string][]types.ContainerJSON)
+	var keys []string
+	for _, c := range containers {
+		key := "/" + strings.TrimPrefix(c.Name, "/")
+		if service := c.Config.Labels["com.docker.compose.service"]; service != "" {
+			key = c.Config.Labels["com.docker.compose.project"] + "/" + service
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], c)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(keys))
+	taken := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		replicas := groups[key]
+		sort.SliceStable(replicas, func(i, j int) bool {
+			a, _ := replicaIndex(replicas[i].Config.Labels)
+			b, _ := replicaIndex(replicas[j].Config.Labels)
+			return a < b
+		})
+
+		base := key[strings.Index(key, "/")+1:]
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken[name] = true
+		names[key] = name
+		for _, c := range replicas {
+			e.services[c.ID] = name
+			e.services[strings.TrimPrefix(c.Name, "/")] = name
+		}
+	}
+
+	for _, key := range keys {
+		replicas := groups[key]
+		spec := e.service(ctx, names[key], replicas[0])
+		if len(replicas) > 1 {
+			if spec.Deploy == nil {
+				spec.Deploy = &apitypes.DeploySpec{}
+			}
+			spec.Deploy.Replicas = len(replicas)
+		}
+		e.config.Services[names[key]] = spec
+	}
+
+	if e.project != "" {
+		e.dependsOn(groups, keys, names)
+	}
+
+	return &apitypes.ComposeExport{Config: e.config, Warnings: e.warnings}, nil
+}
+
+// imageConfig returns the config of the image of a container, or an empty
+// config when the image is gone
+func (e *exporter) imageConfig(ctx context.Context, service string, c types.ContainerJSON) *container.Config {
+	if config, ok := e.images[c.Image]; ok {
+		return config
+	}
+	config := &container.Config{}
+	inspect, _, err := e.client.ImageInspectWithRaw(ctx, c.Image)
+	if err != nil {
+		e.warnf("service %s: failed to inspect image %s, image defaults are kept: %v", service, c.Config.Image, err)
+	} else if inspect.Config != nil {
+		config = inspect.Config
+	}
+	e.images[c.Image] = config
+	return config
+}
+
+// service converts a container into a service, leaving out what its image
+// already sets and what compose sets by itself
+func (e *exporter) service(ctx context.Context, name string, c types.ContainerJSON) apitypes.ServiceSpec {
+	image := e.imageConfig(ctx, name, c)
+	config, host := c.Config, c.HostConfig
+
+	spec := apitypes.ServiceSpec{Image: config.Image}
+	if strings.HasPrefix(spec.Image, "sha256:") {
+		e.warnf("service %s: container was created from image ID %s, replace it with a tag", name, spec.Image)
+	}
+
+	if !slices.Equal(config.Entrypoint, image.Entrypoint) {
+		spec.Entrypoint = escapeAll(config.Entrypoint)
+		// A new entrypoint resets the command of the image
+		spec.Command = escapeAll(config.Cmd)
+	} else if !slices.Equal(config.Cmd, image.Cmd) {
+		spec.Command = escapeAll(config.Cmd)
+	}
+
+	spec.Environment = e.environment(name, config.Env, image.Env)
+	if config.User != image.User {
+		spec.User = config.User
+	}
+	if config.WorkingDir != image.WorkingDir {
+		spec.WorkingDir = config.WorkingDir
+	}
+	if config.StopSignal != image.StopSignal {
+		spec.StopSignal = config.StopSignal
+	}
+	if config.StopTimeout != nil {
+		spec.StopGracePeriod = fmt.Sprintf("%ds", *config.StopTimeout)
+	}
+	if config.Healthcheck != nil && !reflect.DeepEqual(config.Healthcheck, image.Healthcheck) {
+		spec.Healthcheck = exportHealthcheck(config.Healthcheck)
+	}
+
+	for key, value := range config.Labels {
+		if strings.HasPrefix(key, "com.docker.compose.") || image.Labels[key] == value {
+			continue
+		}
+		if spec.Labels == nil {
+			spec.Labels = make(apitypes.Labels)
+		}
+		spec.Labels[key] = escape(value)
+	}
+
+	spec.Ports = exportPorts(host)
+	spec.Volumes = e.volumes(c, image)
+	e.networks(ctx, &spec, c)
+
+	spec.Restart = exportRestart(host.RestartPolicy)
+	spec.Deploy = exportResources(host.Resources)
+	spec.Privileged = host.Privileged
+	spec.ReadOnly = host.ReadonlyRootfs
+	spec.CapAdd = host.CapAdd
+	spec.CapDrop = host.CapDrop
+	spec.SecurityOpt = host.SecurityOpt
+	spec.DNS = host.DNS
+	spec.DNSSearch = host.DNSSearch
+	spec.DNSOpt = host.DNSOptions
+	spec.ExtraHosts = host.ExtraHosts
+	if host.Init != nil && *host.Init {
+		spec.Init = host.Init
+	}
+	if len(host.Sysctls) > 0 {
+		spec.Sysctls = host.Sysctls
+	}
+	for _, device := range host.Devices {
+		spec.Devices = append(spec.Devices, exportDevice(device))
+	}
+	for path, opts := range host.Tmpfs {
+		entry := path
+		if opts != "" {
+			entry += ":" + opts
+		}
+		spec.Tmpfs = append(spec.Tmpfs, entry)
+	}
+	sort.Strings(spec.Tmpfs)
+	if host.ShmSize != 0 && host.ShmSize != defaultShmSize {
+		spec.ShmSize = formatBytes(host.ShmSize)
+	}
+	for _, limit := range host.Ulimits {
+		if spec.Ulimits == nil {
+			spec.Ulimits = make(map[string]apitypes.Ulimit)
+		}
+		spec.Ulimits[limit.Name] = apitypes.Ulimit{Soft: limit.Soft, Hard: limit.Hard}
+	}
+	if host.LogConfig.Type != "" && (host.LogConfig.Type != e.logDriver || len(host.LogConfig.Config) > 0) {
+		spec.Logging = &apitypes.LoggingSpec{Driver: host.LogConfig.Type, Options: host.LogConfig.Config}
+	}
+	if mode := string(host.PidMode); mode != "" {
+		spec.Pid = e.namespaceRef(ctx, mode)
+	}
+	if mode := string(host.IpcMode); mode != "" && mode != "private" && mode != "shareable" {
+		spec.Ipc = e.namespaceRef(ctx, mode)
+	}
+
+	if config.Hostname != "" && !strings.HasPrefix(c.ID, config.Hostname) {
+		e.warnf("service %s: hostname %s is not exported", name, config.Hostname)
+	}
+	if len(host.VolumesFrom) > 0 {
+		e.warnf("service %s: volumes_from %s is not exported", name, strings.Join(host.VolumesFrom, ", "))
+	}
+	if len(host.Links) > 0 {
+		e.warnf("service %s: links are not exported, services reach each other by name", name)
+	}
+	return spec
+}
+
+// environment returns the variables that are not set the same way by the
+// image. Sensitive values are replaced by a reference to a variable of the
+// same name, to be set in the project's .env file.
+func (e *exporter) environment(service string, env, imageEnv []string) apitypes.MappingWithEquals {
+	defaults := make(map[string]bool, len(imageEnv))
+	for _, entry := range imageEnv {
+		defaults[entry] = true
+	}
+
+	result := make(apitypes.MappingWithEquals)
+	for _, entry := range env {
+		if defaults[entry] {
+			continue
+		}
+		key, value, _ := strings.Cut(entry, "=")
+		if IsSensitiveKey(key) {
+			value = "${" + key + "}"
+			e.warnf("service %s: environment %s was replaced by ${%s}, set it in .env", service, key, key)
+		} else {
+			value = escape(value)
+		}
+		result[key] = &value
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// volumes converts the mounts of a container. Anonymous volumes the image
+// declares are left to the image; named volumes are declared at the top
+// level.
+func (e *exporter) volumes(c types.ContainerJSON, image *container.Config) []apitypes.ServiceVolume {
+	var volumes []apitypes.ServiceVolume
+	for _, m := range c.Mounts {
+		v := apitypes.ServiceVolume{Type: string(m.Type), Target: m.Destination, ReadOnly: !m.RW}
+		switch m.Type {
+		case mount.TypeBind:
+			v.Source = m.Source
+		case mount.TypeVolume:
+			if isAnonymousVolume(m.Name) {
+				if _, ok := image.Volumes[m.Destination]; ok {
+					continue
+				}
+				break
+			}
+			v.Source = e.resourceKey(m.Name, func(key string, external bool) {
+				if e.config.Volumes == nil {
+					e.config.Volumes = make(map[string]apitypes.VolumeSpec)
+				}
+				e.config.Volumes[key] = apitypes.VolumeSpec{External: external}
+			})
+		case mount.TypeTmpfs:
+		default:
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Target < volumes[j].Target })
+	return volumes
+}
+
+// networks sets the network_mode or the networks of a service. The default
+// bridge network is replaced by the default network of the project.
+func (e *exporter) networks(ctx context.Context, spec *apitypes.ServiceSpec, c types.ContainerJSON) {
+	mode := string(c.HostConfig.NetworkMode)
+	switch {
+	case mode == "host" || mode == "none":
+		spec.NetworkMode = mode
+		return
+	case strings.HasPrefix(mode, "container:"):
+		spec.NetworkMode = e.namespaceRef(ctx, mode)
+		return
+	}
+	if c.NetworkSettings == nil {
+		return
+	}
+
+	networks := make(apitypes.ServiceNetworks)
+	for name, endpoint := range c.NetworkSettings.Networks {
+		if name == "bridge" {
+			continue
+		}
+		key := e.resourceKey(name, func(key string, external bool) {
+			if key == defaultNetwork && !external {
+				return
+			}
+			if e.config.Networks == nil {
+				e.config.Networks = make(map[string]apitypes.NetworkSpec)
+			}
+			e.config.Networks[key] = apitypes.NetworkSpec{External: external}
+		})
+
+		settings := &apitypes.ServiceNetworkSpec{}
+		for _, alias := range endpoint.Aliases {
+			if alias != e.services[c.ID] && alias != c.Config.Labels["com.docker.compose.service"] &&
+				alias != strings.TrimPrefix(c.Name, "/") && !strings.HasPrefix(c.ID, alias) {
+				settings.Aliases = append(settings.Aliases, alias)
+			}
+		}
+		if endpoint.IPAMConfig != nil {
+			settings.Ipv4Address = endpoint.IPAMConfig.IPv4Address
+			settings.Ipv6Address = endpoint.IPAMConfig.IPv6Address
+		}
+		networks[key] = settings
+	}
+
+	if settings, ok := networks[defaultNetwork]; len(networks) == 1 && ok && reflect.DeepEqual(*settings, apitypes.ServiceNetworkSpec{}) {
+		return
+	}
+	if len(networks) > 0 {
+		spec.Networks = networks
+	}
+}
+
+// resourceKey returns the key of a named volume or network and declares
+// it. Resources of the exported project keep their key; any other is
+// external under its own name.
+func (e *exporter) resourceKey(name string, declare func(key string, external bool)) string {
+	if e.project != "" {
+		if key, ok := strings.CutPrefix(name, e.project+"_"); ok {
+			declare(key, false)
+			return key
+		}
+	}
+	declare(name, true)
+	return name
+}
+
+// namespaceRef turns a container:{id} network, pid or ipc mode into a
+// service: reference when the container is exported, or a container: one
+// by name otherwise
+func (e *exporter) namespaceRef(ctx context.Context, mode string) string {
+	ref, ok := strings.CutPrefix(mode, "container:")
+	if !ok {
+		return mode
+	}
+	if service, ok := e.services[ref]; ok {
+		return "service:" + service
+	}
+	if inspect, err := e.client.ContainerInspect(ctx, ref); err == nil {
+		if service, ok := e.services[inspect.ID]; ok {
+			return "service:" + service
+		}
+		return "container:" + strings.TrimPrefix(inspect.Name, "/")
+	}
+	return mode
+}
+
+// dependsOn restores depends_on from the label compose sets, keeping the
+// dependencies that were exported
+func (e *exporter) dependsOn(groups map[string][]types.ContainerJSON, keys []string, names map[string]string) {
+	exported := make(map[string]string, len(keys))
+	for _, key := range keys {
+		exported[groups[key][0].Config.Labels["com.docker.compose.service"]] = names[key]
+	}
+
+	for _, key := range keys {
+		label := groups[key][0].Config.Labels[composeDependsOnLabel]
+		if label == "" {
+			continue
+		}
+		deps := make(apitypes.DependsOn)
+		for _, entry := range strings.Split(label, ",") {
+			parts := strings.Split(entry, ":")
+			dep, ok := exported[parts[0]]
+			if !ok {
+				continue
+			}
+			spec := apitypes.DependencySpec{Condition: apitypes.ConditionServiceStarted, Required: true}
+			if len(parts) > 1 && parts[1] != "" {
+				spec.Condition = parts[1]
+			}
+			if len(parts) > 2 {
+				spec.Restart, _ = strconv.ParseBool(parts[2])
+			}
+			deps[dep] = spec
+		}
+		if len(deps) > 0 {
+			service := e.config.Services[names[key]]
+			service.DependsOn = deps
+			e.config.Services[names[key]] = service
+		}
+	}
+}
+
+func exportPorts(host *container.HostConfig) apitypes.PortList {
+	var ports apitypes.PortList
+	for port, bindings := range host.PortBindings {
+		target := port.Port()
+		if port.Proto() != "tcp" {
+			target += "/" + port.Proto()
+		}
+		for _, binding := range bindings {
+			switch {
+			case binding.HostPort == "":
+				ports = append(ports, target)
+			case binding.HostIP == "" || binding.HostIP == "0.0.0.0":
+				ports = append(ports, binding.HostPort+":"+target)
+			case strings.Contains(binding.HostIP, ":"):
+				ports = append(ports, "["+binding.HostIP+"]:"+binding.HostPort+":"+target)
+			default:
+				ports = append(ports, binding.HostIP+":"+binding.HostPort+":"+target)
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+func exportRestart(policy container.RestartPolicy) string {
+	switch policy.Name {
+	case container.RestartPolicyAlways, container.RestartPolicyUnlessStopped:
+		return string(policy.Name)
+	case container.RestartPolicyOnFailure:
+		if policy.MaximumRetryCount > 0 {
+			return fmt.Sprintf("%s:%d", apitypes.RestartOnFailure, policy.MaximumRetryCount)
+		}
+		return apitypes.RestartOnFailure
+	}
+	return ""
+}
+
+// exportResources is the inverse of applyResources. A CPU quota set
+// without NanoCPUs is converted as well.
+func exportResources(resources container.Resources) *apitypes.DeploySpec {
+	limits := &apitypes.ResourceSpec{}
+	switch {
+	case resources.NanoCPUs > 0:
+		limits.Cpus = formatCpus(float64(resources.NanoCPUs) / 1e9)
+	case resources.CPUQuota > 0:
+		period := resources.CPUPeriod
+		if period == 0 {
+			period = 100000
+		}
+		limits.Cpus = formatCpus(float64(resources.CPUQuota) / float64(period))
+	}
+	if resources.Memory > 0 {
+		limits.Memory = formatBytes(resources.Memory)
+	}
+	if resources.PidsLimit != nil && *resources.PidsLimit > 0 {
+		limits.Pids = *resources.PidsLimit
+	}
+
+	reservations := &apitypes.ResourceSpec{}
+	if resources.CPUShares > 0 {
+		reservations.Cpus = formatCpus(float64(resources.CPUShares) / 1024)
+	}
+	if resources.MemoryReservation > 0 {
+		reservations.Memory = formatBytes(resources.MemoryReservation)
+	}
+
+	spec := &apitypes.ResourcesSpec{}
+	if *limits != (apitypes.ResourceSpec{}) {
+		spec.Limits = limits
+	}
+	if *reservations != (apitypes.ResourceSpec{}) {
+		spec.Reservations = reservations
+	}
+	if spec.Limits == nil && spec.Reservations == nil {
+		return nil
+	}
+	return &apitypes.DeploySpec{Resources: spec}
+}
+
+func exportHealthcheck(hc *container.HealthConfig) *apitypes.HealthcheckSpec {
+	if len(hc.Test) > 0 && hc.Test[0] == "NONE" {
+		return &apitypes.HealthcheckSpec{Disable: true}
+	}
+	spec := &apitypes.HealthcheckSpec{Test: apitypes.HealthcheckTest(escapeAll(hc.Test))}
+	for _, d := range []struct {
+		value  int64
+		target *string
+	}{
+		{int64(hc.Interval), &spec.Interval},
+		{int64(hc.Timeout), &spec.Timeout},
+		{int64(hc.StartPeriod), &spec.StartPeriod},
+		{int64(hc.StartInterval), &spec.StartInterval},
+	} {
+		if d.value > 0 {
+			*d.target = fmt.Sprint(time.Duration(d.value))
+		}
+	}
+	if hc.Retries > 0 {
+		retries := hc.Retries
+		spec.Retries = &retries
+	}
+	return spec
+}
+
+// exportDevice is the inverse of parseDevice
+func exportDevice(device container.DeviceMapping) string {
+	entry := device.PathOnHost
+	if device.PathInContainer != "" && device.PathInContainer != device.PathOnHost {
+		entry += ":" + device.PathInContainer
+	}
+	if device.CgroupPermissions != "" && device.CgroupPermissions != "rwm" {
+		entry += ":" + device.CgroupPermissions
+	}
+	return entry
+}
+
+// isAnonymousVolume reports whether a volume name was generated by the
+// engine: 64 hexadecimal characters
+func isAnonymousVolume(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatBytes formats a size with the largest unit that divides it
+func formatBytes(n int64) apitypes.ByteSize {
+	for _, unit := range []struct {
+		size   int64
+		suffix string
+	}{{units.GiB, "g"}, {units.MiB, "m"}, {units.KiB, "k"}} {
+		if n%unit.size == 0 {
+			return apitypes.ByteSize(fmt.Sprintf("%d%s", n/unit.size, unit.suffix))
+		}
+	}
+	return apitypes.ByteSize(strconv.FormatInt(n, 10))
+}
+
+func formatCpus(cpus float64) string {
+	return strconv.FormatFloat(cpus, 'f', -1, 64)
+}
+
+// escape doubles the $ of a value so that interpolation keeps it literal
+func escape(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+func escapeAll(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = escape(value)
+	}
+	return escaped
+}
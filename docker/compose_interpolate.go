@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MaskedValue replaces secret values in configs returned by the API
+const MaskedValue = "********"
+
+// sensitiveKeyParts mark variable names whose values must not be exposed
+var sensitiveKeyParts = []string{
+	"PASSWORD", "PASSWD", "PASSPHRASE", "SECRET", "TOKEN", "CREDENTIAL",
+	"API_KEY", "APIKEY", "ACCESS_KEY", "PRIVATE_KEY",
+}
+
+// IsSensitiveKey reports whether a variable name looks like it holds a
+// secret, e.g. DB_PASSWORD or GITHUB_TOKEN
+func IsSensitiveKey(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(upper, part) {
+			return true
+		}
+	}
+	return strings.HasSuffix(upper, "_KEY") || strings.HasSuffix(upper, "_PASS")
+}
+
+// interpolateNode substitutes variables in every scalar value below node.
+// Mapping keys are left alone, as in compose. unset is called with the
+// variables referenced without a default that are not set.
+func interpolateNode(node *yaml.Node, lookup func(string) (string, bool), unset func(string)) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := interpolateNode(child, lookup, unset); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := interpolateNode(node.Content[i+1], lookup, unset); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "$") {
+			return nil
+		}
+		value, err := interpolate(node.Value, lookup, unset)
+		if err != nil {
+			return fmt.Errorf("line %d, column %d: %w", node.Line, node.Column, err)
+		}
+		if value != node.Value {
+			node.Value = value
+			// Let plain scalars resolve again so "${PORT}" can become an int
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+	return nil
+}
+
+// Interpolate substitutes $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error}, ${VAR?error}, ${VAR:+replacement} and ${VAR+replacement}.
+// $$ produces a literal $. Defaults may themselves contain variables.
+// Variables that are not set expand to a blank string.
+func Interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	return interpolate(s, lookup, nil)
+}
+
+func interpolate(s string, lookup func(string) (string, bool), unset func(string)) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		next := s[i+1]
+		switch {
+		case next == '$':
+			out.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s)
+			}
+			value, err := expandBraced(s[i+2:end], lookup, unset)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			i = end
+		case isNameStart(next):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			out.WriteString(lookupOrBlank(s[i+1:j], lookup, unset))
+			i = j - 1
+		default:
+			out.WriteByte('$')
+		}
+	}
+	return out.String(), nil
+}
+
+// matchingBrace returns the index of the } closing a ${ whose body starts
+// at start, accounting for nested references
+func matchingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func expandBraced(body string, lookup func(string) (string, bool), unset func(string)) (string, error) {
+	n := 0
+	for n < len(body) && isNameChar(body[n]) {
+		n++
+	}
+	name := body[:n]
+	if name == "" || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid variable name in ${%s}", body)
+	}
+	if n == len(body) {
+		return lookupOrBlank(name, lookup, unset), nil
+	}
+
+	rest := body[n:]
+	colon := strings.HasPrefix(rest, ":")
+	if colon {
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return "", fmt.Errorf("invalid variable reference ${%s}", body)
+	}
+	op, arg := rest[0], rest[1:]
+
+	value, set := lookup(name)
+	// With a colon an empty value counts as unset
+	present := set && (!colon || value != "")
+
+	switch op {
+	case '-':
+		if present {
+			return value, nil
+		}
+		return interpolate(arg, lookup, unset)
+	case '?':
+		if present {
+			return value, nil
+		}
+		msg, err := interpolate(arg, lookup, unset)
+		if err != nil {
+			return "", err
+		}
+		if msg == "" {
+			return "", fmt.Errorf("required variable %s is missing a value", name)
+		}
+		return "", fmt.Errorf("required variable %s is missing a value: %s", name, msg)
+	case '+':
+		if present {
+			return interpolate(arg, lookup, unset)
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid variable reference ${%s}", body)
+}
+
+func lookupOrBlank(name string, lookup func(string) (string, bool), unset func(string)) string {
+	value, ok := lookup(name)
+	if !ok && unset != nil {
+		unset(name)
+	}
+	return value
+}
+
+// warnedUnset holds the project directory and variable pairs already
+// warned about, since projects are loaded on every request and scan
+var warnedUnset sync.Map
+
+// warnUnsetOnce logs that a variable of the project in dir is not set, the
+// first time it is seen
+func warnUnsetOnce(dir, name string) {
+	if _, seen := warnedUnset.LoadOrStore(dir+"\x00"+name, true); !seen {
+		log.Printf("Warning: compose variable %s is not set in %s, defaulting to a blank string", name, dir)
+	}
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,729 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default compose file names, in order of preference
+var (
+	composeFileNames         = []string{"compose.yaml", "compose.yml", "docker-compose.yml", "docker-compose.yaml"}
+	composeOverrideFileNames = []string{"compose.override.yaml", "compose.override.yml", "docker-compose.override.yml", "docker-compose.override.yaml"}
+)
+
+// ComposeLoadOptions controls how a compose project is loaded
+type ComposeLoadOptions struct {
+	// Files lists the compose files, absolute or relative to the project
+	// directory, in merge order. When empty, COMPOSE_FILE or the default
+	// file and its override are used.
+	Files []string
+
+	// Environment overrides both the process environment and the project
+	// .env file during interpolation
+	Environment map[string]string
+
+	// MaskSecrets replaces sensitive values with MaskedValue, for configs
+	// that are returned to clients
+	MaskSecrets bool
+}
+
+// LoadComposeProject loads the compose files of the project in dir and
+// merges them into a single config
+func LoadComposeProject(dir string, opts ComposeLoadOptions) (*apitypes.ComposeConfig, error) {
+	merged, err := MergeComposeProject(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return merged.Config, nil
+}
+
+// MergeComposeProject loads and merges the compose files of the project in
+// dir, recording which file every value came from. Each file is
+// interpolated, its includes are added and its extends resolved before it
+// is merged over the previous files. Variables are resolved from the
+// overrides, the process environment and the project .env file, in that
+// order of precedence.
+func MergeComposeProject(dir string, opts ComposeLoadOptions) (*apitypes.MergedComposeConfig, error) {
+	l, files, err := newComposeLoader(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := l.loadModel(files, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	config, err := l.decode(root, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]string)
+	l.sources.collect(root, "", sources)
+
+	config.WorkingDir = absPath(dir)
+	for _, f := range files {
+		config.ConfigFiles = append(config.ConfigFiles, absPath(f))
+	}
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = l.displayName(f)
+	}
+	return &apitypes.MergedComposeConfig{Files: names, Config: config, Sources: sources}, nil
+}
+
+// newComposeLoader prepares a loader for the project in dir and returns the
+// files to load
+func newComposeLoader(dir string, opts ComposeLoadOptions) (*composeLoader, []string, error) {
+	dotEnv, err := parseEnvFile(filepath.Join(dir, ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read .env: %w", err)
+	}
+
+	l := &composeLoader{
+		projectDir: dir,
+		lookup:     composeLookup(dotEnv, opts),
+		sources:    make(composeSources),
+		docs:       make(map[string]*yaml.Node),
+		drafts:     make(map[string][]byte),
+	}
+
+	files, err := composeFiles(dir, opts, dotEnv)
+	if err != nil {
+		return l, nil, err
+	}
+	return l, files, nil
+}
+
+// decode turns a merged model into a normalized config
+func (l *composeLoader) decode(root *yaml.Node, opts ComposeLoadOptions) (*apitypes.ComposeConfig, error) {
+	dropMergeTags(root)
+
+	var config apitypes.ComposeConfig
+	if err := root.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse compose files: %w", err)
+	}
+	if err := normalizeComposeConfig(&config, l.projectDir, l.lookup); err != nil {
+		return nil, err
+	}
+	if opts.MaskSecrets {
+		maskComposeSecrets(&config)
+	}
+	return &config, nil
+}
+
+// composeFiles resolves the ordered list of compose files of a project
+func composeFiles(dir string, opts ComposeLoadOptions, dotEnv map[string]string) ([]string, error) {
+	if len(opts.Files) > 0 {
+		files := make([]string, len(opts.Files))
+		for i, name := range opts.Files {
+			files[i] = resolvePath(dir, name)
+		}
+		return files, nil
+	}
+
+	composeFile, ok := opts.Environment["COMPOSE_FILE"]
+	if !ok {
+		composeFile, ok = dotEnv["COMPOSE_FILE"]
+	}
+	if ok && composeFile != "" {
+		separator, ok := opts.Environment["COMPOSE_PATH_SEPARATOR"]
+		if !ok {
+			separator, ok = dotEnv["COMPOSE_PATH_SEPARATOR"]
+		}
+		if !ok || separator == "" {
+			separator = string(os.PathListSeparator)
+		}
+		var files []string
+		for _, name := range strings.Split(composeFile, separator) {
+			if name != "" {
+				files = append(files, resolvePath(dir, name))
+			}
+		}
+		return files, nil
+	}
+
+	var files []string
+	for _, candidates := range [][]string{composeFileNames, composeOverrideFileNames} {
+		for _, name := range candidates {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+				break
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, composeFileNames[0]), Err: os.ErrNotExist}
+	}
+	return files, nil
+}
+
+// composeLookup resolves variables from the overrides, the process
+// environment and the project .env file
+func composeLookup(dotEnv map[string]string, opts ComposeLoadOptions) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := opts.Environment[name]
+		if !ok {
+			value, ok = os.LookupEnv(name)
+		}
+		if !ok {
+			value, ok = dotEnv[name]
+		}
+		if ok && opts.MaskSecrets && value != "" && IsSensitiveKey(name) {
+			return MaskedValue, true
+		}
+		return value, ok
+	}
+}
+
+// composeLoader reads compose files into YAML trees, keeping track of the
+// file each node came from
+type composeLoader struct {
+	projectDir string
+	lookup     func(string) (string, bool)
+	sources    composeSources
+	docs       map[string]*yaml.Node
+
+	// drafts replace the content of files on disk, for validating edits
+	// before they are saved
+	drafts map[string][]byte
+}
+
+// loadModel merges files in order. Relative paths in them are resolved
+// against baseDir. stack holds the files being included, to detect cycles.
+func (l *composeLoader) loadModel(files []string, baseDir string, stack []string) (*yaml.Node, error) {
+	var model *yaml.Node
+	for _, file := range files {
+		doc, err := l.loadFile(file, baseDir, stack)
+		if err != nil {
+			return nil, err
+		}
+		if model == nil {
+			model = doc
+			continue
+		}
+		if model, err = l.sources.mergeComposeNodes(model, doc, nil); err != nil {
+			return nil, fmt.Errorf("failed to merge %s: %w", l.displayName(file), err)
+		}
+	}
+	if model == nil {
+		model = newMappingNode()
+	}
+	return model, nil
+}
+
+// loadFile reads one file with its includes added and extends resolved
+func (l *composeLoader) loadFile(file, baseDir string, stack []string) (*yaml.Node, error) {
+	for _, f := range stack {
+		if f == file {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, file), " -> "))
+		}
+	}
+	stack = append(stack, file)
+
+	doc, err := l.parse(file, baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if services := mappingValue(doc, "services"); services != nil && services.Kind == yaml.MappingNode {
+		resolved := *services
+		resolved.Content = append([]*yaml.Node{}, services.Content...)
+		for i := 0; i+1 < len(resolved.Content); i += 2 {
+			service, err := l.resolveService(file, baseDir, resolved.Content[i].Value, nil)
+			if err != nil {
+				return nil, err
+			}
+			resolved.Content[i+1] = service
+		}
+		doc = setMappingValue(doc, "services", &resolved)
+	}
+
+	include := mappingValue(doc, "include")
+	if include == nil {
+		return doc, nil
+	}
+	if include.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s: include must be a list", l.displayName(file))
+	}
+	doc = withoutKey(doc, "include")
+
+	var included *yaml.Node
+	for _, item := range include.Content {
+		files, projectDir, err := l.parseInclude(item, filepath.Dir(file))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.displayName(file), err)
+		}
+		model, err := l.loadModel(files, projectDir, stack)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkIncludeConflicts(model, doc); err != nil {
+			return nil, fmt.Errorf("%s: include %s: %w", l.displayName(file), l.displayName(files[0]), err)
+		}
+		if included == nil {
+			included = model
+		} else if err := checkIncludeConflicts(model, included); err != nil {
+			return nil, fmt.Errorf("%s: include %s: %w", l.displayName(file), l.displayName(files[0]), err)
+		} else if included, err = l.sources.mergeComposeNodes(included, model, nil); err != nil {
+			return nil, err
+		}
+	}
+	if included == nil {
+		return doc, nil
+	}
+	return l.sources.mergeComposeNodes(included, doc, nil)
+}
+
+// parseInclude returns the files and project directory of an include entry
+func (l *composeLoader) parseInclude(item *yaml.Node, dir string) ([]string, string, error) {
+	if item.Kind == yaml.ScalarNode {
+		path := resolvePath(dir, item.Value)
+		return []string{path}, filepath.Dir(path), nil
+	}
+
+	var entry struct {
+		Path             apitypes.StringList `yaml:"path"`
+		ProjectDirectory string              `yaml:"project_directory"`
+	}
+	if err := item.Decode(&entry); err != nil {
+		return nil, "", err
+	}
+	if len(entry.Path) == 0 {
+		return nil, "", fmt.Errorf("line %d: include path is required", item.Line)
+	}
+	files := make([]string, len(entry.Path))
+	for i, p := range entry.Path {
+		files[i] = resolvePath(dir, p)
+	}
+	projectDir := filepath.Dir(files[0])
+	if entry.ProjectDirectory != "" {
+		projectDir = resolvePath(dir, entry.ProjectDirectory)
+	}
+	return files, projectDir, nil
+}
+
+// checkIncludeConflicts fails when an included model defines a resource
+// that the including file also defines
+func checkIncludeConflicts(included, doc *yaml.Node) error {
+	for _, kind := range []string{"services", "networks", "volumes", "secrets", "configs"} {
+		theirs, ours := mappingValue(included, kind), mappingValue(doc, kind)
+		if theirs == nil || ours == nil {
+			continue
+		}
+		for i := 0; i+1 < len(theirs.Content); i += 2 {
+			if mappingIndex(ours, theirs.Content[i].Value) >= 0 {
+				return fmt.Errorf("%s %s is already defined", strings.TrimSuffix(kind, "s"), theirs.Content[i].Value)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveService returns a service of a file with its extends chain merged
+// in. stack holds the services being resolved, to detect cycles.
+func (l *composeLoader) resolveService(file, baseDir, name string, stack []string) (*yaml.Node, error) {
+	key := l.displayName(file) + ":" + name
+	for _, s := range stack {
+		if s == key {
+			return nil, fmt.Errorf("extends cycle: %s", strings.Join(append(stack, key), " -> "))
+		}
+	}
+	stack = append(stack, key)
+
+	doc, err := l.parse(file, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	service := mappingValue(mappingValue(doc, "services"), name)
+	if service == nil {
+		return nil, fmt.Errorf("service %s not found in %s", name, l.displayName(file))
+	}
+
+	extends := mappingValue(service, "extends")
+	if extends == nil {
+		return service, nil
+	}
+
+	baseFile, baseDirOfBase, baseName := file, baseDir, extends.Value
+	if extends.Kind == yaml.MappingNode {
+		var ref struct {
+			File    string `yaml:"file"`
+			Service string `yaml:"service"`
+		}
+		if err := extends.Decode(&ref); err != nil {
+			return nil, err
+		}
+		baseName = ref.Service
+		if ref.File != "" {
+			baseFile = resolvePath(filepath.Dir(file), ref.File)
+			baseDirOfBase = filepath.Dir(baseFile)
+		}
+	}
+	if baseName == "" {
+		return nil, fmt.Errorf("%s: service %s: extends requires a service", l.displayName(file), name)
+	}
+
+	base, err := l.resolveService(baseFile, baseDirOfBase, baseName, stack)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := l.sources.mergeComposeNodes(base, withoutKey(service, "extends"), []string{"services", name})
+	if err != nil {
+		return nil, err
+	}
+	if merged == nil {
+		merged = newMappingNode()
+	}
+	return merged, nil
+}
+
+// parse reads, interpolates and caches a file. Relative paths in it are
+// made absolute against baseDir.
+func (l *composeLoader) parse(file, baseDir string) (*yaml.Node, error) {
+	if doc, ok := l.docs[file]; ok {
+		return doc, nil
+	}
+
+	data, ok := l.drafts[file]
+	if !ok {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", l.displayName(file), err)
+	}
+	warn := func(name string) { warnUnsetOnce(l.projectDir, name) }
+	if err := interpolateNode(&root, l.lookup, warn); err != nil {
+		return nil, fmt.Errorf("failed to interpolate %s: %w", l.displayName(file), err)
+	}
+
+	doc := newMappingNode()
+	if len(root.Content) > 0 {
+		doc = expandAliases(root.Content[0])
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a mapping", l.displayName(file))
+	}
+	absolutizePaths(doc, baseDir)
+	l.sources.register(doc, l.displayName(file))
+
+	l.docs[file] = doc
+	return doc, nil
+}
+
+// displayName returns a file name relative to the project directory
+func (l *composeLoader) displayName(file string) string {
+	if rel, err := filepath.Rel(l.projectDir, file); err == nil {
+		return rel
+	}
+	return file
+}
+
+// absolutizePaths resolves the relative paths of a parsed file against dir,
+// so they stay correct when the file is included or extended from another
+// directory
+func absolutizePaths(doc *yaml.Node, dir string) {
+	services := mappingValue(doc, "services")
+	if services != nil && services.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			service := services.Content[i+1]
+
+			if build := mappingValue(service, "build"); build != nil {
+				if build.Kind == yaml.ScalarNode {
+					absolutizeScalar(build, dir)
+				} else {
+					absolutizeScalar(mappingValue(build, "context"), dir)
+				}
+			}
+
+			if envFile := mappingValue(service, "env_file"); envFile != nil {
+				if envFile.Kind == yaml.ScalarNode {
+					absolutizeScalar(envFile, dir)
+				}
+				for _, item := range envFile.Content {
+					if item.Kind == yaml.MappingNode {
+						absolutizeScalar(mappingValue(item, "path"), dir)
+					} else {
+						absolutizeScalar(item, dir)
+					}
+				}
+			}
+
+			if volumes := mappingValue(service, "volumes"); volumes != nil {
+				for _, item := range volumes.Content {
+					absolutizeVolume(item, dir)
+				}
+			}
+		}
+	}
+
+	for _, kind := range []string{"secrets", "configs"} {
+		objects := mappingValue(doc, kind)
+		if objects == nil {
+			continue
+		}
+		for i := 0; i+1 < len(objects.Content); i += 2 {
+			absolutizeScalar(mappingValue(objects.Content[i+1], "file"), dir)
+		}
+	}
+}
+
+func absolutizeScalar(node *yaml.Node, dir string) {
+	if node == nil || node.Kind != yaml.ScalarNode || node.Value == "" || isRemoteContext(node.Value) {
+		return
+	}
+	node.Value = resolvePath(dir, node.Value)
+}
+
+func absolutizeVolume(node *yaml.Node, dir string) {
+	if node.Kind == yaml.MappingNode {
+		if t := mappingValue(node, "type"); t != nil && t.Value == apitypes.VolumeTypeBind {
+			absolutizeScalar(mappingValue(node, "source"), dir)
+		}
+		return
+	}
+	if node.Kind != yaml.ScalarNode {
+		return
+	}
+	v, err := apitypes.ParseVolumeSpec(node.Value)
+	if err != nil || v.Type != apitypes.VolumeTypeBind || filepath.IsAbs(v.Source) {
+		return
+	}
+	source, rest, _ := strings.Cut(node.Value, ":")
+	node.Value = resolvePath(dir, source) + ":" + rest
+}
+
+func normalizeComposeConfig(config *apitypes.ComposeConfig, workingDir string, lookup func(string) (string, bool)) error {
+	for name, service := range config.Services {
+		env := make(apitypes.MappingWithEquals)
+		for _, file := range service.EnvFile {
+			values, err := parseEnvFile(resolvePath(workingDir, file))
+			if err != nil {
+				return fmt.Errorf("service %s: failed to read env_file: %w", name, err)
+			}
+			for k, v := range values {
+				v := v
+				env[k] = &v
+			}
+		}
+		// Explicit environment entries take precedence over env files
+		for k, v := range service.Environment.Resolve(lookup) {
+			v := v
+			env[k] = &v
+		}
+		service.Environment = env
+
+		if service.Build != nil && service.Build.Context != "" && !isRemoteContext(service.Build.Context) {
+			service.Build.Context = resolvePath(workingDir, service.Build.Context)
+		}
+
+		for i, v := range service.Volumes {
+			if v.Type == apitypes.VolumeTypeBind && v.Source != "" {
+				service.Volumes[i].Source = resolvePath(workingDir, v.Source)
+			}
+		}
+
+		config.Services[name] = service
+	}
+
+	for _, objects := range []map[string]apitypes.FileObjectSpec{config.Secrets, config.Configs} {
+		for name, object := range objects {
+			if object.File != "" {
+				object.File = resolvePath(workingDir, object.File)
+			}
+			if object.Environment != "" {
+				if value, ok := lookup(object.Environment); ok {
+					object.EnvironmentValue = &value
+				}
+			}
+			objects[name] = object
+		}
+	}
+	return nil
+}
+
+// maskComposeSecrets hides environment values and build args whose names
+// look sensitive, and the inline content of secrets
+func maskComposeSecrets(config *apitypes.ComposeConfig) {
+	masked := MaskedValue
+	for name, secret := range config.Secrets {
+		if secret.Content != "" {
+			secret.Content = MaskedValue
+			config.Secrets[name] = secret
+		}
+	}
+	for _, service := range config.Services {
+		for k, v := range service.Environment {
+			if v != nil && *v != "" && IsSensitiveKey(k) {
+				service.Environment[k] = &masked
+			}
+		}
+		if service.Build != nil {
+			for k, v := range service.Build.Args {
+				if v != nil && *v != "" && IsSensitiveKey(k) {
+					service.Build.Args[k] = &masked
+				}
+			}
+		}
+	}
+}
+
+// MaskComposeYAML returns compose file content with the same values hidden
+// as maskComposeSecrets, for files returned as they were saved
+func MaskComposeYAML(content []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return content, nil
+	}
+	root := doc.Content[0]
+
+	if secrets := mappingValue(root, "secrets"); secrets != nil && secrets.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(secrets.Content); i += 2 {
+			maskScalar(mappingValue(secrets.Content[i+1], "content"))
+		}
+	}
+	if services := mappingValue(root, "services"); services != nil && services.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			service := services.Content[i+1]
+			maskVariables(mappingValue(service, "environment"))
+			if build := mappingValue(service, "build"); build != nil {
+				maskVariables(mappingValue(build, "args"))
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// maskVariables masks the sensitive values of an environment or args
+// node, in map or KEY=VALUE list form
+func maskVariables(node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if IsSensitiveKey(node.Content[i].Value) {
+				maskScalar(node.Content[i+1])
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			key, value, ok := strings.Cut(item.Value, "=")
+			if item.Kind == yaml.ScalarNode && ok && value != "" && IsSensitiveKey(key) {
+				item.Value = key + "=" + MaskedValue
+				item.Style = 0
+			}
+		}
+	}
+}
+
+func maskScalar(node *yaml.Node) {
+	if node != nil && node.Kind == yaml.ScalarNode && node.Value != "" && node.Tag != "!!null" {
+		node.Value = MaskedValue
+		node.Tag = "!!str"
+		node.Style = 0
+	}
+}
+
+// resolvePath makes a path absolute relative to dir, expanding a leading ~
+func resolvePath(dir, path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	if abs, err := filepath.Abs(filepath.Join(dir, path)); err == nil {
+		return abs
+	}
+	return filepath.Join(dir, path)
+}
+
+func isRemoteContext(context string) bool {
+	return strings.Contains(context, "://") || strings.HasPrefix(context, "git@")
+}
+
+// parseEnvFile reads KEY=VALUE lines, skipping blanks and # comments. An
+// optional "export " prefix and surrounding quotes are stripped.
+func parseEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("%s:%d: missing variable name", path, lineNo)
+		}
+		if !ok {
+			// A bare name inherits from the host environment
+			if v, found := os.LookupEnv(key); found {
+				values[key] = v
+			}
+			continue
+		}
+		values[key] = unquoteEnvValue(strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func unquoteEnvValue(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			inner := value[1 : len(value)-1]
+			return strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(inner)
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		}
+	}
+	// Unquoted values may carry a trailing comment
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
@@ -0,0 +1,432 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML tags that control merging, as in the compose specification
+const (
+	resetTag    = "!reset"
+	overrideTag = "!override"
+)
+
+type mergeRule int
+
+const (
+	mergeDefault mergeRule = iota
+	mergeReplace
+	mergeKeyValue
+	mergeHosts
+	mergeNetworks
+	mergeDependsOn
+	mergeUniquePorts
+	mergeUniqueVolumes
+	mergeUniqueFileRefs
+	mergeUniqueScalars
+)
+
+// composeMergeRules map generalized paths to the merge behaviour that
+// differs from the default of merging mappings and appending sequences
+var composeMergeRules = map[string]mergeRule{
+	"services.*.command":          mergeReplace,
+	"services.*.entrypoint":       mergeReplace,
+	"services.*.healthcheck.test": mergeReplace,
+	"services.*.environment":      mergeKeyValue,
+	"services.*.labels":           mergeKeyValue,
+	"services.*.build.args":       mergeKeyValue,
+	"services.*.build.labels":     mergeKeyValue,
+	"services.*.deploy.labels":    mergeKeyValue,
+	"services.*.sysctls":          mergeKeyValue,
+	"services.*.extra_hosts":      mergeHosts,
+	"services.*.networks":         mergeNetworks,
+	"services.*.depends_on":       mergeDependsOn,
+	"services.*.ports":            mergeUniquePorts,
+	"services.*.volumes":          mergeUniqueVolumes,
+	"services.*.secrets":          mergeUniqueFileRefs,
+	"services.*.configs":          mergeUniqueFileRefs,
+	"services.*.cap_add":          mergeUniqueScalars,
+	"services.*.cap_drop":         mergeUniqueScalars,
+	"services.*.dns":              mergeUniqueScalars,
+	"services.*.dns_search":       mergeUniqueScalars,
+	"services.*.expose":           mergeUniqueScalars,
+	"services.*.profiles":         mergeUniqueScalars,
+	"services.*.env_file":         mergeUniqueScalars,
+	"services.*.security_opt":     mergeUniqueScalars,
+	"services.*.build.cache_from": mergeUniqueScalars,
+	"networks.*.labels":           mergeKeyValue,
+	"volumes.*.labels":            mergeKeyValue,
+}
+
+// composeSources records the file every YAML node was read from
+type composeSources map[*yaml.Node]string
+
+// register marks node and everything below it as read from file, keeping
+// earlier registrations of shared (aliased) nodes
+func (s composeSources) register(node *yaml.Node, file string) {
+	if node == nil {
+		return
+	}
+	if _, ok := s[node]; ok {
+		return
+	}
+	s[node] = file
+	for _, child := range node.Content {
+		s.register(child, file)
+	}
+}
+
+// collect maps the path of every leaf below node to its file
+func (s composeSources) collect(node *yaml.Node, path string, out map[string]string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			s.collect(node.Content[i+1], key, out)
+		}
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			out[path] = s[node]
+		}
+		for i, child := range node.Content {
+			s.collect(child, fmt.Sprintf("%s[%d]", path, i), out)
+		}
+	default:
+		out[path] = s[node]
+	}
+}
+
+// mergeComposeNodes merges override into base with compose semantics:
+// mappings merge, sequences append or merge by identity depending on the
+// field, and scalars are replaced. A nil result means the value was reset.
+// Neither input is modified.
+func (s composeSources) mergeComposeNodes(base, override *yaml.Node, path []string) (*yaml.Node, error) {
+	switch {
+	case override.Tag == resetTag:
+		return nil, nil
+	case override.Tag == overrideTag, base == nil:
+		return override, nil
+	}
+
+	rule := composeMergeRules[rulePath(path)]
+	switch rule {
+	case mergeReplace:
+		return override, nil
+	case mergeKeyValue, mergeHosts, mergeNetworks, mergeDependsOn:
+		if rule == mergeDependsOn && base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode {
+			return s.mergeUnique(base, override, scalarKey), nil
+		}
+		b, err := s.toMapping(base, rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		o, err := s.toMapping(override, rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		return s.mergeMappings(b, o, path)
+	case mergeUniquePorts, mergeUniqueVolumes, mergeUniqueFileRefs, mergeUniqueScalars:
+		if base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode {
+			return s.mergeUnique(base, override, identityKeys[rule]), nil
+		}
+	}
+
+	switch {
+	case base.Kind == yaml.MappingNode && override.Kind == yaml.MappingNode:
+		return s.mergeMappings(base, override, path)
+	case base.Kind == yaml.SequenceNode && override.Kind == yaml.SequenceNode:
+		merged := *base
+		merged.Content = append(append([]*yaml.Node{}, base.Content...), override.Content...)
+		return &merged, nil
+	}
+	return override, nil
+}
+
+func (s composeSources) mergeMappings(base, override *yaml.Node, path []string) (*yaml.Node, error) {
+	merged := *base
+	merged.Content = append([]*yaml.Node{}, base.Content...)
+
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		idx := mappingIndex(&merged, key.Value)
+		if idx < 0 {
+			if value.Tag != resetTag {
+				merged.Content = append(merged.Content, key, value)
+			}
+			continue
+		}
+
+		result, err := s.mergeComposeNodes(merged.Content[idx+1], value, append(append([]string{}, path...), key.Value))
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			merged.Content = append(merged.Content[:idx], merged.Content[idx+2:]...)
+			continue
+		}
+		merged.Content[idx+1] = result
+	}
+	return &merged, nil
+}
+
+// identityKeys identify sequence entries that override each other
+var identityKeys = map[mergeRule]func(*yaml.Node) string{
+	mergeUniquePorts:    portKey,
+	mergeUniqueVolumes:  volumeKey,
+	mergeUniqueFileRefs: fileRefKey,
+	mergeUniqueScalars:  scalarKey,
+}
+
+func (s composeSources) mergeUnique(base, override *yaml.Node, keyOf func(*yaml.Node) string) *yaml.Node {
+	merged := *base
+	merged.Content = append([]*yaml.Node{}, base.Content...)
+
+	for _, item := range override.Content {
+		key := keyOf(item)
+		replaced := false
+		for i, existing := range merged.Content {
+			if keyOf(existing) == key {
+				merged.Content[i] = item
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged.Content = append(merged.Content, item)
+		}
+	}
+	return &merged
+}
+
+// toMapping converts the list forms of key/value fields to a mapping so
+// entries can be merged by key. New nodes inherit the source of the entry
+// they were split from.
+func (s composeSources) toMapping(node *yaml.Node, rule mergeRule) (*yaml.Node, error) {
+	if node.Kind == yaml.MappingNode {
+		return node, nil
+	}
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		return newMappingNode(), nil
+	}
+	if node.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: expected a mapping or a list", node.Line)
+	}
+
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+	s[mapping] = s[node]
+	for _, item := range node.Content {
+		var key string
+		var value *yaml.Node
+		switch rule {
+		case mergeNetworks, mergeDependsOn:
+			key = item.Value
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		case mergeHosts:
+			host, ip, ok := strings.Cut(item.Value, "=")
+			if !ok {
+				host, ip, _ = strings.Cut(item.Value, ":")
+			}
+			key = host
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ip}
+		default:
+			k, v, ok := strings.Cut(item.Value, "=")
+			key = k
+			if ok {
+				value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+			} else {
+				value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+			}
+		}
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key, Line: item.Line, Column: item.Column}
+		value.Line, value.Column = item.Line, item.Column
+		s[keyNode], s[value] = s[item], s[item]
+
+		if idx := mappingIndex(mapping, key); idx >= 0 {
+			mapping.Content[idx+1] = value
+			continue
+		}
+		mapping.Content = append(mapping.Content, keyNode, value)
+	}
+	return mapping, nil
+}
+
+// rulePath generalizes a path for rule lookup, replacing the name of the
+// service or top-level resource with *
+func rulePath(path []string) string {
+	if len(path) < 2 {
+		return strings.Join(path, ".")
+	}
+	generalized := append([]string{path[0], "*"}, path[2:]...)
+	return strings.Join(generalized, ".")
+}
+
+func scalarKey(node *yaml.Node) string {
+	return node.Value
+}
+
+func portKey(node *yaml.Node) string {
+	if node.Kind != yaml.MappingNode {
+		return node.Value
+	}
+	var parts []string
+	for _, field := range []string{"host_ip", "published", "target", "protocol"} {
+		if v := mappingValue(node, field); v != nil {
+			parts = append(parts, v.Value)
+		} else {
+			parts = append(parts, "")
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+func volumeKey(node *yaml.Node) string {
+	if node.Kind == yaml.MappingNode {
+		if target := mappingValue(node, "target"); target != nil {
+			return target.Value
+		}
+		return ""
+	}
+	if v, err := apitypes.ParseVolumeSpec(node.Value); err == nil {
+		return v.Target
+	}
+	return node.Value
+}
+
+func fileRefKey(node *yaml.Node) string {
+	if node.Kind != yaml.MappingNode {
+		return node.Value
+	}
+	if target := mappingValue(node, "target"); target != nil && target.Value != "" {
+		return target.Value
+	}
+	if source := mappingValue(node, "source"); source != nil {
+		return source.Value
+	}
+	return ""
+}
+
+// expandAliases returns node with aliases replaced by their anchors and
+// << merge keys inlined, so files can be merged key by key
+func expandAliases(node *yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if node.Kind == yaml.AliasNode {
+		return expandAliases(node.Alias)
+	}
+	if node.Kind != yaml.MappingNode && node.Kind != yaml.SequenceNode && node.Kind != yaml.DocumentNode {
+		return node
+	}
+
+	expanded := *node
+	expanded.Content = make([]*yaml.Node, 0, len(node.Content))
+	if node.Kind != yaml.MappingNode {
+		for _, child := range node.Content {
+			expanded.Content = append(expanded.Content, expandAliases(child))
+		}
+		return &expanded
+	}
+
+	var inherited []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], expandAliases(node.Content[i+1])
+		if key.Tag == "!!merge" || (key.Value == "<<" && key.Style == 0) {
+			if value.Kind == yaml.SequenceNode {
+				inherited = append(inherited, value.Content...)
+			} else {
+				inherited = append(inherited, value)
+			}
+			continue
+		}
+		expanded.Content = append(expanded.Content, key, value)
+	}
+	// Explicit keys win over merged ones, earlier merge sources over later
+	for _, source := range inherited {
+		for i := 0; i+1 < len(source.Content); i += 2 {
+			if mappingIndex(&expanded, source.Content[i].Value) < 0 {
+				expanded.Content = append(expanded.Content, source.Content[i], source.Content[i+1])
+			}
+		}
+	}
+	return &expanded
+}
+
+// dropMergeTags removes entries reset with !reset and clears the merge
+// tags so the tree decodes normally
+func dropMergeTags(node *yaml.Node) {
+	if node.Tag == resetTag || node.Tag == overrideTag {
+		node.Tag = ""
+	}
+	if node.Kind == yaml.MappingNode {
+		content := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Tag == resetTag {
+				continue
+			}
+			content = append(content, node.Content[i], node.Content[i+1])
+		}
+		node.Content = content
+	}
+	for _, child := range node.Content {
+		dropMergeTags(child)
+	}
+}
+
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	if idx := mappingIndex(node, key); idx >= 0 {
+		return node.Content[idx+1]
+	}
+	return nil
+}
+
+// withoutKey returns a copy of a mapping without key
+func withoutKey(node *yaml.Node, key string) *yaml.Node {
+	copied := *node
+	copied.Content = make([]*yaml.Node, 0, len(node.Content))
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != key {
+			copied.Content = append(copied.Content, node.Content[i], node.Content[i+1])
+		}
+	}
+	return &copied
+}
+
+// setMappingValue returns a copy of a mapping with key set to value
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Content = append([]*yaml.Node{}, node.Content...)
+	if idx := mappingIndex(&copied, key); idx >= 0 {
+		copied.Content[idx+1] = value
+		return &copied
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	copied.Content = append(copied.Content, keyNode, value)
+	return &copied
+}
+
+func newMappingNode() *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+func newScalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
@@ -0,0 +1,289 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// operationTimeout bounds how long a compose operation may run
+	operationTimeout = 30 * time.Minute
+
+	// operationHistorySize bounds the finished operations kept in memory
+	operationHistorySize = 100
+
+	// operationProgressLimit bounds the progress steps kept per operation
+	operationProgressLimit = 1000
+
+	// operationSubscriberBuffer is how many steps may queue for a slow
+	// subscriber before further steps are dropped for it
+	operationSubscriberBuffer = 64
+)
+
+var (
+	ErrOperationNotFound   = errors.New("operation not found")
+	ErrOperationInProgress = errors.New("another operation is running for this project")
+)
+
+// OperationFunc performs a compose operation, reporting its steps. The
+// returned value becomes the operation result.
+type OperationFunc func(ctx context.Context, report func(apitypes.ComposeProgress)) (interface{}, error)
+
+// OperationManager runs compose operations in the background, one at a
+// time per project. Progress is kept for polling and fanned out to
+// subscribers; finished operations are kept for a while.
+type OperationManager struct {
+	mu  sync.Mutex
+	ops map[string]*operation
+}
+
+type operation struct {
+	mu          sync.Mutex
+	state       apitypes.ComposeOperation
+	cancel      context.CancelFunc
+	done        chan struct{}
+	subscribers map[chan apitypes.ComposeProgress]struct{}
+}
+
+// NewOperationManager creates an empty manager
+func NewOperationManager() *OperationManager {
+	return &OperationManager{ops: make(map[string]*operation)}
+}
+
+// Start runs fn in the background and returns the operation as started.
+// It fails with ErrOperationInProgress while the project has another
+// operation running.
+func (m *OperationManager) Start(project, opType, service string, fn OperationFunc) (apitypes.ComposeOperation, error) {
+	m.mu.Lock()
+	for _, op := range m.ops {
+		if op.snapshot().Project == project && op.running() {
+			m.mu.Unlock()
+			return apitypes.ComposeOperation{}, ErrOperationInProgress
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	op := &operation{
+		state: apitypes.ComposeOperation{
+			ID:        uuid.New().String(),
+			Type:      opType,
+			Project:   project,
+			Service:   service,
+			Status:    apitypes.OperationRunning,
+			StartTime: time.Now().UTC(),
+			Services:  make(map[string]string),
+			Progress:  []apitypes.ComposeProgress{},
+		},
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan apitypes.ComposeProgress]struct{}),
+	}
+	m.ops[op.state.ID] = op
+	m.pruneLocked()
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result, err := fn(ctx, op.report)
+		op.finish(result, err, ctx.Err())
+	}()
+
+	return op.snapshot(), nil
+}
+
+// Get returns an operation by ID
+func (m *OperationManager) Get(id string) (apitypes.ComposeOperation, error) {
+	op, err := m.find(id)
+	if err != nil {
+		return apitypes.ComposeOperation{}, err
+	}
+	return op.snapshot(), nil
+}
+
+// List returns the operations of a project, or of all projects when
+// project is empty, newest first
+func (m *OperationManager) List(project string) []apitypes.ComposeOperation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]apitypes.ComposeOperation, 0, len(m.ops))
+	for _, op := range m.ops {
+		if s := op.snapshot(); project == "" || s.Project == project {
+			result = append(result, s)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime.After(result[j].StartTime)
+	})
+	return result
+}
+
+// Cancel stops a running operation and waits briefly for it to wind down.
+// Steps already taken are not undone.
+func (m *OperationManager) Cancel(id string) (apitypes.ComposeOperation, error) {
+	op, err := m.find(id)
+	if err != nil {
+		return apitypes.ComposeOperation{}, err
+	}
+	op.cancel()
+	select {
+	case <-op.done:
+	case <-time.After(10 * time.Second):
+	}
+	return op.snapshot(), nil
+}
+
+// Subscribe returns the steps reported so far and a channel of further
+// steps. The channel is closed when the operation finishes; the returned
+// function unsubscribes early.
+func (m *OperationManager) Subscribe(id string) ([]apitypes.ComposeProgress, <-chan apitypes.ComposeProgress, func(), error) {
+	op, err := m.find(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	past := make([]apitypes.ComposeProgress, len(op.state.Progress))
+	copy(past, op.state.Progress)
+
+	ch := make(chan apitypes.ComposeProgress, operationSubscriberBuffer)
+	if op.state.Status != apitypes.OperationRunning {
+		close(ch)
+		return past, ch, func() {}, nil
+	}
+	op.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		if _, ok := op.subscribers[ch]; ok {
+			delete(op.subscribers, ch)
+			close(ch)
+		}
+	}
+	return past, ch, unsubscribe, nil
+}
+
+func (m *OperationManager) find(id string) (*operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.ops[id]
+	if !ok {
+		return nil, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+// pruneLocked drops the oldest finished operations beyond the history size
+func (m *OperationManager) pruneLocked() {
+	var finished []apitypes.ComposeOperation
+	for _, op := range m.ops {
+		if !op.running() {
+			finished = append(finished, op.snapshot())
+		}
+	}
+	if len(finished) <= operationHistorySize {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartTime.Before(finished[j].StartTime)
+	})
+	for _, s := range finished[:len(finished)-operationHistorySize] {
+		delete(m.ops, s.ID)
+	}
+}
+
+// report records a step and passes it to subscribers without blocking
+func (op *operation) report(p apitypes.ComposeProgress) {
+	if p.Time.IsZero() {
+		p.Time = time.Now().UTC()
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if p.Service != "" {
+		op.state.Services[p.Service] = p.Step
+	}
+	op.state.Progress = append(op.state.Progress, p)
+	if len(op.state.Progress) > operationProgressLimit {
+		op.state.Progress = op.state.Progress[len(op.state.Progress)-operationProgressLimit:]
+	}
+	for ch := range op.subscribers {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+func (op *operation) finish(result interface{}, err, ctxErr error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.state.EndTime = time.Now().UTC()
+	op.state.Result = result
+	switch {
+	case errors.Is(ctxErr, context.Canceled):
+		op.state.Status = apitypes.OperationCancelled
+		op.state.Error = "operation cancelled"
+	case err != nil:
+		op.state.Status = apitypes.OperationFailed
+		op.state.Error = err.Error()
+	default:
+		op.state.Status = apitypes.OperationSucceeded
+	}
+	if err != nil {
+		log.Printf("Warning: compose %s of %s %s: %v", op.state.Type, op.state.Project, op.state.Status, err)
+	}
+
+	for ch := range op.subscribers {
+		close(ch)
+	}
+	op.subscribers = nil
+	close(op.done)
+}
+
+func (op *operation) running() bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.state.Status == apitypes.OperationRunning
+}
+
+// snapshot returns a copy of the operation state that is safe to encode
+func (op *operation) snapshot() apitypes.ComposeOperation {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	s := op.state
+	s.Services = make(map[string]string, len(op.state.Services))
+	for k, v := range op.state.Services {
+		s.Services[k] = v
+	}
+	s.Progress = make([]apitypes.ComposeProgress, len(op.state.Progress))
+	copy(s.Progress, op.state.Progress)
+	return s
+}
+
+// reportf builds and sends a progress step when report is set
+func reportf(report func(apitypes.ComposeProgress), service, container, step, format string, args ...interface{}) {
+	if report == nil {
+		return
+	}
+	p := apitypes.ComposeProgress{Service: service, Container: container, Step: step}
+	if format != "" {
+		p.Message = fmt.Sprintf(format, args...)
+	}
+	report(p)
+}
@@ -0,0 +1,361 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// configHashLabel records the service config a container was created
+// from. The hash is Kibutsu's own, so it is kept apart from the compose
+// CLI's com.docker.compose.config-hash, which it could never match.
+const configHashLabel = "kibutsu.config-hash"
+
+// UpOptions controls how Up converges a project
+type UpOptions struct {
+	// RemoveOrphans removes containers of services that are no longer in
+	// the config
+	RemoveOrphans bool
+
+	// DryRun returns the plan without executing it
+	DryRun bool
+
+	// WaitTimeout bounds the wait for each depends_on condition, defaulting
+	// to DefaultDependencyTimeout
+	WaitTimeout time.Duration
+}
+
+// upStep is a plan action with the replica index it applies to
+type upStep struct {
+	apitypes.ComposePlanAction
+	index int
+}
+
+// ServiceConfigHash returns the hash of a service config that is stored on
+// its containers. The replica count and update settings are left out so
+// that changing them does not recreate containers.
+func ServiceConfigHash(spec apitypes.ServiceSpec) (string, error) {
+	if spec.Deploy != nil {
+		deploy := *spec.Deploy
+		deploy.Replicas = 0
+		deploy.UpdateConfig = nil
+		spec.Deploy = &deploy
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash service config: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// configChanged reports whether a container was created from another
+// config than the one hashed. Containers created elsewhere, e.g. by the
+// compose CLI, have no hash to compare and are taken as up to date.
+func configChanged(c types.Container, hash string) bool {
+	h := c.Labels[configHashLabel]
+	return h != "" && h != hash
+}
+
+// plan compares the containers of the project with its config. Each
+// replica is created when missing, recreated when its config hash or
+// image differs (see configChanged), started when stopped and otherwise left alone. Replicas
+// beyond the desired count are removed, as are orphans when requested.
+// Services that depend with restart: true on a recreated service are
+// restarted.
+func (p *ComposeProject) plan(ctx context.Context, opts UpOptions) (*apitypes.ComposePlan, []upStep, error) {
+	services, err := p.getServiceOrder()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	networks, err := p.missingNetworks(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containers, err := p.projectContainers(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	byService := make(map[string][]types.Container)
+	for _, c := range containers {
+		service := c.Labels["com.docker.compose.service"]
+		byService[service] = append(byService[service], c)
+	}
+
+	var steps []upStep
+	add := func(action, service string, index int, c *types.Container, format string, args ...interface{}) {
+		step := upStep{index: index}
+		step.Action = action
+		step.Service = service
+		step.Container = p.containerName(service, index)
+		if c != nil {
+			step.Container = summaryName(*c)
+			step.ContainerID = c.ID
+		}
+		if format != "" {
+			step.Reason = fmt.Sprintf(format, args...)
+		}
+		steps = append(steps, step)
+	}
+
+	recreated := make(map[string]bool)
+	for _, service := range services {
+		first := len(steps)
+		spec := p.Config.Services[service]
+		hash, err := ServiceConfigHash(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		replicas := 1
+		if spec.Deploy != nil && spec.Deploy.Replicas > 0 {
+			replicas = spec.Deploy.Replicas
+		}
+		imageID, err := p.imageID(ctx, p.serviceImage(service, spec))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		byIndex, extra := replicasByIndex(byService[service], replicas)
+
+		for i := 0; i < replicas; i++ {
+			c, ok := byIndex[i]
+			switch {
+			case !ok:
+				add(apitypes.PlanCreate, service, i, nil, "")
+			case c.Labels[composeContainerNumberLabel] == "":
+				add(apitypes.PlanRecreate, service, i, &c, "container predates compose naming")
+			case configChanged(c, hash):
+				add(apitypes.PlanRecreate, service, i, &c, "config changed")
+			case imageID != "" && c.ImageID != imageID:
+				add(apitypes.PlanRecreate, service, i, &c, "image changed")
+			case c.State != "running":
+				add(apitypes.PlanStart, service, i, &c, "container is %s", c.State)
+			default:
+				add(apitypes.PlanUnchanged, service, i, &c, "")
+			}
+		}
+		for _, c := range extra {
+			add(apitypes.PlanRemove, service, -1, &c, "service is scaled to %d", replicas)
+		}
+
+		for _, step := range steps[first:] {
+			if step.Action == apitypes.PlanRecreate {
+				recreated[service] = true
+			}
+		}
+		for dep, d := range spec.DependsOn {
+			if !d.Restart || !recreated[dep] {
+				continue
+			}
+			for i := first; i < len(steps); i++ {
+				if steps[i].Action == apitypes.PlanUnchanged {
+					steps[i].Action = apitypes.PlanRestart
+					steps[i].Reason = fmt.Sprintf("dependency %s is recreated", dep)
+				}
+			}
+		}
+	}
+
+	// Containers of inactive services are left alone
+	orphans := make([]string, 0)
+	for service := range byService {
+		if _, ok := p.Config.Services[service]; !ok && p.inactiveReason(service) == "" {
+			orphans = append(orphans, service)
+		}
+	}
+	sort.Strings(orphans)
+	for _, service := range orphans {
+		for _, c := range byService[service] {
+			if opts.RemoveOrphans {
+				add(apitypes.PlanRemove, service, -1, &c, "service %s is not in the config", service)
+			} else {
+				add(apitypes.PlanOrphan, service, -1, &c, "service %s is not in the config, use remove orphans to remove it", service)
+			}
+		}
+	}
+
+	plan := &apitypes.ComposePlan{
+		Project:  p.Name,
+		DryRun:   opts.DryRun,
+		Networks: networks,
+		Actions:  make([]apitypes.ComposePlanAction, len(steps)),
+	}
+	for i, step := range steps {
+		plan.Actions[i] = step.ComposePlanAction
+	}
+	return plan, steps, nil
+}
+
+// apply executes plan steps in order
+func (p *ComposeProject) apply(ctx context.Context, steps []upStep) error {
+	for _, step := range steps {
+		spec := p.Config.Services[step.Service]
+		var err error
+		switch step.Action {
+		case apitypes.PlanCreate:
+			err = p.runContainer(ctx, step.Service, spec, step.index)
+		case apitypes.PlanRecreate:
+			err = p.recreateContainer(ctx, step.Service, spec, step.index, step.ContainerID, step.Container)
+		case apitypes.PlanStart:
+			reportf(p.report, step.Service, step.Container, apitypes.StepStarting, "")
+			if err = p.client.ContainerStart(ctx, step.ContainerID, container.StartOptions{}); err == nil {
+				reportf(p.report, step.Service, step.Container, apitypes.StepStarted, "")
+			}
+		case apitypes.PlanRestart:
+			reportf(p.report, step.Service, step.Container, apitypes.StepRestarting, "%s", step.Reason)
+			var stop container.StopOptions
+			if stop, err = stopOptions(spec, nil); err != nil {
+				break
+			}
+			if err = p.client.ContainerRestart(ctx, step.ContainerID, stop); err == nil {
+				reportf(p.report, step.Service, step.Container, apitypes.StepStarted, "")
+			}
+		case apitypes.PlanRemove:
+			reportf(p.report, step.Service, step.Container, apitypes.StepRemoving, "%s", step.Reason)
+			if err = p.removeContainer(ctx, step.ContainerID, spec); err == nil {
+				reportf(p.report, step.Service, step.Container, apitypes.StepRemoved, "")
+			}
+		case apitypes.PlanUnchanged:
+			reportf(p.report, step.Service, step.Container, apitypes.StepStarted, "container is up to date")
+		}
+		if err != nil {
+			reportf(p.report, step.Service, step.Container, apitypes.StepFailed, "%v", err)
+			return fmt.Errorf("failed to %s %s: %w", step.Action, step.Container, err)
+		}
+	}
+	return nil
+}
+
+// runContainer creates and starts a replica
+func (p *ComposeProject) runContainer(ctx context.Context, service string, spec apitypes.ServiceSpec, index int) error {
+	name := p.containerName(service, index)
+	reportf(p.report, service, name, apitypes.StepCreating, "")
+	id, err := p.createContainer(ctx, service, spec, index)
+	if err != nil {
+		return err
+	}
+	reportf(p.report, service, name, apitypes.StepStarting, "")
+	if err := p.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+	reportf(p.report, service, name, apitypes.StepStarted, "")
+	return nil
+}
+
+// recreateContainer replaces a replica. The old container is stopped and
+// renamed out of the way, and only removed once its replacement runs; if
+// the replacement fails the old container is restored.
+func (p *ComposeProject) recreateContainer(ctx context.Context, service string, spec apitypes.ServiceSpec, index int, oldID, oldName string) error {
+	reportf(p.report, service, oldName, apitypes.StepStopping, "recreating")
+	stop, err := stopOptions(spec, nil)
+	if err != nil {
+		return err
+	}
+	if err := p.client.ContainerStop(ctx, oldID, stop); err != nil {
+		return fmt.Errorf("failed to stop container %s: %w", oldName, err)
+	}
+	if err := p.client.ContainerRename(ctx, oldID, fmt.Sprintf("%s_%s", shortID(oldID), oldName)); err != nil {
+		return fmt.Errorf("failed to rename container %s: %w", oldName, err)
+	}
+
+	if err := p.runContainer(ctx, service, spec, index); err != nil {
+		p.removeContainerNamed(ctx, p.containerName(service, index))
+		if rerr := p.client.ContainerRename(ctx, oldID, oldName); rerr == nil {
+			p.client.ContainerStart(ctx, oldID, container.StartOptions{})
+		}
+		return err
+	}
+
+	return p.client.ContainerRemove(ctx, oldID, container.RemoveOptions{Force: true})
+}
+
+// removeContainerNamed force-removes a container if it exists
+func (p *ComposeProject) removeContainerNamed(ctx context.Context, name string) {
+	if _, err := p.client.ContainerInspect(ctx, name); err == nil {
+		p.client.ContainerRemove(ctx, name, container.RemoveOptions{Force: true})
+	}
+}
+
+// projectContainers lists the containers of the project, leaving out
+// one-off containers
+func (p *ComposeProject) projectContainers(ctx context.Context) ([]types.Container, error) {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project containers: %w", err)
+	}
+
+	result := containers[:0]
+	for _, c := range containers {
+		if !strings.EqualFold(c.Labels["com.docker.compose.oneoff"], "true") {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return summaryName(result[i]) < summaryName(result[j])
+	})
+	return result, nil
+}
+
+// imageID returns the ID of a local image, or "" when it is not present
+func (p *ComposeProject) imageID(ctx context.Context, ref string) (string, error) {
+	inspect, _, err := p.client.ImageInspectWithRaw(ctx, ref)
+	if client.IsErrNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+	return inspect.ID, nil
+}
+
+// missingNetworks returns the daemon names of project networks that do not
+// exist yet
+func (p *ComposeProject) missingNetworks(ctx context.Context) ([]string, error) {
+	existing, err := p.client.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	names := make(map[string]bool, len(existing))
+	for _, n := range existing {
+		names[n.Name] = true
+	}
+
+	missing := make([]string, 0)
+	for name, spec := range p.projectNetworks() {
+		if !spec.External && !names[p.networkName(name)] {
+			missing = append(missing, p.networkName(name))
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func summaryName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return shortID(c.ID)
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
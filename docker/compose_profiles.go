@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+)
+
+// allProfiles activates every profile
+const allProfiles = "*"
+
+// ActivateProfiles limits the project to its active services: those
+// without profiles, those in one of the given profiles ("*" activates
+// all), the given services, and the dependencies of all of them. Inactive
+// services are not started, pulled or treated as orphans. Projects start
+// with no profile active.
+func (p *ComposeProject) ActivateProfiles(profiles []string, services ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	enabled := make(map[string]bool, len(profiles))
+	for _, profile := range profiles {
+		enabled[profile] = true
+	}
+
+	active := make(map[string]apitypes.ServiceSpec)
+	var activate func(name string)
+	activate = func(name string) {
+		spec, ok := p.services[name]
+		if _, done := active[name]; done || !ok {
+			return
+		}
+		active[name] = spec
+		for dep := range spec.DependsOn {
+			activate(dep)
+		}
+	}
+	for name, spec := range p.services {
+		if len(spec.Profiles) == 0 || enabled[allProfiles] {
+			activate(name)
+			continue
+		}
+		for _, profile := range spec.Profiles {
+			if enabled[profile] {
+				activate(name)
+				break
+			}
+		}
+	}
+	for _, name := range services {
+		activate(name)
+	}
+
+	config := *p.Config
+	config.Services = active
+	p.Config = &config
+	p.inactive = make(map[string][]string)
+	for name, spec := range p.services {
+		if _, ok := active[name]; !ok {
+			p.inactive[name] = spec.Profiles
+		}
+	}
+}
+
+// InactiveServices returns the services left out by ActivateProfiles
+func (p *ComposeProject) InactiveServices() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, 0, len(p.inactive))
+	for name := range p.inactive {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inactiveReason explains why a service is inactive, or returns "" when
+// it is active or not in the config
+func (p *ComposeProject) inactiveReason(service string) string {
+	profiles, ok := p.inactive[service]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("service %s is in the inactive profiles %s", service, strings.Join(profiles, ", "))
+}
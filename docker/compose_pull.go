@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	units "github.com/docker/go-units"
+)
+
+const (
+	// maxParallelPulls bounds how many images are pulled at once
+	maxParallelPulls = 4
+
+	// pullProgressInterval is how often the progress of a pull is reported
+	pullProgressInterval = time.Second
+)
+
+// imagePull is an image to pull and the services that run it
+type imagePull struct {
+	ref      string
+	services []string
+}
+
+// Pull refreshes the images of the project without touching its
+// containers. Services that are built or have pull_policy never are
+// skipped.
+func (p *ComposeProject) Pull(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pulls, err := p.imagePulls(ctx, nil, true)
+	if err != nil {
+		return err
+	}
+	return p.pullImages(ctx, pulls)
+}
+
+// pullServiceImage pulls the image of one service when its pull policy
+// asks for it
+func (p *ComposeProject) pullServiceImage(ctx context.Context, service string) error {
+	pulls, err := p.imagePulls(ctx, []string{service}, false)
+	if err != nil {
+		return err
+	}
+	return p.pullImages(ctx, pulls)
+}
+
+// serviceImage returns the image a service runs. Services that are only
+// built use the {project}-{service} tag.
+func (p *ComposeProject) serviceImage(service string, spec apitypes.ServiceSpec) string {
+	if spec.Image != "" {
+		return spec.Image
+	}
+	return fmt.Sprintf("%s-%s", p.Name, service)
+}
+
+// imagePulls resolves the pull policy of the given services, or of every
+// service when services is nil. With refresh the image of every pullable
+// service is pulled; otherwise only those that are missing or have
+// pull_policy always. Images that are missing and cannot be pulled are
+// errors.
+func (p *ComposeProject) imagePulls(ctx context.Context, services []string, refresh bool) ([]imagePull, error) {
+	if services == nil {
+		for name := range p.Config.Services {
+			services = append(services, name)
+		}
+		sort.Strings(services)
+	}
+
+	byRef := make(map[string]*imagePull)
+	var errs []error
+	for _, service := range services {
+		spec := p.Config.Services[service]
+		ref := p.serviceImage(service, spec)
+		id, err := p.imageID(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		present := id != ""
+
+		need := false
+		switch spec.PullPolicy {
+		case "", apitypes.PullPolicyMissing, apitypes.PullPolicyIfNotPresent:
+			if spec.Image == "" {
+				if !present && !refresh {
+					errs = append(errs, fmt.Errorf("service %s: image %s must be built first, building images is not supported", service, ref))
+				}
+				continue
+			}
+			need = refresh || !present
+		case apitypes.PullPolicyAlways:
+			need = spec.Image != ""
+		case apitypes.PullPolicyNever:
+			if !present && !refresh {
+				errs = append(errs, fmt.Errorf("service %s: image %s is not present and pull_policy is never", service, ref))
+			}
+		case apitypes.PullPolicyBuild:
+			if !present && !refresh {
+				errs = append(errs, fmt.Errorf("service %s: image %s must be built first, building images is not supported", service, ref))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("service %s: unknown pull_policy %s", service, spec.PullPolicy))
+		}
+		if !need {
+			continue
+		}
+		if pull, ok := byRef[ref]; ok {
+			pull.services = append(pull.services, service)
+		} else {
+			byRef[ref] = &imagePull{ref: ref, services: []string{service}}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	pulls := make([]imagePull, 0, len(byRef))
+	for _, pull := range byRef {
+		pulls = append(pulls, *pull)
+	}
+	sort.Slice(pulls, func(i, j int) bool { return pulls[i].ref < pulls[j].ref })
+	return pulls, nil
+}
+
+// pullImages pulls images in parallel, reporting the combined progress of
+// their layers to every service that runs them
+func (p *ComposeProject) pullImages(ctx context.Context, pulls []imagePull) error {
+	images := NewImageManager(p.client)
+	sem := make(chan struct{}, maxParallelPulls)
+	errs := make([]error, len(pulls))
+	var wg sync.WaitGroup
+	for i, pull := range pulls {
+		wg.Add(1)
+		go func(i int, pull imagePull) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			step := func(step, format string, args ...interface{}) {
+				for _, service := range pull.services {
+					reportf(p.report, service, "", step, format, args...)
+				}
+			}
+			step(apitypes.StepPulling, "%s", pull.ref)
+
+			if err := p.pullImage(ctx, images, pull.ref, func(current, total int64) {
+				step(apitypes.StepPulling, "%s: %s / %s", pull.ref, units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+			}); err != nil {
+				step(apitypes.StepFailed, "%v", err)
+				errs[i] = fmt.Errorf("failed to pull %s: %w", pull.ref, err)
+				return
+			}
+			step(apitypes.StepPulled, "%s", pull.ref)
+		}(i, pull)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// pullImage pulls one image, calling progress at most once per
+// pullProgressInterval with the bytes downloaded across all layers
+func (p *ComposeProject) pullImage(ctx context.Context, images *ImageManager, ref string, progress func(current, total int64)) error {
+	events := make(chan apitypes.PullProgress, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- images.Pull(ctx, ref, events)
+		close(events)
+	}()
+
+	type layer struct{ current, total int64 }
+	layers := make(map[string]layer)
+	var pullErr error
+	last := time.Now()
+	for event := range events {
+		if event.Error != "" && pullErr == nil {
+			pullErr = errors.New(event.Error)
+		}
+		if event.ID != "" && event.ProgressDetail.Total > 0 {
+			layers[event.ID] = layer{event.ProgressDetail.Current, event.ProgressDetail.Total}
+		}
+		if time.Since(last) < pullProgressInterval {
+			continue
+		}
+		last = time.Now()
+		var current, total int64
+		for _, l := range layers {
+			current += l.current
+			total += l.total
+		}
+		if total > 0 {
+			progress(current, total)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+	return pullErr
+}
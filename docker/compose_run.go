@@ -0,0 +1,367 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+)
+
+// composeSlugLabel identifies a one-off container, whose name ends with
+// the first 12 characters of it
+const composeSlugLabel = "com.docker.compose.slug"
+
+// RunAttachTimeout is how long a run waits for a client to attach before
+// it is dropped
+const RunAttachTimeout = time.Minute
+
+var (
+	// ErrRunNotFound is returned when attaching to a run that is not one
+	// of the project or was dropped
+	ErrRunNotFound = errors.New("one-off container not found")
+
+	// ErrRunStarted is returned when attaching to a run that a client
+	// already attached to
+	ErrRunStarted = errors.New("one-off container was already started")
+)
+
+// RunOptions overrides the definition of a service for a one-off container
+type RunOptions struct {
+	// Command and Entrypoint replace those of the service when set
+	Command    []string
+	Entrypoint []string
+
+	// Environment is added to the environment of the service
+	Environment map[string]string
+
+	User       string
+	WorkingDir string
+
+	// Tty allocates a terminal and opens stdin
+	Tty bool
+
+	// Remove removes the container once it exits
+	Remove bool
+
+	// NoDeps skips starting the dependencies of the service and waiting
+	// for its depends_on conditions
+	NoDeps bool
+
+	// WaitTimeout bounds the wait for each depends_on condition, defaulting
+	// to DefaultDependencyTimeout
+	WaitTimeout time.Duration
+}
+
+// pendingRun is a run waiting for a client to attach
+type pendingRun struct {
+	project *ComposeProject
+	service string
+	slug    string
+	opts    RunOptions
+}
+
+// pendingRuns holds the runs waiting for a client, by slug
+var pendingRuns = struct {
+	sync.Mutex
+	runs map[string]*pendingRun
+}{runs: make(map[string]*pendingRun)}
+
+// Run registers a one-off container of a service, named and labelled as by
+// compose run: it joins the project networks without the service aliases
+// and publishes no ports. Nothing is pulled, started or created until a
+// client attaches with AttachRun; the run is dropped if none does within
+// RunAttachTimeout.
+func (p *ComposeProject) Run(service string, opts RunOptions) (*apitypes.ComposeRun, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if _, ok := p.Config.Services[service]; !ok {
+		return nil, fmt.Errorf("service %s not found", service)
+	}
+
+	slug := strings.ReplaceAll(uuid.New().String(), "-", "")
+	pendingRuns.Lock()
+	pendingRuns.runs[slug] = &pendingRun{project: p, service: service, slug: slug, opts: opts}
+	pendingRuns.Unlock()
+	time.AfterFunc(RunAttachTimeout, func() {
+		pendingRuns.Lock()
+		delete(pendingRuns.runs, slug)
+		pendingRuns.Unlock()
+	})
+
+	return &apitypes.ComposeRun{
+		ID:      slug,
+		Name:    p.runName(service, slug),
+		Project: p.Name,
+		Service: service,
+		Tty:     opts.Tty,
+		Remove:  opts.Remove,
+	}, nil
+}
+
+func (p *ComposeProject) runName(service, slug string) string {
+	return fmt.Sprintf("%s-%s-run-%s", p.Name, service, slug[:12])
+}
+
+// prepareRun pulls the image of the service, starts its dependencies and
+// waits for their conditions, then creates the one-off container
+func (p *ComposeProject) prepareRun(ctx context.Context, run *pendingRun) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	service, opts := run.service, run.opts
+	spec := p.Config.Services[service]
+
+	if !opts.NoDeps {
+		timeout := opts.WaitTimeout
+		if timeout <= 0 {
+			timeout = DefaultDependencyTimeout
+		}
+		if err := p.startDependencies(ctx, service, timeout); err != nil {
+			return "", err
+		}
+	}
+	if err := p.pullServiceImage(ctx, service); err != nil {
+		return "", err
+	}
+	if err := p.createNetworks(ctx); err != nil {
+		return "", fmt.Errorf("failed to create networks: %w", err)
+	}
+	if err := p.createVolumes(ctx); err != nil {
+		return "", fmt.Errorf("failed to create volumes: %w", err)
+	}
+
+	containerConfig, hostConfig, networkConfig, err := p.containerSpec(service, spec, 0)
+	if err != nil {
+		return "", err
+	}
+
+	delete(containerConfig.Labels, composeContainerNumberLabel)
+	containerConfig.Labels[composeOneoffLabel] = "True"
+	containerConfig.Labels[composeSlugLabel] = run.slug
+
+	if len(opts.Command) > 0 {
+		containerConfig.Cmd = opts.Command
+	}
+	if len(opts.Entrypoint) > 0 {
+		containerConfig.Entrypoint = opts.Entrypoint
+	}
+	if len(opts.Environment) > 0 {
+		env := spec.Environment.Resolve(os.LookupEnv)
+		for k, v := range opts.Environment {
+			env[k] = v
+		}
+		containerConfig.Env = mapToEnvSlice(env)
+	}
+	if opts.User != "" {
+		containerConfig.User = opts.User
+	}
+	if opts.WorkingDir != "" {
+		containerConfig.WorkingDir = opts.WorkingDir
+	}
+
+	containerConfig.Tty = opts.Tty
+	containerConfig.OpenStdin = opts.Tty
+	containerConfig.StdinOnce = opts.Tty
+	containerConfig.AttachStdin = opts.Tty
+	containerConfig.AttachStdout = true
+	containerConfig.AttachStderr = true
+	containerConfig.ExposedPorts = nil
+	hostConfig.PortBindings = nil
+	hostConfig.AutoRemove = opts.Remove
+	hostConfig.RestartPolicy = container.RestartPolicy{Name: container.RestartPolicyDisabled}
+	for _, endpoint := range networkConfig.EndpointsConfig {
+		endpoint.Aliases = nil
+	}
+
+	name := p.runName(service, run.slug)
+	reportf(p.report, service, name, apitypes.StepCreating, "")
+	resp, err := p.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	if err := p.copyFileObjects(ctx, resp.ID, service, spec); err != nil {
+		p.client.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true})
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// startDependencies brings up the services a service depends on, directly
+// or not, as Up does for the whole project: missing or outdated
+// containers are created and stopped ones started, waiting for the
+// depends_on conditions between them. The service's own conditions are
+// then waited for.
+func (p *ComposeProject) startDependencies(ctx context.Context, service string, timeout time.Duration) error {
+	deps := make(map[string]apitypes.ServiceSpec)
+	var add func(name string)
+	add = func(name string) {
+		for dep := range p.Config.Services[name].DependsOn {
+			spec, ok := p.Config.Services[dep]
+			if _, done := deps[dep]; done || !ok {
+				continue
+			}
+			deps[dep] = spec
+			add(dep)
+		}
+	}
+	add(service)
+	if len(deps) == 0 {
+		return nil
+	}
+
+	// The other services are left alone rather than reported as orphans
+	config := *p.Config
+	config.Services = deps
+	dependencies := &ComposeProject{
+		Name:       p.Name,
+		ConfigPath: p.ConfigPath,
+		Config:     &config,
+		client:     p.client,
+		report:     p.report,
+		services:   p.services,
+		inactive:   make(map[string][]string),
+	}
+	for name, spec := range p.services {
+		if _, ok := deps[name]; !ok {
+			dependencies.inactive[name] = spec.Profiles
+		}
+	}
+	if _, err := dependencies.Up(ctx, UpOptions{WaitTimeout: timeout}); err != nil {
+		return fmt.Errorf("failed to start dependencies: %w", err)
+	}
+	return p.waitForDependencies(ctx, service, timeout)
+}
+
+// RunAttachment is a client attached to a started one-off container.
+// With a terminal, Conn carries the raw stream; otherwise Reader carries
+// stdout and stderr multiplexed.
+type RunAttachment struct {
+	types.HijackedResponse
+	ID   string
+	Name string
+	Tty  bool
+
+	client *client.Client
+	exit   <-chan container.WaitResponse
+	errs   <-chan error
+}
+
+// AttachRun takes a run of the project registered by Run, prepares and
+// creates its one-off container, attaches to it and starts it. Progress of
+// the preparation goes to the OnProgress callback. A run can be attached
+// to once, even if its preparation fails.
+func (p *ComposeProject) AttachRun(ctx context.Context, slug string) (*RunAttachment, error) {
+	pendingRuns.Lock()
+	run, ok := pendingRuns.runs[slug]
+	if ok && run.project.Name == p.Name {
+		delete(pendingRuns.runs, slug)
+	}
+	pendingRuns.Unlock()
+	if !ok || run.project.Name != p.Name {
+		return nil, p.runStatus(ctx, slug)
+	}
+
+	run.project.OnProgress(p.report)
+	id, err := run.project.prepareRun(ctx, run)
+	if err != nil {
+		return nil, err
+	}
+	inspect, err := p.client.ContainerInspect(ctx, id)
+	if err != nil {
+		p.client.ContainerRemove(context.WithoutCancel(ctx), id, container.RemoveOptions{Force: true})
+		return nil, fmt.Errorf("failed to inspect container %s: %w", id, err)
+	}
+
+	resp, err := p.client.ContainerAttach(ctx, id, container.AttachOptions{
+		Stream: true,
+		Stdin:  inspect.Config.OpenStdin,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		p.client.ContainerRemove(context.WithoutCancel(ctx), id, container.RemoveOptions{Force: true})
+		return nil, fmt.Errorf("failed to attach to container: %w", err)
+	}
+
+	// The wait starts before the container so that an auto-removed
+	// container cannot exit unnoticed
+	condition := container.WaitConditionNextExit
+	if inspect.HostConfig.AutoRemove {
+		condition = container.WaitConditionRemoved
+	}
+	exit, errs := p.client.ContainerWait(ctx, id, condition)
+
+	reportf(p.report, run.service, strings.TrimPrefix(inspect.Name, "/"), apitypes.StepStarting, "")
+	if err := p.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		resp.Close()
+		p.client.ContainerRemove(context.WithoutCancel(ctx), id, container.RemoveOptions{Force: true})
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	return &RunAttachment{
+		HijackedResponse: resp,
+		ID:               id,
+		Name:             strings.TrimPrefix(inspect.Name, "/"),
+		Tty:              inspect.Config.Tty,
+		client:           p.client,
+		exit:             exit,
+		errs:             errs,
+	}, nil
+}
+
+// runStatus tells a run that was already attached to from one that does
+// not exist or was dropped
+func (p *ComposeProject) runStatus(ctx context.Context, slug string) error {
+	f := filters.NewArgs()
+	f.Add("label", fmt.Sprintf("com.docker.compose.project=%s", p.Name))
+	f.Add("label", fmt.Sprintf("%s=%s", composeSlugLabel, slug))
+	containers, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		return fmt.Errorf("failed to list one-off containers: %w", err)
+	}
+	if len(containers) > 0 {
+		return ErrRunStarted
+	}
+	return ErrRunNotFound
+}
+
+// Resize changes the size of the terminal
+func (a *RunAttachment) Resize(ctx context.Context, height, width uint) error {
+	return a.client.ContainerResize(ctx, a.ID, container.ResizeOptions{
+		Height: height,
+		Width:  width,
+	})
+}
+
+// Stop stops the container, e.g. when the client goes away before it exits
+func (a *RunAttachment) Stop(ctx context.Context) error {
+	if err := a.client.ContainerStop(ctx, a.ID, container.StopOptions{}); err != nil && !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to stop container %s: %w", a.Name, err)
+	}
+	return nil
+}
+
+// Wait blocks until the container exits and returns its exit code
+func (a *RunAttachment) Wait() (int, error) {
+	select {
+	case resp := <-a.exit:
+		if resp.Error != nil {
+			return -1, fmt.Errorf("failed to wait for container %s: %s", a.Name, resp.Error.Message)
+		}
+		return int(resp.StatusCode), nil
+	case err := <-a.errs:
+		return -1, fmt.Errorf("failed to wait for container %s: %w", a.Name, err)
+	}
+}
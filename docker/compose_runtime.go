@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// applyHostOptions maps the resources, restart policy and runtime options
+// of a service onto its host config
+func (p *ComposeProject) applyHostOptions(hostConfig *container.HostConfig, config apitypes.ServiceSpec) error {
+	policy, err := restartPolicy(config)
+	if err != nil {
+		return err
+	}
+	hostConfig.RestartPolicy = policy
+
+	if config.Deploy != nil && config.Deploy.Resources != nil {
+		if err := applyResources(&hostConfig.Resources, config.Deploy.Resources); err != nil {
+			return err
+		}
+	}
+
+	hostConfig.Privileged = config.Privileged
+	hostConfig.CapAdd = config.CapAdd
+	hostConfig.CapDrop = config.CapDrop
+	hostConfig.SecurityOpt = config.SecurityOpt
+	hostConfig.Sysctls = config.Sysctls
+	hostConfig.Init = config.Init
+	hostConfig.ReadonlyRootfs = config.ReadOnly
+	hostConfig.DNS = config.DNS
+	hostConfig.DNSSearch = config.DNSSearch
+	hostConfig.DNSOptions = config.DNSOpt
+	hostConfig.ExtraHosts = config.ExtraHosts
+
+	for _, spec := range config.Devices {
+		device, err := parseDevice(spec)
+		if err != nil {
+			return err
+		}
+		hostConfig.Devices = append(hostConfig.Devices, device)
+	}
+
+	if len(config.Tmpfs) > 0 {
+		hostConfig.Tmpfs = make(map[string]string, len(config.Tmpfs))
+		for _, entry := range config.Tmpfs {
+			path, opts, _ := strings.Cut(entry, ":")
+			hostConfig.Tmpfs[path] = opts
+		}
+	}
+
+	if config.ShmSize != "" {
+		size, err := units.RAMInBytes(string(config.ShmSize))
+		if err != nil {
+			return fmt.Errorf("invalid shm_size %s: %w", config.ShmSize, err)
+		}
+		hostConfig.ShmSize = size
+	}
+
+	names := make([]string, 0, len(config.Ulimits))
+	for name := range config.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limit := config.Ulimits[name]
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{Name: name, Soft: limit.Soft, Hard: limit.Hard})
+	}
+
+	if config.Logging != nil {
+		hostConfig.LogConfig = container.LogConfig{Type: config.Logging.Driver, Config: config.Logging.Options}
+	}
+
+	hostConfig.NetworkMode = container.NetworkMode(p.namespaceMode(config.NetworkMode))
+	hostConfig.PidMode = container.PidMode(p.namespaceMode(config.Pid))
+	hostConfig.IpcMode = container.IpcMode(p.namespaceMode(config.Ipc))
+	return nil
+}
+
+// namespaceMode turns the service:{name} form of network_mode, pid and ipc
+// into the container:{name} form the engine takes, pointing at the first
+// replica of the service
+func (p *ComposeProject) namespaceMode(mode string) string {
+	if service, ok := strings.CutPrefix(mode, "service:"); ok {
+		return "container:" + p.containerName(service, 0)
+	}
+	return mode
+}
+
+// restartPolicy returns the restart policy of a service. deploy.restart_policy
+// takes precedence over restart.
+func restartPolicy(config apitypes.ServiceSpec) (container.RestartPolicy, error) {
+	if config.Deploy != nil && config.Deploy.RestartPolicy != nil {
+		rp := config.Deploy.RestartPolicy
+		switch rp.Condition {
+		case apitypes.RestartConditionNone:
+			return container.RestartPolicy{Name: container.RestartPolicyDisabled}, nil
+		case apitypes.RestartConditionOnFailure:
+			policy := container.RestartPolicy{Name: container.RestartPolicyOnFailure}
+			if rp.MaxAttempts != nil {
+				policy.MaximumRetryCount = *rp.MaxAttempts
+			}
+			return policy, nil
+		case "", apitypes.RestartConditionAny:
+			return container.RestartPolicy{Name: container.RestartPolicyAlways}, nil
+		default:
+			return container.RestartPolicy{}, fmt.Errorf("invalid restart_policy condition %s", rp.Condition)
+		}
+	}
+
+	name, retries, _ := strings.Cut(config.Restart, ":")
+	switch name {
+	case "", apitypes.RestartNo:
+		return container.RestartPolicy{Name: container.RestartPolicyDisabled}, nil
+	case apitypes.RestartAlways:
+		return container.RestartPolicy{Name: container.RestartPolicyAlways}, nil
+	case apitypes.RestartUnlessStopped:
+		return container.RestartPolicy{Name: container.RestartPolicyUnlessStopped}, nil
+	case apitypes.RestartOnFailure:
+		policy := container.RestartPolicy{Name: container.RestartPolicyOnFailure}
+		if retries != "" {
+			n, err := strconv.Atoi(retries)
+			if err != nil || n < 0 {
+				return container.RestartPolicy{}, fmt.Errorf("invalid restart %s", config.Restart)
+			}
+			policy.MaximumRetryCount = n
+		}
+		return policy, nil
+	}
+	return container.RestartPolicy{}, fmt.Errorf("invalid restart %s", config.Restart)
+}
+
+// applyResources maps deploy.resources: limits set the CPU quota, memory
+// and pids limits, reservations the memory reservation and the CPU shares,
+// 1024 per CPU
+func applyResources(resources *container.Resources, spec *apitypes.ResourcesSpec) error {
+	if limits := spec.Limits; limits != nil {
+		if limits.Cpus != "" {
+			cpus, err := parseCpus(limits.Cpus)
+			if err != nil {
+				return err
+			}
+			resources.NanoCPUs = int64(cpus * 1e9)
+		}
+		if limits.Memory != "" {
+			memory, err := units.RAMInBytes(string(limits.Memory))
+			if err != nil {
+				return fmt.Errorf("invalid memory limit %s: %w", limits.Memory, err)
+			}
+			resources.Memory = memory
+		}
+		if limits.Pids != 0 {
+			pids := limits.Pids
+			resources.PidsLimit = &pids
+		}
+	}
+
+	if reservations := spec.Reservations; reservations != nil {
+		if reservations.Cpus != "" {
+			cpus, err := parseCpus(reservations.Cpus)
+			if err != nil {
+				return err
+			}
+			resources.CPUShares = int64(cpus * 1024)
+		}
+		if reservations.Memory != "" {
+			memory, err := units.RAMInBytes(string(reservations.Memory))
+			if err != nil {
+				return fmt.Errorf("invalid memory reservation %s: %w", reservations.Memory, err)
+			}
+			resources.MemoryReservation = memory
+		}
+	}
+	return nil
+}
+
+func parseCpus(value string) (float64, error) {
+	cpus, err := strconv.ParseFloat(value, 64)
+	if err != nil || cpus < 0 {
+		return 0, fmt.Errorf("invalid cpus %s", value)
+	}
+	return cpus, nil
+}
+
+// parseDevice parses a device in host[:container[:permissions]] form
+func parseDevice(spec string) (container.DeviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	device := container.DeviceMapping{PathOnHost: parts[0], PathInContainer: parts[0], CgroupPermissions: "rwm"}
+	switch len(parts) {
+	case 1:
+	case 2:
+		// The second field is permissions when it is not a path
+		if strings.HasPrefix(parts[1], "/") {
+			device.PathInContainer = parts[1]
+		} else {
+			device.CgroupPermissions = parts[1]
+		}
+	case 3:
+		device.PathInContainer = parts[1]
+		device.CgroupPermissions = parts[2]
+	default:
+		return device, fmt.Errorf("invalid device %s", spec)
+	}
+	if device.PathOnHost == "" {
+		return device, fmt.Errorf("invalid device %s", spec)
+	}
+	return device, nil
+}
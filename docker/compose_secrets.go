@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+const (
+	// secretsDir is where secrets go when their target is not absolute
+	secretsDir = "/run/secrets"
+
+	// defaultFileObjectMode is the mode of secrets and configs copied into
+	// containers without a mode
+	defaultFileObjectMode = 0o444
+)
+
+// fileObject is a secret or config granted to a service, resolved to its
+// place in the container. A file without uid, gid or mode is bind-mounted
+// read-only; any other object is copied in before the container starts.
+type fileObject struct {
+	kind    string
+	name    string
+	target  string
+	file    string
+	content []byte
+	uid     int
+	gid     int
+	mode    int64
+	bind    bool
+}
+
+// serviceFileObjects resolves the secrets and configs of a service
+func (p *ComposeProject) serviceFileObjects(service string, spec apitypes.ServiceSpec) ([]fileObject, error) {
+	var objects []fileObject
+	for _, ref := range spec.Secrets {
+		object, err := resolveFileObject("secret", ref, p.Config.Secrets)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service, err)
+		}
+		objects = append(objects, object)
+	}
+	for _, ref := range spec.Configs {
+		object, err := resolveFileObject("config", ref, p.Config.Configs)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service, err)
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// resolveFileObject finds the source of a secret or config reference and
+// where it goes: secrets default to /run/secrets/{source} and configs to
+// /{source}
+func resolveFileObject(kind string, ref apitypes.ServiceFileRef, defined map[string]apitypes.FileObjectSpec) (fileObject, error) {
+	spec, ok := defined[ref.Source]
+	if !ok {
+		return fileObject{}, fmt.Errorf("undefined %s %s", kind, ref.Source)
+	}
+
+	object := fileObject{kind: kind, name: ref.Source, target: ref.Target, mode: defaultFileObjectMode}
+	if object.target == "" {
+		object.target = ref.Source
+	}
+	if !path.IsAbs(object.target) {
+		dir := "/"
+		if kind == "secret" {
+			dir = secretsDir
+		}
+		object.target = path.Join(dir, object.target)
+	}
+
+	var err error
+	if ref.UID != "" {
+		if object.uid, err = strconv.Atoi(ref.UID); err != nil {
+			return fileObject{}, fmt.Errorf("%s %s: invalid uid %s", kind, ref.Source, ref.UID)
+		}
+	}
+	if ref.GID != "" {
+		if object.gid, err = strconv.Atoi(ref.GID); err != nil {
+			return fileObject{}, fmt.Errorf("%s %s: invalid gid %s", kind, ref.Source, ref.GID)
+		}
+	}
+	if ref.Mode != nil {
+		object.mode = int64(*ref.Mode)
+	}
+
+	switch {
+	case spec.External:
+		return fileObject{}, fmt.Errorf("%s %s is external, which needs swarm mode", kind, ref.Source)
+	case spec.File != "":
+		object.file = spec.File
+		object.bind = ref.UID == "" && ref.GID == "" && ref.Mode == nil
+	case spec.Environment != "":
+		if spec.EnvironmentValue == nil {
+			return fileObject{}, fmt.Errorf("%s %s: environment variable %s is not set", kind, ref.Source, spec.Environment)
+		}
+		object.content = []byte(*spec.EnvironmentValue)
+	default:
+		object.content = []byte(spec.Content)
+	}
+	return object, nil
+}
+
+// fileObjectMounts returns the read-only bind mounts of file objects
+func fileObjectMounts(objects []fileObject) []mount.Mount {
+	var mounts []mount.Mount
+	for _, object := range objects {
+		if object.bind {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   object.file,
+				Target:   object.target,
+				ReadOnly: true,
+			})
+		}
+	}
+	return mounts
+}
+
+// copyFileObjects copies the secrets and configs of a service that are not
+// bind-mounted into a created container, with their owner and mode
+func (p *ComposeProject) copyFileObjects(ctx context.Context, containerID, service string, spec apitypes.ServiceSpec) error {
+	objects, err := p.serviceFileObjects(service, spec)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	copied := 0
+	for _, object := range objects {
+		if object.bind {
+			continue
+		}
+		content := object.content
+		if object.file != "" {
+			if content, err = os.ReadFile(object.file); err != nil {
+				return fmt.Errorf("failed to read %s %s: %w", object.kind, object.name, err)
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    strings.TrimPrefix(object.target, "/"),
+			Mode:    object.mode,
+			Uid:     object.uid,
+			Gid:     object.gid,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+		copied++
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if copied == 0 {
+		return nil
+	}
+
+	if err := p.client.CopyToContainer(ctx, containerID, "/", &buf, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("failed to copy secrets and configs: %w", err)
+	}
+	return nil
+}
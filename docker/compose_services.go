@@ -0,0 +1,403 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// serviceActions are the actions ServiceAction accepts
+var serviceActions = map[string]bool{
+	apitypes.ServiceActionStart:    true,
+	apitypes.ServiceActionStop:     true,
+	apitypes.ServiceActionRestart:  true,
+	apitypes.ServiceActionRecreate: true,
+	apitypes.ServiceActionKill:     true,
+	apitypes.ServiceActionPause:    true,
+	apitypes.ServiceActionUnpause:  true,
+}
+
+// IsServiceAction reports whether action is an action on a service
+func IsServiceAction(action string) bool {
+	return serviceActions[action]
+}
+
+// ServiceActionOptions controls an action on a service
+type ServiceActionOptions struct {
+	// Cascade applies the action to the dependents of the service too:
+	// before the service for stop, kill and pause, after it otherwise.
+	// Dependents are restarted when the service is recreated.
+	Cascade bool
+
+	// Signal is sent by kill, defaulting to SIGKILL
+	Signal string
+}
+
+// Services describes every service of the project with its containers.
+// Environment values that look sensitive are masked.
+func (p *ComposeProject) Services(ctx context.Context) ([]apitypes.ComposeService, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	order, err := p.getServiceOrder()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := p.projectContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[string][]types.Container)
+	for _, c := range containers {
+		service := c.Labels["com.docker.compose.service"]
+		byService[service] = append(byService[service], c)
+	}
+
+	names := append([]string(nil), order...)
+	sort.Strings(names)
+	services := make([]apitypes.ComposeService, 0, len(names))
+	for _, name := range names {
+		spec := p.Config.Services[name]
+		svc := apitypes.ComposeService{
+			Name:            name,
+			Image:           p.serviceImage(name, spec),
+			Replicas:        len(byService[name]),
+			DesiredReplicas: 1,
+			Ports:           []apitypes.PortMapping{},
+			Networks:        []apitypes.NetworkInfo{},
+			Volumes:         []apitypes.MountInfo{},
+			Environment:     make(map[string]string, len(spec.Environment)),
+			Dependencies:    make([]string, 0, len(spec.DependsOn)),
+			Dependents:      p.dependents(name, order),
+			Containers:      make([]apitypes.ContainerResponse, 0, len(byService[name])),
+		}
+		if spec.Deploy != nil && spec.Deploy.Replicas > 0 {
+			svc.DesiredReplicas = spec.Deploy.Replicas
+		}
+		for k, v := range spec.Environment {
+			switch {
+			case v == nil:
+				svc.Environment[k] = ""
+			case *v != "" && IsSensitiveKey(k):
+				svc.Environment[k] = MaskedValue
+			default:
+				svc.Environment[k] = *v
+			}
+		}
+		for dep := range spec.DependsOn {
+			svc.Dependencies = append(svc.Dependencies, dep)
+		}
+		sort.Strings(svc.Dependencies)
+
+		ports := make(map[apitypes.PortMapping]bool)
+		mounts := make(map[string]bool)
+		for _, c := range byService[name] {
+			resp := apitypes.ContainerResponse{
+				ID:       c.ID,
+				Name:     summaryName(c),
+				Image:    c.Image,
+				Command:  c.Command,
+				Status:   c.Status,
+				State:    c.State,
+				Created:  time.Unix(c.Created, 0),
+				Ports:    make([]apitypes.PortMapping, 0, len(c.Ports)),
+				Networks: []apitypes.NetworkInfo{},
+				Mounts:   make([]apitypes.MountInfo, 0, len(c.Mounts)),
+				Labels:   c.Labels,
+			}
+			for _, port := range c.Ports {
+				pm := apitypes.PortMapping{HostIP: port.IP, HostPort: port.PublicPort, ContainerPort: port.PrivatePort, Protocol: port.Type}
+				resp.Ports = append(resp.Ports, pm)
+				if !ports[pm] {
+					ports[pm] = true
+					svc.Ports = append(svc.Ports, pm)
+				}
+			}
+			if c.NetworkSettings != nil {
+				for net, ep := range c.NetworkSettings.Networks {
+					info := apitypes.NetworkInfo{Name: net}
+					if ep != nil {
+						info.IPAddress = ep.IPAddress
+						info.Gateway = ep.Gateway
+						info.Aliases = ep.Aliases
+					}
+					resp.Networks = append(resp.Networks, info)
+					svc.Networks = append(svc.Networks, info)
+				}
+			}
+			for _, m := range c.Mounts {
+				mi := apitypes.MountInfo{Type: string(m.Type), Source: m.Source, Destination: m.Destination, Mode: m.Mode, RW: m.RW}
+				resp.Mounts = append(resp.Mounts, mi)
+				if !mounts[m.Destination] {
+					mounts[m.Destination] = true
+					svc.Volumes = append(svc.Volumes, mi)
+				}
+			}
+			svc.Containers = append(svc.Containers, resp)
+		}
+		svc.Status = serviceStatus(byService[name], svc.DesiredReplicas)
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// serviceStatus summarizes the state of the containers of a service:
+// not_created, running, partial, paused, restarting or stopped
+func serviceStatus(containers []types.Container, desired int) string {
+	if len(containers) == 0 {
+		return "not_created"
+	}
+	counts := make(map[string]int)
+	for _, c := range containers {
+		counts[c.State]++
+	}
+	switch {
+	case counts["running"] == len(containers) && len(containers) >= desired:
+		return "running"
+	case counts["running"] > 0:
+		return "partial"
+	case counts["paused"] > 0:
+		return "paused"
+	case counts["restarting"] > 0:
+		return "restarting"
+	}
+	return "stopped"
+}
+
+// ServiceAction applies an action to the containers of a service. Without
+// Cascade, dependents that restart with the service (depends_on with
+// restart: true) are restarted after a restart or recreate, and the
+// result warns about other dependents the action may affect.
+func (p *ComposeProject) ServiceAction(ctx context.Context, service, action string, opts ServiceActionOptions) (*apitypes.ComposeServiceActionResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !serviceActions[action] {
+		return nil, fmt.Errorf("unknown service action %s", action)
+	}
+	if _, ok := p.Config.Services[service]; !ok {
+		return nil, fmt.Errorf("service %s not found", service)
+	}
+	order, err := p.getServiceOrder()
+	if err != nil {
+		return nil, err
+	}
+	dependents := p.dependents(service, order)
+
+	result := &apitypes.ComposeServiceActionResult{
+		Action:     action,
+		Service:    service,
+		Containers: []string{},
+		Cascaded:   []string{},
+		Restarted:  []string{},
+		Warnings:   []string{},
+	}
+	stopping := action == apitypes.ServiceActionStop || action == apitypes.ServiceActionKill || action == apitypes.ServiceActionPause
+
+	type target struct{ service, action string }
+	targets := []target{{service, action}}
+	if opts.Cascade {
+		result.Cascaded = dependents
+		switch {
+		case stopping:
+			// Dependents go down first, the furthest first
+			targets = targets[:0]
+			for i := len(dependents) - 1; i >= 0; i-- {
+				targets = append(targets, target{dependents[i], action})
+			}
+			targets = append(targets, target{service, action})
+		case action == apitypes.ServiceActionRecreate:
+			for _, dep := range dependents {
+				targets = append(targets, target{dep, apitypes.ServiceActionRestart})
+			}
+		default:
+			for _, dep := range dependents {
+				targets = append(targets, target{dep, action})
+			}
+		}
+	} else if len(dependents) > 0 {
+		switch {
+		case stopping:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("services %s depend on %s and may fail while it is unavailable", strings.Join(dependents, ", "), service))
+		case action == apitypes.ServiceActionRestart || action == apitypes.ServiceActionRecreate:
+			for _, dep := range dependents {
+				if d, ok := p.Config.Services[dep].DependsOn[service]; ok && d.Restart {
+					targets = append(targets, target{dep, apitypes.ServiceActionRestart})
+					result.Restarted = append(result.Restarted, dep)
+				}
+			}
+		}
+	}
+
+	if action == apitypes.ServiceActionRecreate || action == apitypes.ServiceActionStart {
+		if err := p.createNetworks(ctx); err != nil {
+			return result, fmt.Errorf("failed to create networks: %w", err)
+		}
+		if err := p.createVolumes(ctx); err != nil {
+			return result, fmt.Errorf("failed to create volumes: %w", err)
+		}
+	}
+
+	containers, err := p.projectContainers(ctx)
+	if err != nil {
+		return result, err
+	}
+	byService := make(map[string][]types.Container)
+	for _, c := range containers {
+		s := c.Labels["com.docker.compose.service"]
+		byService[s] = append(byService[s], c)
+	}
+	if len(byService[service]) == 0 && action != apitypes.ServiceActionRecreate {
+		return result, fmt.Errorf("service %s has no containers, bring the project up first", service)
+	}
+
+	for _, t := range targets {
+		var names []string
+		var err error
+		if t.action == apitypes.ServiceActionRecreate {
+			names, err = p.recreateService(ctx, t.service, byService[t.service])
+		} else {
+			names, err = p.containerAction(ctx, t.service, t.action, byService[t.service], opts.Signal)
+		}
+		result.Containers = append(result.Containers, names...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// containerAction applies an action to the containers of a service that
+// are in a state it applies to, returning their names
+func (p *ComposeProject) containerAction(ctx context.Context, service, action string, containers []types.Container, signal string) ([]string, error) {
+	stop, err := stopOptions(p.Config.Services[service], nil)
+	if err != nil {
+		return nil, err
+	}
+	if signal == "" {
+		signal = "SIGKILL"
+	}
+
+	var names []string
+	for _, c := range containers {
+		name := summaryName(c)
+		var err error
+		switch action {
+		case apitypes.ServiceActionStart:
+			if c.State == "running" || c.State == "paused" {
+				continue
+			}
+			reportf(p.report, service, name, apitypes.StepStarting, "")
+			if err = p.client.ContainerStart(ctx, c.ID, container.StartOptions{}); err == nil {
+				reportf(p.report, service, name, apitypes.StepStarted, "")
+			}
+		case apitypes.ServiceActionStop:
+			if c.State != "running" && c.State != "paused" && c.State != "restarting" {
+				continue
+			}
+			reportf(p.report, service, name, apitypes.StepStopping, "")
+			if err = p.client.ContainerStop(ctx, c.ID, stop); err == nil {
+				reportf(p.report, service, name, apitypes.StepStopped, "")
+			}
+		case apitypes.ServiceActionRestart:
+			reportf(p.report, service, name, apitypes.StepRestarting, "")
+			if err = p.client.ContainerRestart(ctx, c.ID, stop); err == nil {
+				reportf(p.report, service, name, apitypes.StepStarted, "")
+			}
+		case apitypes.ServiceActionKill:
+			if c.State != "running" && c.State != "paused" && c.State != "restarting" {
+				continue
+			}
+			if err = p.client.ContainerKill(ctx, c.ID, signal); err == nil {
+				reportf(p.report, service, name, apitypes.StepKilled, "%s", signal)
+			}
+		case apitypes.ServiceActionPause:
+			if c.State != "running" {
+				continue
+			}
+			if err = p.client.ContainerPause(ctx, c.ID); err == nil {
+				reportf(p.report, service, name, apitypes.StepPaused, "")
+			}
+		case apitypes.ServiceActionUnpause:
+			if c.State != "paused" {
+				continue
+			}
+			if err = p.client.ContainerUnpause(ctx, c.ID); err == nil {
+				reportf(p.report, service, name, apitypes.StepUnpaused, "")
+			}
+		}
+		if err != nil {
+			reportf(p.report, service, name, apitypes.StepFailed, "%v", err)
+			return names, fmt.Errorf("failed to %s container %s: %w", action, name, err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// recreateService replaces every replica of a service with a container
+// created from the current config, creating missing replicas
+func (p *ComposeProject) recreateService(ctx context.Context, service string, containers []types.Container) ([]string, error) {
+	if err := p.pullServiceImage(ctx, service); err != nil {
+		return nil, err
+	}
+	spec := p.Config.Services[service]
+	replicas := 1
+	if spec.Deploy != nil && spec.Deploy.Replicas > 0 {
+		replicas = spec.Deploy.Replicas
+	}
+
+	var steps []upStep
+	byIndex, extra := replicasByIndex(containers, replicas)
+	for i := 0; i < replicas; i++ {
+		step := upStep{index: i}
+		step.Service = service
+		step.Action = apitypes.PlanCreate
+		step.Container = p.containerName(service, i)
+		if c, ok := byIndex[i]; ok {
+			step.Action = apitypes.PlanRecreate
+			step.Container = summaryName(c)
+			step.ContainerID = c.ID
+		}
+		steps = append(steps, step)
+	}
+	for _, c := range extra {
+		step := upStep{index: -1}
+		step.Service = service
+		step.Action = apitypes.PlanRemove
+		step.Container = summaryName(c)
+		step.ContainerID = c.ID
+		step.Reason = fmt.Sprintf("service is scaled to %d", replicas)
+		steps = append(steps, step)
+	}
+
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		names = append(names, step.Container)
+	}
+	return names, p.apply(ctx, steps)
+}
+
+// dependents returns the services that depend on service, directly or
+// through other services, in dependency order
+func (p *ComposeProject) dependents(service string, order []string) []string {
+	affected := map[string]bool{service: true}
+	result := []string{}
+	for _, name := range order {
+		for dep := range p.Config.Services[name].DependsOn {
+			if affected[dep] && !affected[name] {
+				affected[name] = true
+				result = append(result, name)
+				break
+			}
+		}
+	}
+	return result
+}
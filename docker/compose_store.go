@@ -0,0 +1,348 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	apitypes "kibutsu/api/types"
+)
+
+const (
+	// composeHistoryDir holds previous versions inside a project directory
+	composeHistoryDir = ".history"
+
+	// composeHistoryLimit bounds the versions kept per project
+	composeHistoryLimit = 50
+)
+
+var (
+	ErrProjectExists      = errors.New("project already exists")
+	ErrProjectNotFound    = errors.New("project not found")
+	ErrInvalidProjectName = errors.New("invalid project name")
+	ErrVersionNotFound    = errors.New("version not found")
+)
+
+// projectNamePattern follows the compose rules for project names
+var projectNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidateProjectName checks that a name is a valid compose project name.
+// Valid names cannot traverse out of the projects directory.
+func ValidateProjectName(name string) error {
+	if len(name) > 63 || !projectNamePattern.MatchString(name) {
+		return fmt.Errorf("%w %q: use lowercase letters, digits, dashes and underscores, starting with a letter or digit", ErrInvalidProjectName, name)
+	}
+	return nil
+}
+
+// ComposeStore manages project definitions below a root directory, one
+// directory per project. Writes are atomic and the previous content of the
+// main compose file is kept as a numbered version.
+type ComposeStore struct {
+	root string
+	mu   sync.Mutex
+}
+
+// NewComposeStore creates a store rooted at dir
+func NewComposeStore(dir string) *ComposeStore {
+	return &ComposeStore{root: dir}
+}
+
+// Root returns the directory holding the projects
+func (s *ComposeStore) Root() string {
+	return s.root
+}
+
+// ProjectDir returns the directory of a project
+func (s *ComposeStore) ProjectDir(name string) (string, error) {
+	if err := ValidateProjectName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+// List returns the names of the projects that have a compose file
+func (s *ComposeStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() || ValidateProjectName(e.Name()) != nil {
+			continue
+		}
+		if _, err := mainComposeFile(filepath.Join(s.root, e.Name())); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// MainFile returns the path of the main compose file of a project, which
+// is the file written by Create and Update
+func (s *ComposeStore) MainFile(name string) (string, error) {
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return "", err
+	}
+	if path, err := mainComposeFile(dir); err == nil {
+		return path, nil
+	}
+	return filepath.Join(dir, "docker-compose.yml"), nil
+}
+
+// Read returns the content of the main compose file
+func (s *ComposeStore) Read(name string) ([]byte, error) {
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return nil, err
+	}
+	path, err := mainComposeFile(dir)
+	if err != nil {
+		return nil, ErrProjectNotFound
+	}
+	return os.ReadFile(path)
+}
+
+// Create writes the compose file of a new project
+func (s *ComposeStore) Create(name string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := mainComposeFile(dir); err == nil {
+		return ErrProjectExists
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create project directory: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(dir, "docker-compose.yml"), content, 0o644)
+}
+
+// CreateFiles writes a new project made of several files, keyed by their
+// path relative to the project directory, one of which must be a compose
+// file. A project directory created here is removed again if a write fails.
+func (s *ComposeStore) CreateFiles(name string, files map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := mainComposeFile(dir); err == nil {
+		return ErrProjectExists
+	}
+	_, statErr := os.Stat(dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create project directory: %w", err)
+	}
+
+	for file, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		rel, err := filepath.Rel(dir, path)
+		switch {
+		case err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+			err = errors.New("path is outside the project directory")
+		default:
+			if err = os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+				err = writeFileAtomic(path, content, 0o644)
+			}
+		}
+		if err != nil {
+			if os.IsNotExist(statErr) {
+				os.RemoveAll(dir)
+			}
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// Update replaces the main compose file of a project, keeping the previous
+// content as a new version
+func (s *ComposeStore) Update(name string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return err
+	}
+	path, err := mainComposeFile(dir)
+	if err != nil {
+		return ErrProjectNotFound
+	}
+
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read current version: %w", err)
+	}
+	if err := s.saveVersion(dir, previous); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content, 0o644)
+}
+
+// Delete removes a project directory with its history
+func (s *ComposeStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return ErrProjectNotFound
+		}
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// History lists the saved versions of a project, newest first
+func (s *ComposeStore) History(name string) ([]apitypes.ComposeVersion, error) {
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mainComposeFile(dir); err != nil {
+		return nil, ErrProjectNotFound
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, composeHistoryDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	versions := make([]apitypes.ComposeVersion, 0, len(entries))
+	for _, e := range entries {
+		n, ok := versionNumber(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, apitypes.ComposeVersion{
+			Version: n,
+			Time:    info.ModTime(),
+			Size:    info.Size(),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+// Version returns the content of a saved version
+func (s *ComposeStore) Version(name string, version int) ([]byte, error) {
+	dir, err := s.ProjectDir(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, composeHistoryDir, versionFileName(version)))
+	if os.IsNotExist(err) {
+		return nil, ErrVersionNotFound
+	}
+	return data, err
+}
+
+// saveVersion stores content as the next version and prunes the oldest
+// versions beyond the limit
+func (s *ComposeStore) saveVersion(dir string, content []byte) error {
+	historyDir := filepath.Join(dir, composeHistoryDir)
+	if err := os.MkdirAll(historyDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(historyDir)
+	if err != nil {
+		return err
+	}
+	var numbers []int
+	for _, e := range entries {
+		if n, ok := versionNumber(e.Name()); ok {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+	if err := writeFileAtomic(filepath.Join(historyDir, versionFileName(next)), content, 0o644); err != nil {
+		return fmt.Errorf("failed to save version: %w", err)
+	}
+
+	for len(numbers) >= composeHistoryLimit {
+		os.Remove(filepath.Join(historyDir, versionFileName(numbers[0])))
+		numbers = numbers[1:]
+	}
+	return nil
+}
+
+func versionFileName(n int) string {
+	return fmt.Sprintf("%d.yml", n)
+}
+
+func versionNumber(fileName string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSuffix(fileName, ".yml"))
+	return n, err == nil && n > 0 && strings.HasSuffix(fileName, ".yml")
+}
+
+// mainComposeFile returns the first default compose file present in dir
+func mainComposeFile(dir string) (string, error) {
+	for _, name := range composeFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// and renames it over path, so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
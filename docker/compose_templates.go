@@ -0,0 +1,389 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	apitypes "kibutsu/api/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// templateFile describes a template and its inputs
+	templateFile = "template.yaml"
+
+	// templateSuffix marks files whose ${VAR} references are substituted
+	// with the input values on deploy; the suffix is dropped
+	templateSuffix = ".tmpl"
+
+	// envFile holds the input values in a deployed project
+	envFile = ".env"
+)
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// inputNamePattern restricts input names to environment variable names
+var inputNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// TemplateStore serves compose templates from a directory, one directory
+// per template holding a template.yaml, a compose file and any files the
+// compose file refers to
+type TemplateStore struct {
+	root string
+}
+
+// NewTemplateStore creates a store rooted at dir
+func NewTemplateStore(dir string) *TemplateStore {
+	return &TemplateStore{root: dir}
+}
+
+// List returns the templates sorted by name. Invalid templates are logged
+// and left out.
+func (s *TemplateStore) List() ([]apitypes.ComposeTemplate, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []apitypes.ComposeTemplate{}, nil
+		}
+		return nil, err
+	}
+
+	templates := make([]apitypes.ComposeTemplate, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() || !projectNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.root, e.Name(), templateFile)); err != nil {
+			continue
+		}
+		t, err := s.Get(e.Name())
+		if err != nil {
+			log.Printf("Warning: skipping template %s: %v", e.Name(), err)
+			continue
+		}
+		templates = append(templates, *t)
+	}
+	return templates, nil
+}
+
+// Get loads a template and checks its inputs
+func (s *TemplateStore) Get(name string) (*apitypes.ComposeTemplate, error) {
+	if !projectNamePattern.MatchString(name) {
+		return nil, ErrTemplateNotFound
+	}
+	dir := filepath.Join(s.root, name)
+
+	data, err := os.ReadFile(filepath.Join(dir, templateFile))
+	if os.IsNotExist(err) {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &apitypes.ComposeTemplate{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(t); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", templateFile, err)
+	}
+	t.Name = name
+	if t.Title == "" {
+		t.Title = name
+	}
+	if t.Inputs == nil {
+		t.Inputs = []apitypes.TemplateInput{}
+	}
+
+	seen := make(map[string]bool, len(t.Inputs))
+	for _, input := range t.Inputs {
+		if seen[input.Name] {
+			return nil, fmt.Errorf("input %s is declared twice", input.Name)
+		}
+		seen[input.Name] = true
+		if err := checkInputDefinition(input); err != nil {
+			return nil, fmt.Errorf("input %s: %w", input.Name, err)
+		}
+	}
+
+	main, err := mainComposeFile(dir)
+	if err != nil {
+		return nil, errors.New("no compose file")
+	}
+	if t.Services, err = templateServices(main); err != nil {
+		return nil, err
+	}
+	if t.Files, err = templateFiles(dir); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render resolves the inputs of a template and returns the files of a
+// project deployed from it, keyed by relative path: the template files,
+// with .tmpl files rendered, and a .env file holding the values. Invalid
+// inputs and a compose file that does not validate with the values are
+// returned as validation errors.
+func (s *TemplateStore) Render(name string, inputs map[string]string) (map[string][]byte, []apitypes.ComposeValidationError, error) {
+	t, err := s.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := filepath.Join(s.root, name)
+
+	values, problems := resolveInputs(t, inputs)
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+
+	files := make(map[string][]byte, len(t.Files)+1)
+	for _, file := range t.Files {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if rendered, ok := strings.CutSuffix(file, templateSuffix); ok {
+			text, err := Interpolate(string(content), lookup)
+			if err != nil {
+				problems = append(problems, apitypes.ComposeValidationError{File: file, Message: err.Error()})
+				continue
+			}
+			file, content = rendered, []byte(text)
+		}
+		files[file] = content
+	}
+	if len(problems) > 0 {
+		return nil, problems, nil
+	}
+
+	main, _ := mainComposeFile(dir)
+	result := ValidateComposeProject(dir, filepath.Base(main), nil, ComposeLoadOptions{Environment: values})
+	if !result.Valid {
+		return nil, result.Errors, nil
+	}
+
+	files[envFile] = envFileContent(name, t.Inputs, values)
+	return files, nil, nil
+}
+
+// resolveInputs applies the defaults of a template to the given values
+// and checks them. Empty values fall back to the default, and passwords
+// with generate to a random value.
+func resolveInputs(t *apitypes.ComposeTemplate, given map[string]string) (map[string]string, []apitypes.ComposeValidationError) {
+	var problems []apitypes.ComposeValidationError
+	fail := func(name, format string, args ...interface{}) {
+		problems = append(problems, apitypes.ComposeValidationError{
+			Path:    "inputs." + name,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	declared := make(map[string]bool, len(t.Inputs))
+	for _, input := range t.Inputs {
+		declared[input.Name] = true
+	}
+	names := make([]string, 0, len(given))
+	for name := range given {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !declared[name] {
+			fail(name, "unknown input %s", name)
+		}
+	}
+
+	values := make(map[string]string, len(t.Inputs))
+	for _, input := range t.Inputs {
+		value := given[input.Name]
+		if value == "" {
+			value = input.Default
+		}
+		if value == "" && input.Generate {
+			value = generateSecret()
+		}
+		if value == "" {
+			if input.Required {
+				fail(input.Name, "%s is required", input.Name)
+			}
+			continue
+		}
+		value, err := checkInputValue(input, value)
+		if err != nil {
+			fail(input.Name, "%v", err)
+			continue
+		}
+		values[input.Name] = value
+	}
+	return values, problems
+}
+
+// checkInputDefinition checks the type, options, pattern and default of
+// an input
+func checkInputDefinition(input apitypes.TemplateInput) error {
+	if !inputNamePattern.MatchString(input.Name) {
+		return errors.New("name must be a valid environment variable name")
+	}
+	switch input.Type {
+	case apitypes.TemplateInputString, apitypes.TemplateInputPassword, apitypes.TemplateInputInteger,
+		apitypes.TemplateInputNumber, apitypes.TemplateInputBoolean, apitypes.TemplateInputPort:
+	case apitypes.TemplateInputEnum:
+		if len(input.Options) == 0 {
+			return errors.New("enum needs options")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", input.Type)
+	}
+	if input.Generate && input.Type != apitypes.TemplateInputPassword {
+		return errors.New("only passwords can be generated")
+	}
+	if input.Pattern != "" {
+		if _, err := regexp.Compile(input.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	if input.Default != "" {
+		if _, err := checkInputValue(input, input.Default); err != nil {
+			return fmt.Errorf("invalid default: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkInputValue validates a value against the type of an input and
+// returns it normalized
+func checkInputValue(input apitypes.TemplateInput, value string) (string, error) {
+	var number float64
+	switch input.Type {
+	case apitypes.TemplateInputString, apitypes.TemplateInputPassword:
+		if input.Pattern != "" && !regexp.MustCompile(`^(?:`+input.Pattern+`)$`).MatchString(value) {
+			return "", fmt.Errorf("%s must match %s", input.Name, input.Pattern)
+		}
+		return value, nil
+	case apitypes.TemplateInputBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%s must be true or false", input.Name)
+		}
+		return strconv.FormatBool(b), nil
+	case apitypes.TemplateInputEnum:
+		for _, option := range input.Options {
+			if value == option {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%s must be one of %s", input.Name, strings.Join(input.Options, ", "))
+	case apitypes.TemplateInputInteger, apitypes.TemplateInputPort:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be an integer", input.Name)
+		}
+		if input.Type == apitypes.TemplateInputPort && (n < 1 || n > 65535) {
+			return "", fmt.Errorf("%s must be a port between 1 and 65535", input.Name)
+		}
+		number, value = float64(n), strconv.FormatInt(n, 10)
+	case apitypes.TemplateInputNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a number", input.Name)
+		}
+		number = n
+	}
+
+	if input.Min != nil && number < *input.Min {
+		return "", fmt.Errorf("%s must be at least %v", input.Name, *input.Min)
+	}
+	if input.Max != nil && number > *input.Max {
+		return "", fmt.Errorf("%s must be at most %v", input.Name, *input.Max)
+	}
+	return value, nil
+}
+
+// templateServices returns the service names of a compose file
+func templateServices(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Services map[string]yaml.Node `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", filepath.Base(path), err)
+	}
+	services := make([]string, 0, len(doc.Services))
+	for name := range doc.Services {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// templateFiles lists the files of a template directory copied into the
+// projects deployed from it: all but template.yaml, .env and hidden
+// directories
+func templateFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel != "." && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == templateFile || rel == envFile || !d.Type().IsRegular() {
+			return nil
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// envFileContent writes the input values as a .env file, in the order the
+// template declares them
+func envFileContent(template string, inputs []apitypes.TemplateInput, values map[string]string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Inputs of template %s\n", template)
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, input := range inputs {
+		if value, ok := values[input.Name]; ok {
+			fmt.Fprintf(&b, "%s=\"%s\"\n", input.Name, quote.Replace(value))
+		}
+	}
+	return b.Bytes()
+}
+
+// generateSecret returns a random value for a generated password
+func generateSecret() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,446 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// defaultUpdateMonitor is how long a new replica must keep running before
+// it counts as updated
+const defaultUpdateMonitor = 5 * time.Second
+
+// updateSettings is an update_config with defaults applied
+type updateSettings struct {
+	parallelism     int
+	delay           time.Duration
+	monitor         time.Duration
+	failureAction   string
+	maxFailureRatio float64
+	order           string
+}
+
+// replicaUpdate tracks the replacement of one replica. The old container
+// is kept aside until the update is over so that it can be restored.
+type replicaUpdate struct {
+	index      int
+	oldID      string
+	oldName    string
+	oldRunning bool
+	newID      string
+}
+
+// newUpdateSettings applies the defaults to the update_config of a service
+func newUpdateSettings(spec apitypes.ServiceSpec) (updateSettings, error) {
+	s := updateSettings{
+		parallelism:   1,
+		monitor:       defaultUpdateMonitor,
+		failureAction: apitypes.FailureActionPause,
+		order:         apitypes.UpdateOrderStopFirst,
+	}
+	if spec.Deploy == nil || spec.Deploy.UpdateConfig == nil {
+		return s, nil
+	}
+	c := spec.Deploy.UpdateConfig
+
+	if c.Parallelism != nil {
+		if *c.Parallelism < 0 {
+			return s, fmt.Errorf("invalid update parallelism %d", *c.Parallelism)
+		}
+		s.parallelism = *c.Parallelism
+	}
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{c.Delay, &s.delay},
+		{c.Monitor, &s.monitor},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil || duration < 0 {
+			return s, fmt.Errorf("invalid update duration %s", d.value)
+		}
+		*d.target = duration
+	}
+	switch c.FailureAction {
+	case "":
+	case apitypes.FailureActionPause, apitypes.FailureActionContinue, apitypes.FailureActionRollback:
+		s.failureAction = c.FailureAction
+	default:
+		return s, fmt.Errorf("unknown update failure_action %s", c.FailureAction)
+	}
+	switch c.Order {
+	case "":
+	case apitypes.UpdateOrderStopFirst, apitypes.UpdateOrderStartFirst:
+		s.order = c.Order
+	default:
+		return s, fmt.Errorf("unknown update order %s", c.Order)
+	}
+	if s.order == apitypes.UpdateOrderStartFirst {
+		// The replacement would bind the host port the old replica holds
+		port, err := fixedHostPort(spec.Ports)
+		if err != nil {
+			return s, err
+		}
+		if port != "" {
+			return s, fmt.Errorf("update order start-first cannot be used with the fixed host port %s, use stop-first or let the host port be assigned", port)
+		}
+	}
+	if c.MaxFailureRatio < 0 || c.MaxFailureRatio > 1 {
+		return s, fmt.Errorf("invalid update max_failure_ratio %v", c.MaxFailureRatio)
+	}
+	s.maxFailureRatio = c.MaxFailureRatio
+	return s, nil
+}
+
+// fixedHostPort returns the first published host port that is a single
+// port rather than left to the daemon or picked from a range
+func fixedHostPort(ports []string) (string, error) {
+	for _, spec := range ports {
+		mappings, err := nat.ParsePortSpec(spec)
+		if err != nil {
+			return "", fmt.Errorf("invalid port mapping %s: %w", spec, err)
+		}
+		for _, m := range mappings {
+			if m.Binding.HostPort != "" && m.Binding.HostPort != "0" && !strings.Contains(m.Binding.HostPort, "-") {
+				return m.Binding.HostPort, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// RollingUpdate replaces the outdated replicas of a service in batches,
+// following its deploy.update_config. Each new replica has to become
+// healthy, or running when it has no healthcheck, and stay so for the
+// monitor window. When failures exceed max_failure_ratio the update is
+// paused, rolled back to the previous containers, or continued, as set by
+// failure_action.
+func (p *ComposeProject) RollingUpdate(ctx context.Context, service string) (*apitypes.ComposeUpdateResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	spec, ok := p.Config.Services[service]
+	if !ok {
+		return nil, fmt.Errorf("service %s not found", service)
+	}
+	settings, err := newUpdateSettings(spec)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", service, err)
+	}
+
+	if err := p.pullServiceImage(ctx, service); err != nil {
+		return nil, err
+	}
+	if err := p.createNetworks(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create networks: %w", err)
+	}
+	if err := p.createVolumes(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create volumes: %w", err)
+	}
+
+	hash, err := ServiceConfigHash(spec)
+	if err != nil {
+		return nil, err
+	}
+	imageID, err := p.imageID(ctx, p.serviceImage(service, spec))
+	if err != nil {
+		return nil, err
+	}
+	replicas := 1
+	if spec.Deploy != nil && spec.Deploy.Replicas > 0 {
+		replicas = spec.Deploy.Replicas
+	}
+
+	containers, err := p.projectContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var replicaContainers []types.Container
+	for _, c := range containers {
+		if c.Labels["com.docker.compose.service"] == service {
+			replicaContainers = append(replicaContainers, c)
+		}
+	}
+	byIndex, extra := replicasByIndex(replicaContainers, replicas)
+
+	result := &apitypes.ComposeUpdateResult{
+		Service:   service,
+		Updated:   []string{},
+		Unchanged: []string{},
+		Failed:    []string{},
+		Removed:   []string{},
+	}
+	var pending []replicaUpdate
+	for i := 0; i < replicas; i++ {
+		c, ok := byIndex[i]
+		if !ok {
+			pending = append(pending, replicaUpdate{index: i})
+			continue
+		}
+		if !configChanged(c, hash) && c.Labels[composeContainerNumberLabel] != "" && (imageID == "" || c.ImageID == imageID) && c.State == "running" {
+			result.Unchanged = append(result.Unchanged, summaryName(c))
+			continue
+		}
+		pending = append(pending, replicaUpdate{index: i, oldID: c.ID, oldName: summaryName(c), oldRunning: c.State == "running"})
+	}
+
+	batch := settings.parallelism
+	if batch == 0 || batch > len(pending) {
+		batch = len(pending)
+	}
+	var updated []replicaUpdate
+	var failures []error
+	for start := 0; start < len(pending); start += batch {
+		if start > 0 && settings.delay > 0 {
+			select {
+			case <-ctx.Done():
+				p.discardReplaced(ctx, updated)
+				return result, ctx.Err()
+			case <-time.After(settings.delay):
+			}
+		}
+
+		chunk := pending[start:min(start+batch, len(pending))]
+		errs := make([]error, len(chunk))
+		var wg sync.WaitGroup
+		for i := range chunk {
+			wg.Add(1)
+			go func(r *replicaUpdate, i int) {
+				defer wg.Done()
+				errs[i] = p.updateReplica(ctx, service, spec, r, settings)
+			}(&chunk[i], i)
+		}
+		wg.Wait()
+
+		for i, r := range chunk {
+			name := p.containerName(service, r.index)
+			if errs[i] != nil {
+				result.Failed = append(result.Failed, name)
+				failures = append(failures, errs[i])
+				continue
+			}
+			updated = append(updated, r)
+			result.Updated = append(result.Updated, name)
+		}
+
+		if len(failures) == 0 || float64(len(failures))/float64(len(pending)) <= settings.maxFailureRatio {
+			continue
+		}
+		switch settings.failureAction {
+		case apitypes.FailureActionRollback:
+			result.RolledBack = true
+			if err := p.rollbackReplicas(ctx, service, updated); err != nil {
+				failures = append(failures, err)
+			}
+			return result, fmt.Errorf("update of %s failed and was rolled back: %w", service, errors.Join(failures...))
+		case apitypes.FailureActionPause:
+			result.Paused = true
+			p.discardReplaced(ctx, updated)
+			return result, fmt.Errorf("update of %s paused after %d of %d replicas: %w", service, len(updated), len(pending), errors.Join(failures...))
+		}
+	}
+	p.discardReplaced(ctx, updated)
+
+	for _, c := range extra {
+		name := summaryName(c)
+		reportf(p.report, service, name, apitypes.StepRemoving, "service is scaled to %d", replicas)
+		if err := p.removeContainer(ctx, c.ID, spec); err != nil {
+			failures = append(failures, fmt.Errorf("failed to remove container %s: %w", name, err))
+			continue
+		}
+		reportf(p.report, service, name, apitypes.StepRemoved, "")
+		result.Removed = append(result.Removed, name)
+	}
+
+	if len(failures) > 0 {
+		return result, fmt.Errorf("%d replicas of %s failed to update: %w", len(result.Failed), service, errors.Join(failures...))
+	}
+	return result, nil
+}
+
+// updateReplica replaces one replica. With stop-first the old container is
+// stopped before its replacement starts, with start-first only once the
+// replacement has passed monitoring. On failure the old container is
+// restored.
+func (p *ComposeProject) updateReplica(ctx context.Context, service string, spec apitypes.ServiceSpec, r *replicaUpdate, s updateSettings) error {
+	name := p.containerName(service, r.index)
+	stop, err := stopOptions(spec, nil)
+	if err != nil {
+		return err
+	}
+
+	if r.oldID != "" {
+		if s.order == apitypes.UpdateOrderStopFirst && r.oldRunning {
+			reportf(p.report, service, r.oldName, apitypes.StepStopping, "updating")
+			if err := p.client.ContainerStop(ctx, r.oldID, stop); err != nil {
+				return fmt.Errorf("failed to stop container %s: %w", r.oldName, err)
+			}
+		}
+		if err := p.client.ContainerRename(ctx, r.oldID, fmt.Sprintf("%s_%s", shortID(r.oldID), r.oldName)); err != nil {
+			if s.order == apitypes.UpdateOrderStopFirst && r.oldRunning {
+				p.client.ContainerStart(context.WithoutCancel(ctx), r.oldID, container.StartOptions{})
+			}
+			return fmt.Errorf("failed to rename container %s: %w", r.oldName, err)
+		}
+	}
+
+	fail := func(err error) error {
+		reportf(p.report, service, name, apitypes.StepFailed, "%v", err)
+		p.restoreReplica(ctx, service, r)
+		return err
+	}
+
+	reportf(p.report, service, name, apitypes.StepCreating, "")
+	id, err := p.createContainer(ctx, service, spec, r.index)
+	if err != nil {
+		return fail(err)
+	}
+	r.newID = id
+	reportf(p.report, service, name, apitypes.StepStarting, "")
+	if err := p.client.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		return fail(fmt.Errorf("failed to start container %s: %w", name, err))
+	}
+	if err := p.monitorReplica(ctx, service, name, id, spec.Healthcheck != nil && !spec.Healthcheck.Disable, s.monitor); err != nil {
+		return fail(err)
+	}
+
+	if r.oldID != "" && s.order == apitypes.UpdateOrderStartFirst && r.oldRunning {
+		reportf(p.report, service, r.oldName, apitypes.StepStopping, "replaced by %s", name)
+		if err := p.client.ContainerStop(ctx, r.oldID, stop); err != nil {
+			log.Printf("Warning: failed to stop replaced container %s: %v", r.oldName, err)
+		}
+	}
+	return nil
+}
+
+// monitorReplica waits for a new replica to become healthy, or running
+// when it has no healthcheck, and then checks that it stays so for the
+// monitor window
+func (p *ComposeProject) monitorReplica(ctx context.Context, service, name, id string, healthcheck bool, monitor time.Duration) error {
+	condition := apitypes.ConditionServiceStarted
+	if healthcheck {
+		condition = apitypes.ConditionServiceHealthy
+		reportf(p.report, service, name, apitypes.StepWaiting, "waiting for %s to be healthy", name)
+	}
+
+	check := func() (bool, error) {
+		inspect, err := p.client.ContainerInspect(ctx, id)
+		if err != nil {
+			return false, fmt.Errorf("failed to inspect container %s: %w", name, err)
+		}
+		return stateMeets(name, inspect.State, condition)
+	}
+
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(DefaultDependencyTimeout)
+	for {
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("timed out after %s waiting for %s", DefaultDependencyTimeout, name)
+		case <-ticker.C:
+		}
+	}
+	if healthcheck {
+		reportf(p.report, service, name, apitypes.StepHealthy, "")
+	}
+
+	end := time.After(monitor)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-end:
+			reportf(p.report, service, name, apitypes.StepStarted, "")
+			return nil
+		case <-ticker.C:
+		}
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("container %s stopped being ready during monitoring", name)
+		}
+	}
+}
+
+// restoreReplica removes the replacement of a replica, if any, and puts
+// the old container back under its name. Like the other cleanup helpers of
+// an update, it runs without the cancellation of ctx, so that a cancelled
+// update does not leave replicas half replaced.
+func (p *ComposeProject) restoreReplica(ctx context.Context, service string, r *replicaUpdate) {
+	ctx = context.WithoutCancel(ctx)
+	if r.newID != "" {
+		if err := p.client.ContainerRemove(ctx, r.newID, container.RemoveOptions{Force: true}); err != nil {
+			log.Printf("Warning: failed to remove container %s: %v", shortID(r.newID), err)
+		}
+		r.newID = ""
+	}
+	if r.oldID == "" {
+		return
+	}
+	if err := p.client.ContainerRename(ctx, r.oldID, r.oldName); err != nil {
+		log.Printf("Warning: failed to restore container name %s: %v", r.oldName, err)
+	}
+	if r.oldRunning {
+		if err := p.client.ContainerStart(ctx, r.oldID, container.StartOptions{}); err != nil {
+			log.Printf("Warning: failed to restart container %s: %v", r.oldName, err)
+		}
+	}
+}
+
+// rollbackReplicas restores the old containers of updated replicas, most
+// recent first. Replicas that had no old container are removed.
+func (p *ComposeProject) rollbackReplicas(ctx context.Context, service string, updated []replicaUpdate) error {
+	ctx = context.WithoutCancel(ctx)
+	var errs []error
+	for i := len(updated) - 1; i >= 0; i-- {
+		r := updated[i]
+		name := p.containerName(service, r.index)
+		reportf(p.report, service, name, apitypes.StepRollingBack, "")
+		if err := p.client.ContainerRemove(ctx, r.newID, container.RemoveOptions{Force: true}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove container %s: %w", name, err))
+			continue
+		}
+		r.newID = ""
+		p.restoreReplica(ctx, service, &r)
+	}
+	return errors.Join(errs...)
+}
+
+// discardReplaced removes the old containers of updated replicas
+func (p *ComposeProject) discardReplaced(ctx context.Context, updated []replicaUpdate) {
+	ctx = context.WithoutCancel(ctx)
+	for _, r := range updated {
+		if r.oldID == "" {
+			continue
+		}
+		if err := p.client.ContainerRemove(ctx, r.oldID, container.RemoveOptions{Force: true}); err != nil {
+			log.Printf("Warning: failed to remove replaced container %s: %v", r.oldName, err)
+		}
+	}
+}
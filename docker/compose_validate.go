@@ -0,0 +1,372 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apitypes "kibutsu/api/types"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// composeTopLevelKeys are the top-level fields of the compose specification
+var composeTopLevelKeys = map[string]bool{
+	"version": true, "name": true, "include": true, "services": true,
+	"networks": true, "volumes": true, "secrets": true, "configs": true,
+}
+
+// composeServiceKeys are the service fields of the compose specification
+var composeServiceKeys = map[string]bool{}
+
+func init() {
+	for _, key := range strings.Fields(`annotations attach blkio_config build cap_add cap_drop cgroup
+		cgroup_parent command configs container_name cpu_count cpu_percent cpu_period cpu_quota
+		cpu_rt_period cpu_rt_runtime cpu_shares cpus cpuset credential_spec depends_on deploy develop
+		device_cgroup_rules devices dns dns_opt dns_search domainname driver_opts entrypoint env_file
+		environment expose extends external_links extra_hosts gpus group_add healthcheck hostname
+		image init ipc isolation labels label_file links logging mac_address mem_limit
+		mem_reservation mem_swappiness memswap_limit network_mode networks oom_kill_disable
+		oom_score_adj pid pids_limit platform ports post_start pre_stop privileged profiles
+		pull_policy read_only restart runtime scale secrets security_opt shm_size stdin_open
+		stop_grace_period stop_signal storage_opt sysctls tmpfs tty ulimits user userns_mode uts
+		volumes volumes_from working_dir`) {
+		composeServiceKeys[key] = true
+	}
+}
+
+// errorPosition extracts the position that YAML and loader errors embed
+var errorPosition = regexp.MustCompile(`line (\d+)(?:, column (\d+))?`)
+
+// ValidateComposeProject validates the project in dir. When content is not
+// nil it replaces the file at path (relative to dir) before loading, so an
+// edit can be checked before it is saved. Syntax and schema errors stop
+// validation; semantic checks report every problem found.
+func ValidateComposeProject(dir, file string, content []byte, opts ComposeLoadOptions) apitypes.ComposeValidationResult {
+	l, files, err := newComposeLoader(dir, opts)
+	if err != nil && (l == nil || content == nil || !os.IsNotExist(err)) {
+		return validationFailure(err)
+	}
+
+	if content != nil {
+		path := filepath.Join(dir, file)
+		l.drafts[path] = content
+		found := false
+		for _, f := range files {
+			found = found || f == path
+		}
+		if !found {
+			files = append([]string{path}, files...)
+		}
+	}
+
+	root, err := l.loadModel(files, dir, nil)
+	if err != nil {
+		return validationFailure(err)
+	}
+	config, err := l.decode(root, opts)
+	if err != nil {
+		return validationFailure(err)
+	}
+
+	v := &composeValidator{loader: l}
+	v.validate(root, config)
+
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		a, b := v.errors[i], v.errors[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return apitypes.ComposeValidationResult{Valid: len(v.errors) == 0, Errors: v.errors}
+}
+
+func validationFailure(err error) apitypes.ComposeValidationResult {
+	verr := apitypes.ComposeValidationError{Message: err.Error()}
+	if m := errorPosition.FindStringSubmatch(err.Error()); m != nil {
+		verr.Line, _ = strconv.Atoi(m[1])
+		verr.Column, _ = strconv.Atoi(m[2])
+	}
+	return apitypes.ComposeValidationResult{Errors: []apitypes.ComposeValidationError{verr}}
+}
+
+type composeValidator struct {
+	loader *composeLoader
+	errors []apitypes.ComposeValidationError
+}
+
+func (v *composeValidator) add(node *yaml.Node, path, format string, args ...interface{}) {
+	verr := apitypes.ComposeValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		verr.File = v.loader.sources[node]
+		verr.Line = node.Line
+		verr.Column = node.Column
+	}
+	v.errors = append(v.errors, verr)
+}
+
+func (v *composeValidator) validate(root *yaml.Node, config *apitypes.ComposeConfig) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		if !composeTopLevelKeys[key.Value] && !strings.HasPrefix(key.Value, "x-") {
+			v.add(key, key.Value, "unknown top-level field %s", key.Value)
+		}
+	}
+
+	services := mappingValue(root, "services")
+	if services == nil || len(services.Content) == 0 {
+		v.add(root, "services", "no services defined")
+		return
+	}
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, node := services.Content[i].Value, services.Content[i+1]
+		v.validateService(name, node, config)
+	}
+
+	v.validateDependencies(services, config)
+	v.validatePorts(services, config)
+	v.validateFileObjects(root, "secrets", config.Secrets)
+	v.validateFileObjects(root, "configs", config.Configs)
+}
+
+// validateFileObjects checks that every top-level secret or config has
+// exactly one source
+func (v *composeValidator) validateFileObjects(root *yaml.Node, kind string, defined map[string]apitypes.FileObjectSpec) {
+	objects := mappingValue(root, kind)
+	if objects == nil {
+		return
+	}
+	for i := 0; i+1 < len(objects.Content); i += 2 {
+		name, node := objects.Content[i].Value, objects.Content[i+1]
+		spec := defined[name]
+		sources := 0
+		for _, set := range []bool{spec.File != "", spec.Environment != "", spec.Content != "", spec.External} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			v.add(node, kind+"."+name, "%s %s must have exactly one of file, environment, content and external", strings.TrimSuffix(kind, "s"), name)
+		}
+	}
+}
+
+func (v *composeValidator) validateService(name string, node *yaml.Node, config *apitypes.ComposeConfig) {
+	path := "services." + name
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !composeServiceKeys[key.Value] && !strings.HasPrefix(key.Value, "x-") {
+			v.add(key, path+"."+key.Value, "service %s: unknown field %s", name, key.Value)
+		}
+	}
+
+	spec := config.Services[name]
+	if spec.Image == "" && spec.Build == nil {
+		v.add(node, path, "service %s has neither image nor build", name)
+	}
+
+	switch spec.PullPolicy {
+	case "", apitypes.PullPolicyAlways, apitypes.PullPolicyMissing, apitypes.PullPolicyIfNotPresent, apitypes.PullPolicyNever:
+	case apitypes.PullPolicyBuild:
+		if spec.Build == nil {
+			v.add(mappingValue(node, "pull_policy"), path+".pull_policy", "service %s has pull_policy build but no build section", name)
+		}
+	default:
+		v.add(mappingValue(node, "pull_policy"), path+".pull_policy", "service %s: unknown pull_policy %s", name, spec.PullPolicy)
+	}
+
+	if spec.StopGracePeriod != "" {
+		if _, err := time.ParseDuration(spec.StopGracePeriod); err != nil {
+			v.add(mappingValue(node, "stop_grace_period"), path+".stop_grace_period", "service %s: invalid stop_grace_period %s", name, spec.StopGracePeriod)
+		}
+	}
+
+	deploy := mappingValue(node, "deploy")
+	if _, err := restartPolicy(spec); err != nil {
+		at, field := mappingValue(node, "restart"), "restart"
+		if policy := mappingValue(deploy, "restart_policy"); policy != nil {
+			at, field = policy, "deploy.restart_policy"
+		}
+		v.add(at, path+"."+field, "service %s: %v", name, err)
+	}
+	if spec.Deploy != nil && spec.Deploy.Resources != nil {
+		if err := applyResources(&container.Resources{}, spec.Deploy.Resources); err != nil {
+			v.add(mappingValue(deploy, "resources"), path+".deploy.resources", "service %s: %v", name, err)
+		}
+	}
+	for i, device := range spec.Devices {
+		if _, err := parseDevice(device); err != nil {
+			v.add(mappingValue(node, "devices"), fmt.Sprintf("%s.devices[%d]", path, i), "service %s: %v", name, err)
+		}
+	}
+	if spec.ShmSize != "" {
+		if _, err := units.RAMInBytes(string(spec.ShmSize)); err != nil {
+			v.add(mappingValue(node, "shm_size"), path+".shm_size", "service %s: invalid shm_size %s", name, spec.ShmSize)
+		}
+	}
+	if spec.NetworkMode != "" && len(spec.Networks) > 0 {
+		v.add(mappingValue(node, "network_mode"), path+".network_mode", "service %s: network_mode and networks cannot be combined", name)
+	}
+
+	if networks := mappingValue(node, "networks"); networks != nil {
+		for _, ref := range referenceNodes(networks) {
+			if _, ok := config.Networks[ref.Value]; !ok && ref.Value != "default" {
+				v.add(ref, path+".networks", "service %s uses undefined network %s", name, ref.Value)
+			}
+		}
+	}
+
+	if volumes := mappingValue(node, "volumes"); volumes != nil {
+		for i, item := range volumes.Content {
+			if i >= len(spec.Volumes) {
+				break
+			}
+			vol := spec.Volumes[i]
+			if vol.Type != apitypes.VolumeTypeVolume || vol.Source == "" {
+				continue
+			}
+			if _, ok := config.Volumes[vol.Source]; !ok {
+				v.add(item, fmt.Sprintf("%s.volumes[%d]", path, i), "service %s uses undefined volume %s", name, vol.Source)
+			}
+		}
+	}
+
+	for _, kind := range []string{"secrets", "configs"} {
+		refs := mappingValue(node, kind)
+		if refs == nil {
+			continue
+		}
+		defined := config.Secrets
+		if kind == "configs" {
+			defined = config.Configs
+		}
+		for i, item := range refs.Content {
+			source := item.Value
+			if item.Kind == yaml.MappingNode {
+				if s := mappingValue(item, "source"); s != nil {
+					source = s.Value
+				}
+			}
+			if _, ok := defined[source]; !ok {
+				v.add(item, fmt.Sprintf("%s.%s[%d]", path, kind, i), "service %s uses undefined %s %s", name, strings.TrimSuffix(kind, "s"), source)
+			}
+		}
+	}
+}
+
+// validateDependencies reports references to unknown services and cycles
+func (v *composeValidator) validateDependencies(services *yaml.Node, config *apitypes.ComposeConfig) {
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name := services.Content[i].Value
+		deps := mappingValue(services.Content[i+1], "depends_on")
+		if deps == nil {
+			continue
+		}
+		for _, ref := range referenceNodes(deps) {
+			if dep, ok := config.Services[name].DependsOn[ref.Value]; ok && !dep.Required {
+				continue
+			}
+			if _, ok := config.Services[ref.Value]; !ok {
+				v.add(ref, "services."+name+".depends_on", "service %s depends on undefined service %s", name, ref.Value)
+			}
+		}
+	}
+
+	if _, err := ServiceOrder(config.Services); err != nil {
+		// Point at the depends_on of the first service in the cycle
+		var node *yaml.Node
+		cycle := strings.TrimPrefix(err.Error(), "dependency cycle: ")
+		first, _, _ := strings.Cut(cycle, " -> ")
+		if svc := mappingValue(services, first); svc != nil {
+			node = mappingValue(svc, "depends_on")
+		}
+		v.add(node, "services."+first+".depends_on", "%v", err)
+	}
+}
+
+// publishedPort is a host port claimed by a service
+type publishedPort struct {
+	service string
+	hostIP  string
+	node    *yaml.Node
+}
+
+// validatePorts reports host ports published more than once, including by
+// replicas of the same service
+func (v *composeValidator) validatePorts(services *yaml.Node, config *apitypes.ComposeConfig) {
+	claimed := make(map[string][]publishedPort)
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name := services.Content[i].Value
+		spec := config.Services[name]
+		portsNode := mappingValue(services.Content[i+1], "ports")
+		if portsNode == nil {
+			continue
+		}
+
+		for j, port := range spec.Ports {
+			var node *yaml.Node
+			if j < len(portsNode.Content) {
+				node = portsNode.Content[j]
+			}
+			path := fmt.Sprintf("services.%s.ports[%d]", name, j)
+
+			mappings, err := nat.ParsePortSpec(port)
+			if err != nil {
+				v.add(node, path, "service %s: invalid port %s: %v", name, port, err)
+				continue
+			}
+			for _, m := range mappings {
+				if m.Binding.HostPort == "" {
+					continue
+				}
+				if spec.Deploy != nil && spec.Deploy.Replicas > 1 {
+					v.add(node, path, "service %s publishes host port %s but has %d replicas", name, m.Binding.HostPort, spec.Deploy.Replicas)
+				}
+
+				key := m.Binding.HostPort + "/" + m.Port.Proto()
+				for _, other := range claimed[key] {
+					if hostIPsOverlap(other.hostIP, m.Binding.HostIP) {
+						v.add(node, path, "host port %s is published by both %s and %s", key, other.service, name)
+						break
+					}
+				}
+				claimed[key] = append(claimed[key], publishedPort{service: name, hostIP: m.Binding.HostIP, node: node})
+			}
+		}
+	}
+}
+
+func hostIPsOverlap(a, b string) bool {
+	wildcard := func(ip string) bool { return ip == "" || ip == "0.0.0.0" || ip == "::" }
+	return a == b || wildcard(a) || wildcard(b)
+}
+
+// referenceNodes returns the name nodes of a list or mapping of references,
+// as used by networks and depends_on
+func referenceNodes(node *yaml.Node) []*yaml.Node {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		return node.Content
+	case yaml.MappingNode:
+		refs := make([]*yaml.Node, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			refs = append(refs, node.Content[i])
+		}
+		return refs
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// EventWatcher follows the Docker event stream and fans messages out to
+// subscribers, reconnecting whenever the stream drops.
+type EventWatcher struct {
+	client *client.Client
+
+	mu          sync.RWMutex
+	subscribers []func(events.Message)
+	reconnects  []func()
+}
+
+// NewEventWatcher creates a watcher for the daemon behind the client
+func NewEventWatcher(client *client.Client) *EventWatcher {
+	return &EventWatcher{client: client}
+}
+
+// Subscribe registers a callback invoked for every event in arrival order
+func (w *EventWatcher) Subscribe(fn func(events.Message)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// OnReconnect registers a callback invoked after the stream was
+// re-established, so subscribers can resync state they may have missed.
+func (w *EventWatcher) OnReconnect(fn func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reconnects = append(w.reconnects, fn)
+}
+
+// Run follows the event stream until the context is cancelled
+func (w *EventWatcher) Run(ctx context.Context) {
+	backoff := time.Second
+	first := true
+
+	for {
+		if !first {
+			w.mu.RLock()
+			reconnects := make([]func(), len(w.reconnects))
+			copy(reconnects, w.reconnects)
+			w.mu.RUnlock()
+			for _, fn := range reconnects {
+				fn()
+			}
+		}
+		first = false
+
+		started := time.Now()
+		err := w.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Warning: docker event stream interrupted: %v", err)
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (w *EventWatcher) follow(ctx context.Context) error {
+	msgs, errs := w.client.Events(ctx, events.ListOptions{})
+	for {
+		select {
+		case msg := <-msgs:
+			w.mu.RLock()
+			subscribers := make([]func(events.Message), len(w.subscribers))
+			copy(subscribers, w.subscribers)
+			w.mu.RUnlock()
+			for _, fn := range subscribers {
+				fn(msg)
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
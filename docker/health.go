@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+const (
+	// healthHistoryLimit bounds the transitions kept per container
+	healthHistoryLimit = 100
+
+	// healthHistoryRetention is how long history survives container removal,
+	// so recreated containers can still be investigated afterwards
+	healthHistoryRetention = 24 * time.Hour
+)
+
+// HealthTracker records health status transitions from the event stream
+type HealthTracker struct {
+	client *client.Client
+
+	mu         sync.RWMutex
+	containers map[string]*healthHistory
+}
+
+type healthHistory struct {
+	name        string
+	transitions []apitypes.HealthTransition
+	removed     time.Time
+}
+
+// NewHealthTracker creates an empty tracker
+func NewHealthTracker(client *client.Client) *HealthTracker {
+	return &HealthTracker{
+		client:     client,
+		containers: make(map[string]*healthHistory),
+	}
+}
+
+// HandleEvent records health_status events and container removals
+func (t *HealthTracker) HandleEvent(msg events.Message) {
+	if msg.Type != events.ContainerEventType {
+		return
+	}
+
+	action := string(msg.Action)
+	switch {
+	case strings.HasPrefix(action, "health_status"):
+		status := strings.TrimSpace(strings.TrimPrefix(action, "health_status:"))
+		ts := time.Unix(0, msg.TimeNano)
+		if msg.TimeNano == 0 {
+			ts = time.Unix(msg.Time, 0)
+		}
+		t.record(msg.Actor.ID, msg.Actor.Attributes["name"], status, ts)
+		go t.attachProbe(msg.Actor.ID, status, ts)
+	case msg.Action == events.ActionDestroy:
+		t.mu.Lock()
+		if h, ok := t.containers[msg.Actor.ID]; ok {
+			h.removed = time.Now()
+		}
+		t.mu.Unlock()
+	}
+}
+
+// record stores a transition in event order. The probe that caused it is
+// attached afterwards by attachProbe, so the event stream never waits on
+// an inspect.
+func (t *HealthTracker) record(id, name, status string, ts time.Time) {
+	transition := apitypes.HealthTransition{
+		Time:   ts,
+		Status: status,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.containers[id]
+	if !ok {
+		h = &healthHistory{}
+		t.containers[id] = h
+	}
+	if name != "" {
+		h.name = name
+	}
+	if n := len(h.transitions); n > 0 {
+		transition.Previous = h.transitions[n-1].Status
+	}
+	h.transitions = append(h.transitions, transition)
+	if len(h.transitions) > healthHistoryLimit {
+		h.transitions = h.transitions[len(h.transitions)-healthHistoryLimit:]
+	}
+
+	t.pruneLocked()
+}
+
+// attachProbe fills in the failing streak and last probe output of a
+// recorded transition
+func (t *HealthTracker) attachProbe(id, status string, ts time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inspect, err := t.client.ContainerInspect(ctx, id)
+	if err != nil || inspect.State == nil || inspect.State.Health == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.containers[id]
+	if !ok {
+		return
+	}
+	for i := len(h.transitions) - 1; i >= 0; i-- {
+		transition := &h.transitions[i]
+		if !transition.Time.Equal(ts) || transition.Status != status {
+			continue
+		}
+		transition.FailingStreak = inspect.State.Health.FailingStreak
+		if probes := inspect.State.Health.Log; len(probes) > 0 {
+			last := probes[len(probes)-1]
+			transition.ExitCode = last.ExitCode
+			transition.Output = last.Output
+		}
+		return
+	}
+}
+
+// History returns the recorded transitions for a container, oldest first.
+// The container may be given by ID, ID prefix or name; a name also covers
+// earlier containers of the same name that have since been recreated.
+func (t *HealthTracker) History(container string) []apitypes.HealthTransition {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if h, ok := t.containers[container]; ok {
+		return append([]apitypes.HealthTransition{}, h.transitions...)
+	}
+
+	name := strings.TrimPrefix(container, "/")
+	result := make([]apitypes.HealthTransition, 0)
+	for id, h := range t.containers {
+		if h.name == name || (len(container) >= 12 && strings.HasPrefix(id, container)) {
+			result = append(result, h.transitions...)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
+}
+
+func (t *HealthTracker) pruneLocked() {
+	cutoff := time.Now().Add(-healthHistoryRetention)
+	for id, h := range t.containers {
+		if !h.removed.IsZero() && h.removed.Before(cutoff) {
+			delete(t.containers, id)
+		}
+	}
+}
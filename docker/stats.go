@@ -0,0 +1,324 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	apitypes "kibutsu/api/types"
+)
+
+// statsConcurrency bounds the number of stats requests in flight per round
+const statsConcurrency = 8
+
+// infoTimeout bounds the daemon info request of a round, which runs after
+// the stats requests and must not share their deadline
+const infoTimeout = 10 * time.Second
+
+// ContainerSample is a point-in-time resource reading for one container
+type ContainerSample struct {
+	ID      string
+	Name    string
+	Image   string
+	Project string
+	Service string
+	Stats   apitypes.ContainerStats
+}
+
+// HostSample is a point-in-time reading of daemon-wide totals
+type HostSample struct {
+	Time              time.Time
+	NCPU              int
+	MemTotal          int64
+	CPUPercent        float64
+	MemoryUsage       uint64
+	Containers        int
+	ContainersRunning int
+	ContainersPaused  int
+	ContainersStopped int
+	Images            int
+}
+
+// StatsCollector periodically samples resource usage of all running containers
+type StatsCollector struct {
+	client   *client.Client
+	interval time.Duration
+
+	mu            sync.RWMutex
+	samples       []ContainerSample
+	previousCPU   map[string]container.CPUStats
+	host          HostSample
+	observers     []func([]ContainerSample)
+	hostObservers []func(HostSample)
+}
+
+// NewStatsCollector creates a collector sampling at the given interval
+func NewStatsCollector(client *client.Client, interval time.Duration) *StatsCollector {
+	return &StatsCollector{
+		client:   client,
+		interval: interval,
+	}
+}
+
+// OnSample registers a callback invoked with every completed sampling round
+func (c *StatsCollector) OnSample(fn func([]ContainerSample)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observers = append(c.observers, fn)
+}
+
+// OnHostSample registers a callback invoked with the host totals of every round
+func (c *StatsCollector) OnHostSample(fn func(HostSample)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hostObservers = append(c.hostObservers, fn)
+}
+
+// Interval returns the sampling interval
+func (c *StatsCollector) Interval() time.Duration {
+	return c.interval
+}
+
+// Host returns the host totals of the most recent sampling round
+func (c *StatsCollector) Host() HostSample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.host
+}
+
+// Samples returns the most recent sampling round
+func (c *StatsCollector) Samples() []ContainerSample {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ContainerSample(nil), c.samples...)
+}
+
+// Run samples until the context is cancelled
+func (c *StatsCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.collect(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect runs one sampling round. Stats are read one-shot, without the
+// daemon waiting for a second reading, and CPU usage is computed against
+// the reading of the previous round. A container whose read fails keeps
+// its last sample rather than dropping out of the round.
+func (c *StatsCollector) collect(parent context.Context) {
+	ctx, cancel := context.WithTimeout(parent, c.interval)
+	defer cancel()
+
+	containers, err := c.client.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		log.Printf("Warning: stats collector failed to list containers: %v", err)
+		return
+	}
+
+	c.mu.RLock()
+	last := make(map[string]ContainerSample, len(c.samples))
+	for _, s := range c.samples {
+		last[s.ID] = s
+	}
+	previousCPU := c.previousCPU
+	c.mu.RUnlock()
+
+	samples := make([]ContainerSample, len(containers))
+	ok := make([]bool, len(containers))
+	cpu := make([]*container.CPUStats, len(containers))
+	sem := make(chan struct{}, statsConcurrency)
+	var wg sync.WaitGroup
+
+	for i, ctr := range containers {
+		wg.Add(1)
+		go func(i int, id string, previous *container.CPUStats) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			stats, current, err := c.readStats(ctx, id, previous)
+			if err != nil {
+				if s, found := last[id]; found {
+					samples[i].Stats = s.Stats
+					ok[i] = true
+				}
+				return
+			}
+			samples[i].Stats = stats
+			cpu[i] = &current
+			ok[i] = true
+		}(i, ctr.ID, cpuOf(previousCPU, ctr.ID))
+
+		name := ctr.ID
+		if len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		samples[i].ID = ctr.ID
+		samples[i].Name = name
+		samples[i].Image = ctr.Image
+		samples[i].Project = ctr.Labels["com.docker.compose.project"]
+		samples[i].Service = ctr.Labels["com.docker.compose.service"]
+	}
+	wg.Wait()
+
+	result := make([]ContainerSample, 0, len(samples))
+	host := HostSample{Time: time.Now()}
+	for i, s := range samples {
+		if ok[i] {
+			result = append(result, s)
+			host.CPUPercent += s.Stats.CPU.UsagePercent
+			host.MemoryUsage += s.Stats.Memory.Usage
+		}
+	}
+
+	nextCPU := make(map[string]container.CPUStats, len(containers))
+	for i, ctr := range containers {
+		if cpu[i] != nil {
+			nextCPU[ctr.ID] = *cpu[i]
+		} else if previous, found := previousCPU[ctr.ID]; found {
+			nextCPU[ctr.ID] = previous
+		}
+	}
+
+	infoCtx, cancelInfo := context.WithTimeout(parent, infoTimeout)
+	defer cancelInfo()
+
+	hostOK := false
+	if info, err := c.client.Info(infoCtx); err != nil {
+		log.Printf("Warning: stats collector failed to get system info: %v", err)
+	} else {
+		host.NCPU = info.NCPU
+		host.MemTotal = info.MemTotal
+		host.Containers = info.Containers
+		host.ContainersRunning = info.ContainersRunning
+		host.ContainersPaused = info.ContainersPaused
+		host.ContainersStopped = info.ContainersStopped
+		host.Images = info.Images
+		hostOK = true
+	}
+
+	c.mu.Lock()
+	c.samples = result
+	c.previousCPU = nextCPU
+	if hostOK {
+		c.host = host
+	}
+	observers := make([]func([]ContainerSample), len(c.observers))
+	copy(observers, c.observers)
+	hostObservers := make([]func(HostSample), len(c.hostObservers))
+	copy(hostObservers, c.hostObservers)
+	c.mu.Unlock()
+
+	for _, fn := range observers {
+		fn(result)
+	}
+	if hostOK {
+		for _, fn := range hostObservers {
+			fn(host)
+		}
+	}
+}
+
+// readStats reads the stats of a container once, computing CPU usage
+// against the previous reading when there is one, and returns the CPU
+// reading for the next round
+func (c *StatsCollector) readStats(ctx context.Context, id string, previous *container.CPUStats) (apitypes.ContainerStats, container.CPUStats, error) {
+	resp, err := c.client.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return apitypes.ContainerStats{}, container.CPUStats{}, err
+	}
+	defer resp.Body.Close()
+
+	var raw container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return apitypes.ContainerStats{}, container.CPUStats{}, err
+	}
+	if previous == nil {
+		// The first reading has nothing to compare against; a delta from
+		// zero would report the average since the container started
+		stats := ConvertStats(raw)
+		stats.CPU.UsagePercent = 0
+		return stats, raw.CPUStats, nil
+	}
+	raw.PreCPUStats = *previous
+	return ConvertStats(raw), raw.CPUStats, nil
+}
+
+func cpuOf(readings map[string]container.CPUStats, id string) *container.CPUStats {
+	if cpu, ok := readings[id]; ok {
+		return &cpu
+	}
+	return nil
+}
+
+// ConvertStats reduces a raw Docker stats payload to the API representation,
+// computing CPU and memory percentages the same way the docker CLI does.
+func ConvertStats(raw container.StatsResponse) apitypes.ContainerStats {
+	var stats apitypes.ContainerStats
+
+	cpuDelta := float64(raw.CPUStats.CPUUsage.TotalUsage) - float64(raw.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(raw.CPUStats.SystemUsage) - float64(raw.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(raw.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(raw.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPU.UsagePercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+	stats.CPU.SystemUsage = raw.CPUStats.CPUUsage.UsageInKernelmode
+	stats.CPU.UserUsage = raw.CPUStats.CPUUsage.UsageInUsermode
+
+	// cgroup v2 reports page cache as inactive_file, v1 as total_inactive_file
+	cache := raw.MemoryStats.Stats["inactive_file"]
+	if v, ok := raw.MemoryStats.Stats["total_inactive_file"]; ok {
+		cache = v
+	}
+	usage := raw.MemoryStats.Usage
+	if cache < usage {
+		usage -= cache
+	}
+	stats.Memory.Usage = usage
+	stats.Memory.Limit = raw.MemoryStats.Limit
+	stats.Memory.Cache = cache
+	stats.Memory.RSS = raw.MemoryStats.Stats["rss"]
+	if v, ok := raw.MemoryStats.Stats["anon"]; ok {
+		stats.Memory.RSS = v
+	}
+	if raw.MemoryStats.Limit > 0 {
+		stats.Memory.Percent = float64(usage) / float64(raw.MemoryStats.Limit) * 100
+	}
+
+	for _, n := range raw.Networks {
+		stats.Network.RxBytes += n.RxBytes
+		stats.Network.TxBytes += n.TxBytes
+		stats.Network.RxPackets += n.RxPackets
+		stats.Network.TxPackets += n.TxPackets
+	}
+
+	for _, entry := range raw.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			stats.BlockIO.Read += entry.Value
+		case "write":
+			stats.BlockIO.Write += entry.Value
+		}
+	}
+
+	stats.PIDs = int(raw.PidsStats.Current)
+	stats.ReadTime = raw.Read
+	return stats
+}
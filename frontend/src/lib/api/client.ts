@@ -1,4 +1,4 @@
-import type { Container, Image, ComposeProject, SystemInfo, DiskUsage } from '../types/docker';
+import type { Container, Image, ComposeProject, ComposeOperation, ComposeRun, ComposeRunRequest, ComposeService, ComposeTemplate, TemplateDeployRequest, TemplateDeployment, SystemInfo, DiskUsage } from '../types/docker';
 
 const API_BASE = '/api';
 const getWsUrl = () => {
@@ -82,6 +82,10 @@ export class DockerClient {
     await this.fetch(`/containers/${id}/restart`, { method: 'POST' });
   }
 
+  async exportCompose(ids: string[]): Promise<string> {
+    return this.fetch(`/containers/export-compose?ids=${ids.map(encodeURIComponent).join(',')}`).then(r => r.text());
+  }
+
   // Image operations
   async getImages(): Promise<Image[]> {
     return this.fetch('/images').then(r => r.json());
@@ -99,25 +103,104 @@ export class DockerClient {
     return this.fetch('/compose/projects').then(r => r.json());
   }
 
-  async composeUp(project: string): Promise<ReadableStream> {
-    const response = await this.fetch(`/compose/projects/${project}/up`, {
+  async composeUp(project: string, activeProfiles: string[] = []): Promise<ComposeOperation> {
+    const query = activeProfiles.length ? `?activeProfiles=${encodeURIComponent(activeProfiles.join(','))}` : '';
+    return this.fetch(`/compose/projects/${project}/up${query}`, {
       method: 'POST'
-    });
-    return response.body!;
+    }).then(r => r.json());
   }
 
-  async composeDown(project: string): Promise<void> {
-    await this.fetch(`/compose/projects/${project}/down`, {
+  async composeDown(
+    project: string,
+    options: {
+      volumes?: boolean;
+      rmi?: 'all' | 'local';
+      removeOrphans?: boolean;
+      timeout?: string;
+      activeProfiles?: string[];
+    } = {}
+  ): Promise<ComposeOperation> {
+    const params = new URLSearchParams();
+    if (options.volumes) params.set('volumes', 'true');
+    if (options.rmi) params.set('rmi', options.rmi);
+    if (options.removeOrphans) params.set('removeOrphans', 'true');
+    if (options.timeout) params.set('timeout', options.timeout);
+    if (options.activeProfiles?.length) params.set('activeProfiles', options.activeProfiles.join(','));
+    const query = params.toString() ? `?${params}` : '';
+    return this.fetch(`/compose/projects/${project}/down${query}`, {
       method: 'POST'
-    });
+    }).then(r => r.json());
+  }
+
+  async composeRestart(project: string): Promise<ComposeOperation> {
+    return this.fetch(`/compose/projects/${project}/restart`, {
+      method: 'POST'
+    }).then(r => r.json());
   }
 
-  async scaleService(project: string, service: string, replicas: number): Promise<void> {
-    await this.fetch(`/compose/projects/${project}/services/${service}/scale`, {
+  async scaleService(project: string, service: string, replicas: number): Promise<ComposeOperation> {
+    return this.fetch(`/compose/projects/${project}/services/${service}/scale`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify({ replicas })
-    });
+    }).then(r => r.json());
+  }
+
+  async getComposeServices(project: string): Promise<ComposeService[]> {
+    return this.fetch(`/compose/projects/${project}/services`).then(r => r.json());
+  }
+
+  async composeServiceAction(
+    project: string,
+    service: string,
+    action: 'start' | 'stop' | 'restart' | 'recreate' | 'kill' | 'pause' | 'unpause',
+    cascade = false
+  ): Promise<ComposeOperation> {
+    const query = cascade ? '?cascade=true' : '';
+    return this.fetch(`/compose/projects/${project}/services/${service}/${action}${query}`, {
+      method: 'POST'
+    }).then(r => r.json());
+  }
+
+  async composeExport(project: string): Promise<string> {
+    return this.fetch(`/compose/projects/${project}/export`).then(r => r.text());
+  }
+
+  async composeRun(project: string, service: string, request: ComposeRunRequest = {}): Promise<ComposeRun> {
+    return this.fetch(`/compose/projects/${project}/services/${service}/run`, {
+      method: 'POST',
+      body: JSON.stringify(request)
+    }).then(r => r.json());
+  }
+
+  composeRunAttach(run: ComposeRun): WebSocket | null {
+    const url = getWsUrl();
+    return url ? new WebSocket(`${url}${run.attach.replace(/^\/api/, '')}`) : null;
+  }
+
+  async getComposeOperation(id: string): Promise<ComposeOperation> {
+    return this.fetch(`/compose/operations/${id}`).then(r => r.json());
+  }
+
+  async cancelComposeOperation(id: string): Promise<ComposeOperation> {
+    return this.fetch(`/compose/operations/${id}`, { method: 'DELETE' }).then(r => r.json());
+  }
+
+  composeOperationEvents(id: string): WebSocket | null {
+    const url = getWsUrl();
+    return url ? new WebSocket(`${url}/compose/operations/${id}/events`) : null;
+  }
+
+  // Templates
+  async getTemplates(): Promise<ComposeTemplate[]> {
+    return this.fetch('/templates').then(r => r.json());
+  }
+
+  async deployTemplate(name: string, request: TemplateDeployRequest): Promise<ComposeOperation | TemplateDeployment> {
+    return this.fetch(`/templates/${name}/deploy`, {
+      method: 'POST',
+      body: JSON.stringify(request)
+    }).then(r => r.json());
   }
 
   // System operations
@@ -26,11 +26,135 @@ export interface Image {
   VirtualSize: number;
 }
 
+export interface ComposeDrift {
+  kind: 'missing' | 'orphaned' | 'image' | 'replicas' | 'config' | 'modified' | 'working_dir' | 'config_files';
+  service?: string;
+  message: string;
+}
+
 export interface ComposeProject {
   name: string;
   path: string;
-  status: 'running' | 'stopped' | 'partial';
+  configFiles?: string[];
+  sources: ('store' | 'directory' | 'labels' | 'containers')[];
+  managed: boolean;
+  status: 'running' | 'stopped' | 'partial' | 'not_created';
   services: string[];
+  drift: ComposeDrift[];
+  error?: string;
+}
+
+export interface ComposeService {
+  name: string;
+  image: string;
+  status: 'not_created' | 'running' | 'partial' | 'paused' | 'restarting' | 'stopped';
+  replicas: number;
+  desiredReplicas: number;
+  ports: ComposePortMapping[];
+  environment: Record<string, string>;
+  dependencies: string[];
+  dependents: string[];
+  containers: { id: string; name: string; image: string; status: string; state: string; ports: ComposePortMapping[] }[];
+}
+
+export interface ComposePortMapping {
+  hostIp: string;
+  hostPort: number;
+  containerPort: number;
+  protocol: string;
+}
+
+export interface ComposeProgress {
+  time: string;
+  service?: string;
+  container?: string;
+  step: string;
+  message?: string;
+}
+
+export interface ComposeOperation {
+  id: string;
+  type: 'up' | 'down' | 'scale' | 'pull' | 'restart' | 'update';
+  project: string;
+  service?: string;
+  status: 'running' | 'succeeded' | 'failed' | 'cancelled';
+  startTime: string;
+  endTime?: string;
+  error?: string;
+  services: Record<string, string>;
+  progress: ComposeProgress[];
+  result?: unknown;
+}
+
+export interface ComposeResourceResult {
+  kind: 'container' | 'network' | 'volume' | 'image';
+  name: string;
+  service?: string;
+  message?: string;
+}
+
+export interface ComposeDownReport {
+  removed: ComposeResourceResult[];
+  skipped: ComposeResourceResult[];
+  failed: ComposeResourceResult[];
+}
+
+export interface ComposeRunRequest {
+  command?: string[];
+  entrypoint?: string[];
+  environment?: Record<string, string>;
+  user?: string;
+  workingDir?: string;
+  tty?: boolean;
+  remove?: boolean;
+  noDeps?: boolean;
+}
+
+export interface ComposeRun {
+  id: string;
+  name: string;
+  project: string;
+  service: string;
+  tty: boolean;
+  remove: boolean;
+  attach: string;
+}
+
+export interface TemplateInput {
+  name: string;
+  label?: string;
+  description?: string;
+  type: 'string' | 'password' | 'integer' | 'number' | 'boolean' | 'port' | 'enum';
+  default?: string;
+  required?: boolean;
+  options?: string[];
+  pattern?: string;
+  min?: number;
+  max?: number;
+  generate?: boolean;
+}
+
+export interface ComposeTemplate {
+  name: string;
+  title: string;
+  description?: string;
+  category?: string;
+  version?: string;
+  inputs: TemplateInput[];
+  services: string[];
+  files: string[];
+}
+
+export interface TemplateDeployRequest {
+  project: string;
+  inputs?: Record<string, string | number | boolean>;
+  up?: boolean;
+}
+
+export interface TemplateDeployment {
+  project: string;
+  template: string;
+  files: string[];
 }
 
 export interface SystemInfo {
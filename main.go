@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"embed"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,7 +22,10 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 
+	"kibutsu/alerting"
 	"kibutsu/api/handlers"
+	"kibutsu/docker"
+	"kibutsu/metrics"
 )
 
 //go:embed frontend/build/*
@@ -54,6 +62,72 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Hijack lets WebSocket handlers take over the connection through the
+// middleware chain.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	rw.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// collectionSegments are path segments whose following segment is an
+// identifier rather than a fixed route.
+var collectionSegments = map[string]bool{
+	"containers": true,
+	"images":     true,
+	"projects":   true,
+	"services":   true,
+	"history":    true,
+	"operations": true,
+	"templates":  true,
+	"run":        true,
+	"silences":   true,
+}
+
+// fixedSegments are routes that live directly under a collection.
+var fixedSegments = map[string]bool{
+	"pull":           true,
+	"export-compose": true,
+}
+
+// routeLabel collapses a request path into a route template so that
+// container IDs and project names don't explode metric cardinality.
+func routeLabel(path string) string {
+	if !strings.HasPrefix(path, "/api/") {
+		if path == "/health" || path == "/metrics" {
+			return path
+		}
+		return "/"
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	// Image references may contain slashes, so everything after images/
+	// is one identifier but for the history suffix
+	if len(parts) > 2 && parts[1] == "images" && !fixedSegments[parts[2]] {
+		if len(parts) > 3 && parts[len(parts)-1] == "history" {
+			return "/api/images/:image/history"
+		}
+		return "/api/images/:image"
+	}
+
+	for i := 1; i < len(parts); i++ {
+		if collectionSegments[parts[i-1]] && !fixedSegments[parts[i]] {
+			parts[i] = ":" + strings.TrimSuffix(parts[i-1], "s")
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
 func requestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		requestID := r.Header.Get("X-Request-ID")
@@ -73,6 +147,10 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 		next.ServeHTTP(rw, r)
 
+		route := routeLabel(r.URL.Path)
+		metrics.HTTPRequestsTotal.Inc(r.Method, route, strconv.Itoa(rw.status))
+		metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), r.Method, route)
+
 		log.Printf(
 			"[%s] %s %s %d %s",
 			r.Context().Value(requestIDKey),
@@ -110,7 +188,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Next-Cursor, X-Total-Count, ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -162,21 +241,89 @@ func main() {
 	log.Println("Successfully connected to Docker daemon")
 
 	app := &App{dockerClient: dockerClient}
-	containerHandler := handlers.NewContainerHandler(dockerClient)
-	imageHandler := handlers.NewImageHandler(dockerClient)
-	composeHandler := handlers.NewComposeHandler(dockerClient)
+
+	collectorCtx, stopCollector := context.WithCancel(context.Background())
+	defer stopCollector()
+
+	statsCollector := docker.NewStatsCollector(dockerClient, 15*time.Second)
+	statsCollector.OnSample(metrics.ObserveContainers)
+
+	metricsStore := metrics.NewStore(statsCollector.Interval())
+	statsCollector.OnSample(metricsStore.ObserveContainers)
+	statsCollector.OnHostSample(metricsStore.ObserveHost)
+
+	alertsPath := os.Getenv("KIBUTSU_ALERTS_CONFIG")
+	if alertsPath == "" {
+		alertsPath = "alerts.json"
+	}
+	alertConfig, err := alerting.LoadConfig(alertsPath)
+	if err != nil {
+		log.Fatalf("Failed to load alerting config: %v", err)
+	}
+	alertEngine, err := alerting.NewEngine(dockerClient, alertConfig)
+	if err != nil {
+		log.Fatalf("Invalid alerting config: %v", err)
+	}
+	statsCollector.OnSample(alertEngine.ObserveContainers)
+
+	eventWatcher := docker.NewEventWatcher(dockerClient)
+	eventWatcher.Subscribe(alertEngine.HandleEvent)
+
+	healthTracker := docker.NewHealthTracker(dockerClient)
+	eventWatcher.Subscribe(healthTracker.HandleEvent)
+
+	stateCache := docker.NewStateCache(dockerClient, 5*time.Minute)
+	eventWatcher.Subscribe(stateCache.HandleEvent)
+	eventWatcher.OnReconnect(stateCache.Invalidate)
+
+	go statsCollector.Run(collectorCtx)
+	go eventWatcher.Run(collectorCtx)
+	go stateCache.Run(collectorCtx)
+	go alertEngine.Run(collectorCtx)
+
+	composeDir := os.Getenv("KIBUTSU_COMPOSE_DIR")
+	if composeDir == "" {
+		composeDir = "compose"
+	}
+	composeStore := docker.NewComposeStore(composeDir)
+
+	var composeRoots []string
+	for _, root := range filepath.SplitList(os.Getenv("KIBUTSU_COMPOSE_ROOTS")) {
+		if root != "" {
+			composeRoots = append(composeRoots, root)
+		}
+	}
+	templatesDir := os.Getenv("KIBUTSU_TEMPLATES_DIR")
+	if templatesDir == "" {
+		templatesDir = "templates"
+	}
+
+	projectCatalog := docker.NewProjectCatalog(dockerClient, stateCache, composeStore, composeRoots)
+	composeOperations := docker.NewOperationManager()
+
+	containerHandler := handlers.NewContainerHandler(dockerClient, healthTracker, stateCache)
+	terminalHandler := handlers.NewTerminalHandler(dockerClient)
+	imageHandler := handlers.NewImageHandler(dockerClient, stateCache)
+	composeHandler := handlers.NewComposeHandler(dockerClient, composeStore, projectCatalog, composeOperations)
+	templateHandler := handlers.NewTemplateHandler(docker.NewTemplateStore(templatesDir), composeHandler)
+	metricsHandler := handlers.NewMetricsHandler(metricsStore)
+	alertHandler := handlers.NewAlertHandler(alertEngine)
 
 	mux := http.NewServeMux()
 
 	// Health check endpoint
 	mux.HandleFunc("/health", app.healthHandler)
 
+	// Prometheus scrape endpoint
+	mux.Handle("/metrics", metrics.Default)
+
 	// API routes
 	apiRouter := http.NewServeMux()
 	apiRouter.HandleFunc("/docker/info", app.dockerInfoHandler)
 
 	// Container endpoints
 	apiRouter.HandleFunc("/containers", containerHandler.ListContainers)
+	apiRouter.HandleFunc("/containers/export-compose", containerHandler.ExportCompose)
 	apiRouter.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/containers/")
 		parts := strings.Split(path, "/")
@@ -197,6 +344,10 @@ func main() {
 			containerHandler.GetContainerLogs(w, r)
 		case "stats":
 			containerHandler.GetContainerStats(w, r)
+		case "exec":
+			terminalHandler.HandleTerminal(w, r)
+		case "health":
+			containerHandler.GetContainerHealth(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -224,6 +375,32 @@ func main() {
 		}
 	})
 
+	// Historical metrics endpoints
+	apiRouter.HandleFunc("/metrics/query", metricsHandler.Query)
+	apiRouter.HandleFunc("/metrics/series", metricsHandler.ListSeries)
+
+	// Alerting endpoints
+	apiRouter.HandleFunc("/alerts", alertHandler.ListAlerts)
+	apiRouter.HandleFunc("/alerts/history", alertHandler.ListHistory)
+	apiRouter.HandleFunc("/alerts/rules", alertHandler.ListRules)
+	apiRouter.HandleFunc("/alerts/silences", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			alertHandler.ListSilences(w, r)
+		case http.MethodPost:
+			alertHandler.CreateSilence(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	apiRouter.HandleFunc("/alerts/silences/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.NotFound(w, r)
+			return
+		}
+		alertHandler.DeleteSilence(w, r)
+	})
+
 	// Compose endpoints
 	apiRouter.HandleFunc("/compose/projects/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/compose/projects/")
@@ -237,12 +414,21 @@ func main() {
 			}
 		}
 
-		// If only the project name is provided, return project details.
+		// If only the project name is provided, manage the project definition.
 		if len(parts) == 1 {
-			if r.Method == http.MethodGet {
+			switch r.Method {
+			case http.MethodGet:
 				composeHandler.GetProject(w, r)
-				return
+			case http.MethodPost:
+				composeHandler.CreateProject(w, r)
+			case http.MethodPut:
+				composeHandler.UpdateProject(w, r)
+			case http.MethodDelete:
+				composeHandler.DeleteProject(w, r)
+			default:
+				http.NotFound(w, r)
 			}
+			return
 		}
 
 		// Otherwise route based on an action provided in the URL.
@@ -260,11 +446,49 @@ func main() {
 				composeHandler.ProjectDown(w, r)
 				return
 			}
+		case "restart":
+			if r.Method == http.MethodPost {
+				composeHandler.ProjectRestart(w, r)
+				return
+			}
+		case "pull":
+			if r.Method == http.MethodPost {
+				composeHandler.ProjectPull(w, r)
+				return
+			}
 		case "logs":
 			if r.Method == http.MethodGet {
 				composeHandler.GetProjectLogs(w, r)
 				return
 			}
+		case "config":
+			if r.Method == http.MethodGet {
+				composeHandler.GetProjectConfig(w, r)
+				return
+			}
+		case "merged":
+			if r.Method == http.MethodGet {
+				composeHandler.GetMergedConfig(w, r)
+				return
+			}
+		case "export":
+			if r.Method == http.MethodGet {
+				composeHandler.ExportProject(w, r)
+				return
+			}
+		case "validate":
+			if r.Method == http.MethodPost {
+				composeHandler.ValidateProject(w, r)
+				return
+			}
+		case "history":
+			if len(parts) == 2 && r.Method == http.MethodGet {
+				composeHandler.ListHistory(w, r)
+				return
+			} else if len(parts) == 3 && r.Method == http.MethodGet {
+				composeHandler.GetVersion(w, r)
+				return
+			}
 		case "services":
 			// GET /compose/projects/{project}/services to list service details.
 			if len(parts) == 2 && r.Method == http.MethodGet {
@@ -274,11 +498,70 @@ func main() {
 				// Expected URL: /compose/projects/{project}/services/{service}/scale
 				composeHandler.ScaleService(w, r)
 				return
+			} else if len(parts) == 4 && parts[3] == "update" && r.Method == http.MethodPost {
+				// Expected URL: /compose/projects/{project}/services/{service}/update
+				composeHandler.UpdateService(w, r)
+				return
+			} else if len(parts) == 4 && parts[3] == "run" && r.Method == http.MethodPost {
+				// Expected URL: /compose/projects/{project}/services/{service}/run
+				composeHandler.RunService(w, r)
+				return
+			} else if len(parts) == 5 && parts[3] == "run" && r.Method == http.MethodGet {
+				// WebSocket: /compose/projects/{project}/services/{service}/run/{id}
+				composeHandler.AttachRun(w, r)
+				return
+			} else if len(parts) == 4 && docker.IsServiceAction(parts[3]) && r.Method == http.MethodPost {
+				// Expected URL: /compose/projects/{project}/services/{service}/{action}
+				composeHandler.ServiceAction(w, r)
+				return
 			}
 		}
 		http.NotFound(w, r)
 	})
 
+	// Compose operations run in the background and are polled, streamed
+	// over WebSocket or cancelled by ID
+	apiRouter.HandleFunc("/compose/operations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		composeHandler.ListOperations(w, r)
+	})
+	apiRouter.HandleFunc("/compose/operations/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compose/operations/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodGet:
+			composeHandler.GetOperation(w, r)
+		case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodDelete:
+			composeHandler.CancelOperation(w, r)
+		case len(parts) == 2 && parts[1] == "events" && r.Method == http.MethodGet:
+			composeHandler.OperationEvents(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// Template endpoints
+	apiRouter.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		templateHandler.ListTemplates(w, r)
+	})
+	apiRouter.HandleFunc("/templates/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/templates/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] != "" && r.Method == http.MethodGet:
+			templateHandler.GetTemplate(w, r)
+		case len(parts) == 2 && parts[1] == "deploy" && r.Method == http.MethodPost:
+			templateHandler.DeployTemplate(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
 	// Mount API router under /api
 	mux.Handle("/api/", http.StripPrefix("/api", apiRouter))
 
@@ -322,6 +605,7 @@ func main() {
 	<-quit
 
 	log.Println("Shutting down server...")
+	stopCollector()
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
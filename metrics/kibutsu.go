@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+
+	"kibutsu/docker"
+)
+
+// Service-level metrics exported by Kibutsu itself
+var (
+	HTTPRequestsTotal = Default.NewCounterVec(
+		"kibutsu_http_requests_total",
+		"Total HTTP requests handled, by method, route and status code.",
+		"method", "route", "code",
+	)
+	HTTPRequestDuration = Default.NewHistogramVec(
+		"kibutsu_http_request_duration_seconds",
+		"HTTP request latency in seconds, by method and route.",
+		DefBuckets,
+		"method", "route",
+	)
+	WebSocketConnections = Default.NewGaugeVec(
+		"kibutsu_websocket_connections",
+		"Currently open WebSocket connections, by endpoint.",
+		"endpoint",
+	)
+	ExecSessions = Default.NewGaugeVec(
+		"kibutsu_exec_sessions",
+		"Currently attached container exec sessions.",
+	)
+)
+
+// Per-container resource gauges fed by the stats collector
+var (
+	containerLabels = []string{"name", "image", "compose_project", "compose_service"}
+
+	containerCPU = Default.NewGaugeVec(
+		"kibutsu_container_cpu_usage_percent",
+		"Container CPU usage as a percentage of one core.",
+		containerLabels...,
+	)
+	containerMemoryUsage = Default.NewGaugeVec(
+		"kibutsu_container_memory_usage_bytes",
+		"Container memory usage excluding page cache.",
+		containerLabels...,
+	)
+	containerMemoryLimit = Default.NewGaugeVec(
+		"kibutsu_container_memory_limit_bytes",
+		"Container memory limit.",
+		containerLabels...,
+	)
+	containerNetworkRx = Default.NewGaugeVec(
+		"kibutsu_container_network_receive_bytes",
+		"Bytes received across all container networks since start.",
+		containerLabels...,
+	)
+	containerNetworkTx = Default.NewGaugeVec(
+		"kibutsu_container_network_transmit_bytes",
+		"Bytes transmitted across all container networks since start.",
+		containerLabels...,
+	)
+	containerBlkioRead = Default.NewGaugeVec(
+		"kibutsu_container_blkio_read_bytes",
+		"Bytes read from block devices since start.",
+		containerLabels...,
+	)
+	containerBlkioWrite = Default.NewGaugeVec(
+		"kibutsu_container_blkio_write_bytes",
+		"Bytes written to block devices since start.",
+		containerLabels...,
+	)
+	containerPIDs = Default.NewGaugeVec(
+		"kibutsu_container_pids",
+		"Number of processes in the container.",
+		containerLabels...,
+	)
+
+	containerGauges = []*GaugeVec{
+		containerCPU, containerMemoryUsage, containerMemoryLimit,
+		containerNetworkRx, containerNetworkTx,
+		containerBlkioRead, containerBlkioWrite, containerPIDs,
+	}
+
+	containerSeriesMu sync.Mutex
+	containerSeries   = make(map[string][]string)
+)
+
+// ObserveContainers publishes a sampling round as container gauges and drops
+// series for containers that are no longer running.
+func ObserveContainers(samples []docker.ContainerSample) {
+	containerSeriesMu.Lock()
+	defer containerSeriesMu.Unlock()
+
+	current := make(map[string][]string, len(samples))
+	live := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		labels := []string{s.Name, s.Image, s.Project, s.Service}
+		current[s.ID] = labels
+		live[strings.Join(labels, "\x00")] = true
+
+		containerCPU.Set(s.Stats.CPU.UsagePercent, labels...)
+		containerMemoryUsage.Set(float64(s.Stats.Memory.Usage), labels...)
+		containerMemoryLimit.Set(float64(s.Stats.Memory.Limit), labels...)
+		containerNetworkRx.Set(float64(s.Stats.Network.RxBytes), labels...)
+		containerNetworkTx.Set(float64(s.Stats.Network.TxBytes), labels...)
+		containerBlkioRead.Set(float64(s.Stats.BlockIO.Read), labels...)
+		containerBlkioWrite.Set(float64(s.Stats.BlockIO.Write), labels...)
+		containerPIDs.Set(float64(s.Stats.PIDs), labels...)
+	}
+
+	// A container recreated with the same name, image, project and service
+	// shares its series with the one it replaced
+	for _, labels := range containerSeries {
+		if live[strings.Join(labels, "\x00")] {
+			continue
+		}
+		for _, g := range containerGauges {
+			g.Delete(labels...)
+		}
+	}
+	containerSeries = current
+}
@@ -0,0 +1,392 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apitypes "kibutsu/api/types"
+	"kibutsu/docker"
+)
+
+// HostSeries is the pseudo-container under which daemon-wide totals are stored
+const HostSeries = "host"
+
+// Metric names recorded for every container
+const (
+	MetricCPUPercent    = "cpu_percent"
+	MetricMemoryUsage   = "memory_usage"
+	MetricMemoryLimit   = "memory_limit"
+	MetricMemoryPercent = "memory_percent"
+	MetricNetworkRx     = "network_rx"
+	MetricNetworkTx     = "network_tx"
+	MetricBlkioRead     = "blkio_read"
+	MetricBlkioWrite    = "blkio_write"
+	MetricPIDs          = "pids"
+)
+
+// Metric names recorded only for the host series
+const (
+	MetricMemoryTotal       = "memory_total"
+	MetricNCPU              = "ncpu"
+	MetricContainersRunning = "containers_running"
+	MetricContainersStopped = "containers_stopped"
+	MetricImages            = "images"
+)
+
+// Query errors
+var (
+	ErrSeriesNotFound = errors.New("series not found")
+	ErrInvalidRange   = errors.New("invalid time range")
+)
+
+// tierSpec describes one retention level of the store. A zero resolution
+// means raw samples are kept as-is.
+type tierSpec struct {
+	resolution time.Duration
+	retention  time.Duration
+}
+
+var storeTiers = []tierSpec{
+	{resolution: 0, retention: time.Hour},
+	{resolution: time.Minute, retention: 24 * time.Hour},
+	{resolution: 10 * time.Minute, retention: 30 * 24 * time.Hour},
+}
+
+// Store is an embedded time-series store. Every series keeps raw samples for
+// an hour plus one- and ten-minute rollups in fixed-size ring buffers, so
+// memory use is bounded regardless of uptime.
+type Store struct {
+	interval time.Duration
+
+	mu      sync.RWMutex
+	series  map[string]map[string]*series
+	aliases map[string]string
+}
+
+// NewStore creates a store for samples arriving at the given interval
+func NewStore(interval time.Duration) *Store {
+	return &Store{
+		interval: interval,
+		series:   make(map[string]map[string]*series),
+		aliases:  make(map[string]string),
+	}
+}
+
+// ObserveContainers records a sampling round from the stats collector
+func (s *Store) ObserveContainers(samples []docker.ContainerSample) {
+	now := time.Now()
+	for _, c := range samples {
+		ts := c.Stats.ReadTime
+		if ts.IsZero() {
+			ts = now
+		}
+
+		s.mu.Lock()
+		s.aliases[c.ID] = c.Name
+		s.mu.Unlock()
+
+		s.Record(c.Name, MetricCPUPercent, ts, c.Stats.CPU.UsagePercent)
+		s.Record(c.Name, MetricMemoryUsage, ts, float64(c.Stats.Memory.Usage))
+		s.Record(c.Name, MetricMemoryLimit, ts, float64(c.Stats.Memory.Limit))
+		s.Record(c.Name, MetricMemoryPercent, ts, c.Stats.Memory.Percent)
+		s.Record(c.Name, MetricNetworkRx, ts, float64(c.Stats.Network.RxBytes))
+		s.Record(c.Name, MetricNetworkTx, ts, float64(c.Stats.Network.TxBytes))
+		s.Record(c.Name, MetricBlkioRead, ts, float64(c.Stats.BlockIO.Read))
+		s.Record(c.Name, MetricBlkioWrite, ts, float64(c.Stats.BlockIO.Write))
+		s.Record(c.Name, MetricPIDs, ts, float64(c.Stats.PIDs))
+	}
+}
+
+// ObserveHost records daemon-wide totals from the stats collector
+func (s *Store) ObserveHost(h docker.HostSample) {
+	s.Record(HostSeries, MetricCPUPercent, h.Time, h.CPUPercent)
+	s.Record(HostSeries, MetricMemoryUsage, h.Time, float64(h.MemoryUsage))
+	s.Record(HostSeries, MetricMemoryTotal, h.Time, float64(h.MemTotal))
+	s.Record(HostSeries, MetricNCPU, h.Time, float64(h.NCPU))
+	s.Record(HostSeries, MetricContainersRunning, h.Time, float64(h.ContainersRunning))
+	s.Record(HostSeries, MetricContainersStopped, h.Time, float64(h.ContainersStopped))
+	s.Record(HostSeries, MetricImages, h.Time, float64(h.Images))
+
+	s.prune(h.Time)
+}
+
+// Record appends a sample to the series, creating it on first use
+func (s *Store) Record(container, metric string, ts time.Time, value float64) {
+	s.mu.Lock()
+	byMetric, ok := s.series[container]
+	if !ok {
+		byMetric = make(map[string]*series)
+		s.series[container] = byMetric
+	}
+	ser, ok := byMetric[metric]
+	if !ok {
+		ser = newSeries(s.interval)
+		byMetric[metric] = ser
+	}
+	s.mu.Unlock()
+
+	ser.add(ts, value)
+}
+
+// Query returns the points of a series between from and to. The tier is
+// picked by how far from reaches back from now, which should be the time
+// the range was resolved against. When step is larger than the resolution
+// of the best matching tier, points are further aggregated into step-sized
+// buckets.
+func (s *Store) Query(container, metric string, from, to, now time.Time, step time.Duration) ([]apitypes.MetricPoint, time.Duration, error) {
+	if !from.Before(to) {
+		return nil, 0, ErrInvalidRange
+	}
+
+	ser := s.lookup(container, metric)
+	if ser == nil {
+		return nil, 0, ErrSeriesNotFound
+	}
+
+	points, resolution := ser.query(from, to, now)
+	if step > resolution {
+		points = downsample(points, step)
+		resolution = step
+	}
+	return points, resolution, nil
+}
+
+// Series lists every series currently held by the store
+func (s *Store) Series() []apitypes.MetricSeries {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]apitypes.MetricSeries, 0)
+	for container, byMetric := range s.series {
+		for metric, ser := range byMetric {
+			result = append(result, apitypes.MetricSeries{
+				Container: container,
+				Metric:    metric,
+				LastSeen:  ser.lastSeen(),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Container != result[j].Container {
+			return result[i].Container < result[j].Container
+		}
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// lookup resolves a container by name, full ID or ID prefix
+func (s *Store) lookup(container, metric string) *series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.TrimPrefix(container, "/")
+	if _, ok := s.series[name]; !ok {
+		if alias, ok := s.aliases[name]; ok {
+			name = alias
+		} else {
+			for id, alias := range s.aliases {
+				if len(name) >= 12 && strings.HasPrefix(id, name) {
+					name = alias
+					break
+				}
+			}
+		}
+	}
+
+	byMetric, ok := s.series[name]
+	if !ok {
+		return nil
+	}
+	return byMetric[metric]
+}
+
+// prune drops series that have not been written for longer than the
+// longest retention, e.g. containers removed weeks ago.
+func (s *Store) prune(now time.Time) {
+	cutoff := now.Add(-storeTiers[len(storeTiers)-1].retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for container, byMetric := range s.series {
+		for metric, ser := range byMetric {
+			if ser.lastSeen().Before(cutoff) {
+				delete(byMetric, metric)
+			}
+		}
+		if len(byMetric) == 0 {
+			delete(s.series, container)
+			for id, alias := range s.aliases {
+				if alias == container {
+					delete(s.aliases, id)
+				}
+			}
+		}
+	}
+}
+
+type series struct {
+	mu    sync.Mutex
+	tiers []*tier
+	last  time.Time
+}
+
+func newSeries(interval time.Duration) *series {
+	ser := &series{}
+	for _, spec := range storeTiers {
+		resolution := spec.resolution
+		if resolution == 0 {
+			resolution = interval
+		}
+		ser.tiers = append(ser.tiers, &tier{
+			spec:       spec,
+			resolution: resolution,
+			capacity:   int(spec.retention / resolution),
+		})
+	}
+	return ser
+}
+
+func (s *series) add(ts time.Time, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ts.After(s.last) {
+		s.last = ts
+	}
+	for _, t := range s.tiers {
+		t.add(ts, value)
+	}
+}
+
+func (s *series) lastSeen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// query serves the range from the finest tier whose retention still covers
+// the start of the range.
+func (s *series) query(from, to, now time.Time) ([]apitypes.MetricPoint, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chosen := s.tiers[len(s.tiers)-1]
+	for _, t := range s.tiers {
+		if !from.Before(now.Add(-t.spec.retention)) {
+			chosen = t
+			break
+		}
+	}
+	return chosen.points(from, to), chosen.resolution
+}
+
+// tier is a ring buffer of points at a fixed resolution. Rollup tiers
+// accumulate samples into the current bucket and flush it once a sample
+// from a later bucket arrives.
+type tier struct {
+	spec       tierSpec
+	resolution time.Duration
+	capacity   int
+
+	ring  []apitypes.MetricPoint
+	start int
+
+	bucket time.Time
+	sum    float64
+	min    float64
+	max    float64
+	count  int
+}
+
+func (t *tier) add(ts time.Time, value float64) {
+	if t.spec.resolution == 0 {
+		t.push(apitypes.MetricPoint{Time: ts, Value: value, Min: value, Max: value})
+		return
+	}
+
+	bucket := ts.Truncate(t.resolution)
+	if t.count > 0 && !bucket.Equal(t.bucket) {
+		t.flush()
+	}
+	if t.count == 0 {
+		t.bucket = bucket
+		t.min = value
+		t.max = value
+	}
+	t.sum += value
+	t.min = math.Min(t.min, value)
+	t.max = math.Max(t.max, value)
+	t.count++
+}
+
+func (t *tier) flush() {
+	t.push(t.pending())
+	t.sum = 0
+	t.count = 0
+}
+
+func (t *tier) pending() apitypes.MetricPoint {
+	return apitypes.MetricPoint{
+		Time:  t.bucket,
+		Value: t.sum / float64(t.count),
+		Min:   t.min,
+		Max:   t.max,
+	}
+}
+
+func (t *tier) push(p apitypes.MetricPoint) {
+	if len(t.ring) < t.capacity {
+		t.ring = append(t.ring, p)
+		return
+	}
+	t.ring[t.start] = p
+	t.start = (t.start + 1) % t.capacity
+}
+
+func (t *tier) points(from, to time.Time) []apitypes.MetricPoint {
+	result := make([]apitypes.MetricPoint, 0)
+	for i := 0; i < len(t.ring); i++ {
+		p := t.ring[(t.start+i)%len(t.ring)]
+		if !p.Time.Before(from) && !p.Time.After(to) {
+			result = append(result, p)
+		}
+	}
+	if t.count > 0 && !t.bucket.Before(from) && !t.bucket.After(to) {
+		result = append(result, t.pending())
+	}
+	return result
+}
+
+// downsample merges points into step-aligned buckets
+func downsample(points []apitypes.MetricPoint, step time.Duration) []apitypes.MetricPoint {
+	result := make([]apitypes.MetricPoint, 0, len(points))
+	var sum float64
+	var count int
+
+	for _, p := range points {
+		bucket := p.Time.Truncate(step)
+		if count > 0 && !bucket.Equal(result[len(result)-1].Time) {
+			result[len(result)-1].Value = sum / float64(count)
+			count = 0
+		}
+		if count == 0 {
+			sum = 0
+			result = append(result, apitypes.MetricPoint{Time: bucket, Min: p.Min, Max: p.Max})
+		}
+		last := &result[len(result)-1]
+		sum += p.Value
+		last.Min = math.Min(last.Min, p.Min)
+		last.Max = math.Max(last.Max, p.Max)
+		count++
+	}
+	if count > 0 {
+		result[len(result)-1].Value = sum / float64(count)
+	}
+	return result
+}